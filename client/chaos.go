@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultRule injects faults into the exchanges of requests it matches, to simulate a bad
+// network or an unreliable service. Every matching rule applies.
+type FaultRule struct {
+	// Delay before the request is passed on, varied by up to Jitter either way
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bytes per second the request and response are slowed down to, or zero
+	Bandwidth int64
+
+	// Percentage of requests answered with ErrorStatus instead of being passed on
+	ErrorRate   float64
+	ErrorStatus int
+	// Percentage of requests whose connection is dropped after the local exchange
+	ResetRate float64
+
+	// Conditions on the public request. Empty conditions match every request.
+	Methods    []string
+	PathPrefix string
+}
+
+// ParseFaultRule parses a rule of the form KEY=VALUE[;KEY=VALUE...] with the keys
+// latency, jitter, bandwidth (bytes per second, with an optional k or m suffix),
+// error (PERCENT%[:STATUS]), reset (PERCENT%), path and method, for example
+// "latency=300ms;jitter=100ms;error=5%:502;path=/api".
+func ParseFaultRule(s string) (FaultRule, error) {
+	r := FaultRule{ErrorStatus: http.StatusServiceUnavailable}
+	for _, part := range strings.Split(s, ";") {
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			return FaultRule{}, fmt.Errorf("fault rule %q: expected KEY=VALUE, got %q", s, part)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(part[:eq])), strings.TrimSpace(part[eq+1:])
+
+		var err error
+		switch key {
+		case "latency":
+			r.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			r.Jitter, err = time.ParseDuration(value)
+		case "bandwidth":
+			r.Bandwidth, err = common.ParseSize(strings.TrimSuffix(strings.ToLower(value), "/s"))
+		case "error":
+			rate, status := value, ""
+			if i := strings.Index(value, ":"); i != -1 {
+				rate, status = value[:i], value[i+1:]
+			}
+			if r.ErrorRate, err = parsePercentage(rate); err == nil && status != "" {
+				r.ErrorStatus, err = strconv.Atoi(status)
+			}
+		case "reset":
+			r.ResetRate, err = parsePercentage(value)
+		case "path":
+			r.PathPrefix = strings.TrimSuffix(value, "*")
+		case "method":
+			r.Methods = strings.Split(strings.ToUpper(value), ",")
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return FaultRule{}, fmt.Errorf("fault rule %q: %w", s, err)
+		}
+	}
+
+	if err := r.validate(); err != nil {
+		return FaultRule{}, fmt.Errorf("fault rule %q: %w", s, err)
+	}
+	return r, nil
+}
+
+func parsePercentage(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+}
+
+func (r *FaultRule) validate() error {
+	if r.Latency < 0 || r.Jitter < 0 || r.Bandwidth < 0 {
+		return errors.New("latency, jitter and bandwidth must not be negative")
+	}
+	if r.ErrorRate < 0 || r.ErrorRate > 100 || r.ResetRate < 0 || r.ResetRate > 100 {
+		return errors.New("percentages must be between 0 and 100")
+	}
+	if r.ErrorRate > 0 && (r.ErrorStatus < 100 || r.ErrorStatus > 999) {
+		return fmt.Errorf("invalid error status %d", r.ErrorStatus)
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a public request
+func (r *FaultRule) matches(method, path string) bool {
+	if !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	faultRandMu sync.Mutex
+	faultRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// roll reports whether an event with a chance of percent happens
+func roll(percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	faultRandMu.Lock()
+	defer faultRandMu.Unlock()
+	return faultRand.Float64()*100 < percent
+}
+
+// jitter returns a random duration between -max and max
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	faultRandMu.Lock()
+	defer faultRandMu.Unlock()
+	return time.Duration(faultRand.Int63n(int64(2*max)+1)) - max
+}
+
+// faultPlan is what the fault rules matching a request decided to inject
+type faultPlan struct {
+	latency     time.Duration
+	bandwidth   int64 // the lowest of the matching rules, or zero
+	errorStatus int   // status to answer with instead of passing the request on, or zero
+	reset       bool
+}
+
+// planFaults rolls the fault rules matching a public request and lists the faults in
+// the exchange
+func (c *LeapClient) planFaults(ex *Exchange) *faultPlan {
+	plan := &faultPlan{}
+	if len(c.Config.FaultRules) == 0 {
+		return plan
+	}
+	method, path, _, err := parseRequestTarget(ex.RawRequest)
+	if err != nil {
+		return plan
+	}
+
+	for i := range c.Config.FaultRules {
+		rule := &c.Config.FaultRules[i]
+		if !rule.matches(method, path) {
+			continue
+		}
+		if rule.Latency > 0 || rule.Jitter > 0 {
+			plan.latency += rule.Latency + jitter(rule.Jitter)
+		}
+		if rule.Bandwidth > 0 && (plan.bandwidth == 0 || rule.Bandwidth < plan.bandwidth) {
+			plan.bandwidth = rule.Bandwidth
+		}
+		if plan.errorStatus == 0 && roll(rule.ErrorRate) {
+			plan.errorStatus = rule.ErrorStatus
+		}
+		if roll(rule.ResetRate) {
+			plan.reset = true
+		}
+	}
+
+	if plan.latency < 0 {
+		plan.latency = 0
+	}
+	if plan.latency > 0 {
+		ex.Faults = append(ex.Faults, "latency "+plan.latency.Round(time.Millisecond).String())
+	}
+	if plan.bandwidth > 0 {
+		ex.Faults = append(ex.Faults, fmt.Sprintf("bandwidth %dB/s", plan.bandwidth))
+	}
+	if plan.errorStatus != 0 {
+		// the request never reaches the local service, so there is nothing to drop
+		plan.reset = false
+		ex.Faults = append(ex.Faults, fmt.Sprintf("error %d", plan.errorStatus))
+	} else if plan.reset {
+		ex.Faults = append(ex.Faults, "reset")
+	}
+	return plan
+}
+
+// delay waits as long as sending size bytes takes at the planned bandwidth, plus extra
+func (p *faultPlan) delay(ctx context.Context, size int, extra time.Duration) error {
+	d := extra
+	if p.bandwidth > 0 {
+		d += time.Duration(int64(size) * int64(time.Second) / p.bandwidth)
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ErrCanceled
+	}
+}
+
+// errorResponse is the raw response of an injected error
+func (p *faultPlan) errorResponse() []byte {
+	m := Mock{
+		Status: p.errorStatus,
+		Header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:   []byte(fmt.Sprintf("Injected fault: %d %s\n", p.errorStatus, http.StatusText(p.errorStatus))),
+	}
+	return m.rawResponse()
+}
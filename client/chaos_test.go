@@ -0,0 +1,86 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFaultRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    FaultRule
+		wantErr bool
+	}{
+		{
+			in:   "latency=300ms",
+			want: FaultRule{Latency: 300 * time.Millisecond, ErrorStatus: 503},
+		},
+		{
+			in: "latency=300ms; jitter=100ms ;error=5%:502;path=/api*",
+			want: FaultRule{Latency: 300 * time.Millisecond, Jitter: 100 * time.Millisecond,
+				ErrorRate: 5, ErrorStatus: 502, PathPrefix: "/api"},
+		},
+		{
+			in:   "bandwidth=64k/s;method=get,Post",
+			want: FaultRule{Bandwidth: 64 << 10, ErrorStatus: 503, Methods: []string{"GET", "POST"}},
+		},
+		{
+			in:   "BANDWIDTH=1M",
+			want: FaultRule{Bandwidth: 1 << 20, ErrorStatus: 503},
+		},
+		{
+			in:   "error=12.5%;reset=1%",
+			want: FaultRule{ErrorRate: 12.5, ErrorStatus: 503, ResetRate: 1},
+		},
+		{in: "", wantErr: true},
+		{in: "latency", wantErr: true},
+		{in: "latency=fast", wantErr: true},
+		{in: "latency=-1s", wantErr: true},
+		{in: "error=150%", wantErr: true},
+		{in: "error=5%:oops", wantErr: true},
+		{in: "error=5%:42", wantErr: true},
+		{in: "reset=-1%", wantErr: true},
+		{in: "bandwidth=lots", wantErr: true},
+		{in: "drop=5%", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseFaultRule(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseFaultRule(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFaultRule(%q) error: %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFaultRule(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFaultRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule         FaultRule
+		method, path string
+		want         bool
+	}{
+		{FaultRule{}, "GET", "/", true},
+		{FaultRule{PathPrefix: "/api"}, "GET", "/api/users", true},
+		{FaultRule{PathPrefix: "/api"}, "GET", "/static", false},
+		{FaultRule{Methods: []string{"POST", "PUT"}}, "PUT", "/", true},
+		{FaultRule{Methods: []string{"POST", "PUT"}}, "GET", "/", false},
+		{FaultRule{PathPrefix: "/api", Methods: []string{"POST"}}, "POST", "/static", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.method, tt.path); got != tt.want {
+			t.Errorf("%+v.matches(%q, %q) = %v, want %v", tt.rule, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
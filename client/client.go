@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,15 +15,17 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
 const (
-	// Timeout for connecting to the local port and writing/reading data
-	localConnectionTimeout = time.Second * 10
-
 	// Timeout for gracefully disconnecting from the server
 	disconnectTimeout = time.Second * 5
+
+	// Bounds of the delay between reconnect attempts after losing the connection
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = time.Second * 30
 )
 
 type State uint8
@@ -33,6 +34,7 @@ const (
 	GettingToken State = iota
 	Connecting
 	Connected
+	Reconnecting
 	Disconnecting
 	Disconnected
 )
@@ -45,6 +47,8 @@ func (s State) String() string {
 		return "Connecting"
 	case Connected:
 		return "Connected"
+	case Reconnecting:
+		return "Reconnecting"
 	case Disconnecting:
 		return "Disconnecting"
 	case Disconnected:
@@ -55,34 +59,58 @@ func (s State) String() string {
 }
 
 var httpClient = &http.Client{
-	Timeout: time.Second * 5,
+	// long enough for the server to verify custom hostnames through DNS
+	Timeout: time.Second * 15,
 }
 
 type LeapClient struct {
 	Config *Config
 
 	ws            *websocket.Conn
+	compress      bool // whether the server accepts compressed responses
+	writeMu       sync.Mutex
 	closeReadChan chan bool
-	quitChan      chan bool
 
-	state State
+	// cancel functions of requests being handled, by request id
+	inflightMu sync.Mutex
+	inflight   map[uint64]context.CancelFunc
+
+	stateMu   sync.Mutex
+	state     State
 	subdomain string
+	domain    string // base domain the subdomain is under
+	recorder  *HARRecorder
+	exchanges *exchangeOrder
 
 	OnError       func(error)
 	OnConnect     func()
 	OnDisconnect  func()
 	OnStateChange func(State)
 	OnRequest     func(r *http.Request)
+	// OnExchange is called with the outcome of every request once it has been answered,
+	// failed or canceled
+	OnExchange func(e *Exchange)
+
+	// DialLocal opens the connection to the local service a request is routed to. It
+	// defaults to a TCP dial of addr.
+	DialLocal func(ctx context.Context, addr string) (net.Conn, error)
 }
 
 func New(config *Config) *LeapClient {
+	domain := config.BaseDomain
+	if domain == "" {
+		domain = config.Domain
+	}
+
 	return &LeapClient{
 		Config:        config,
 		closeReadChan: make(chan bool),
-		quitChan:      make(chan bool),
+		inflight:      make(map[uint64]context.CancelFunc),
+		exchanges:     newExchangeOrder(),
 
-		state: Disconnected,
+		state:     Disconnected,
 		subdomain: "?",
+		domain:    domain,
 	}
 }
 
@@ -90,30 +118,176 @@ func (c *LeapClient) Subdomain() string {
 	return c.subdomain
 }
 
+// LocalTarget describes where requests are passed to
+func (c *LeapClient) LocalTarget() string {
+	if c.Config.Dir != "" {
+		return c.Config.Dir
+	} else if c.Config.LocalPort == 0 {
+		return "mock responses"
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", c.Config.LocalPort)
+}
+
+// PublicURL returns the URL the tunnel is reachable at
+func (c *LeapClient) PublicURL() string {
+	return fmt.Sprintf("%s://%s.%s", c.Config.httpScheme(), c.subdomain, c.domain)
+}
+
+// State returns the state of the connection to the server
+func (c *LeapClient) State() State {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
 func (c *LeapClient) SetState(state State) {
-	if c.state != state {
-		c.state = state
-		if c.OnStateChange != nil {
-			c.OnStateChange(state)
-		}
+	c.stateMu.Lock()
+	changed := c.state != state
+	c.state = state
+	c.stateMu.Unlock()
+
+	if changed && c.OnStateChange != nil {
+		c.OnStateChange(state)
 	}
 }
 
 func (c *LeapClient) Run(ctx context.Context) error {
+	if c.Config.Dir != "" {
+		handler, err := NewFileServer(c.Config.Dir, c.Config.DirOptions)
+		if err != nil {
+			return err
+		}
+		return c.Serve(ctx, handler)
+	}
+
+	if err := c.startRecording(); err != nil {
+		return err
+	}
+	defer c.stopRecording()
+
+	if err := c.connect(ctx, c.Config.Subdomain); err != nil {
+		return err
+	}
+	return c.serveConnected(ctx)
+}
+
+// startRecording opens the HAR recording, if one is configured
+func (c *LeapClient) startRecording() error {
+	if c.Config.HARFile == "" {
+		return nil
+	}
+
+	recorder, err := NewHARRecorder(c.Config.HARFile, HAROptions{
+		MaxFileSize: c.Config.HARMaxFileSize,
+		MaxFiles:    c.Config.HARMaxFiles,
+		MaxBodySize: c.Config.HARMaxBodySize,
+		Scheme:      c.Config.httpScheme(),
+	})
+	if err != nil {
+		return err
+	}
+	c.recorder = recorder
+	return nil
+}
+
+func (c *LeapClient) stopRecording() {
+	if c.recorder != nil {
+		_ = c.recorder.Close()
+	}
+}
+
+// serveConnected serves the tunnel once connected, reconnecting whenever the connection
+// is lost, until ctx is done
+func (c *LeapClient) serveConnected(ctx context.Context) error {
+	for {
+		err := c.serve(ctx)
+		if err == nil {
+			c.SetState(Disconnected)
+			return nil
+		}
+
+		if c.OnError != nil {
+			c.OnError(fmt.Errorf("connection lost: %w", err))
+		}
+		if err := c.reconnect(ctx); err != nil {
+			c.SetState(Disconnected)
+			if errors.Is(err, context.Canceled) {
+				// stopped while reconnecting
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// connect obtains a connect token for the subdomain and opens the tunnel websocket
+func (c *LeapClient) connect(ctx context.Context, subdomain string) error {
 	c.SetState(GettingToken)
-	token, err := c.requestConnectToken()
+	token, err := c.requestConnectToken(subdomain)
 	if err != nil {
 		return fmt.Errorf("connect token: %w", err)
 	}
 
 	c.subdomain = token.Subdomain
+	if token.Domain != "" { // older servers don't name it
+		c.domain = token.Domain
+	}
 	c.SetState(Connecting)
-	if err := c.dialWebsocket(ctx, token.Token); err != nil {
+	if err := c.dialWebsocket(ctx, token); err != nil {
 		return err
 	}
 
+	for _, hostname := range c.Config.Hostnames {
+		if err := c.registerHostname(token.Token, hostname); err != nil {
+			_ = c.ws.Close()
+			return fmt.Errorf("register hostname %q: %w", hostname, err)
+		}
+	}
+
 	c.SetState(Connected)
-	dataChan := c.startReader()
+	return nil
+}
+
+// reconnect retries connecting to the current subdomain with exponential backoff
+// until it succeeds or ctx is done, in which case it returns ctx.Err()
+func (c *LeapClient) reconnect(ctx context.Context) error {
+	backoff := reconnectBackoffMin
+	for {
+		c.SetState(Reconnecting)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err := c.connect(ctx, c.subdomain)
+		if err == nil {
+			return nil
+		}
+		if c.OnError != nil {
+			c.OnError(fmt.Errorf("reconnect: %w", err))
+		}
+
+		backoff *= 2
+		if backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+	}
+}
+
+// serve handles requests on the current connection. It returns nil if the tunnel was
+// closed on purpose, either by ctx or by the server, and an error if the connection
+// was lost.
+func (c *LeapClient) serve(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	common.KeepAlive(c.ws, c.Config.PingInterval, c.Config.PingTimeout, done)
+
+	// requests are tied to the connection they arrived on
+	ws := c.ws
+	defer c.cancelAllRequests()
+
+	dataChan, lostChan := c.startReader()
 	for {
 		select {
 		case data := <-dataChan:
@@ -121,60 +295,144 @@ func (c *LeapClient) Run(ctx context.Context) error {
 				continue
 			}
 
-			if err := c.handleRequest(data); err != nil {
-				if c.OnError != nil {
-					c.OnError(fmt.Errorf("request error: %w", err))
+			reqCtx := c.trackRequest(ctx, data.ID)
+			seq := c.exchanges.arrived()
+			go func() {
+				defer c.cancelRequest(data.ID)
+				// injected resets are reported through OnExchange only
+				if err := c.handleRequest(reqCtx, ws, data, seq); err != nil && !errors.Is(err, ErrFaultReset) {
+					if c.OnError != nil {
+						c.OnError(fmt.Errorf("request error: %w", err))
+					}
 				}
-			}
+			}()
 		case <-ctx.Done():
 			if err := c.disconnectWebsocket(websocket.CloseNormalClosure); err != nil {
 				if c.OnError != nil {
 					c.OnError(fmt.Errorf("close error: %w", err))
 				}
 			}
-			return err
-		case <-c.quitChan:
 			return nil
+		case err := <-lostChan:
+			return err
 		}
 	}
 }
 
-func (c *LeapClient) dialWebsocket(ctx context.Context, token string) error {
+func (c *LeapClient) dialWebsocket(ctx context.Context, token *common.TokenResponse) error {
 	// Build URL with access token
-	wsURL := c.Config.getWsURL("/api/connect") + "?token=" + token
+	wsURL := c.Config.getWsURL("/api/connect") + "?token=" + token.Token
+
+	// compress traffic both ways if the server supports it
+	compress := false
+	if !c.Config.DisableCompression {
+		for _, encoding := range token.Encodings {
+			if encoding == common.EncodingGzip {
+				compress = true
+				wsURL += "&encoding=" + common.EncodingGzip
+			}
+		}
+	}
+
 	ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
 	if err != nil {
 		return fmt.Errorf("dial ws: %w", err)
 	}
+	ws.SetReadLimit(common.MaxMessageSize)
 
 	c.ws = ws
+	c.compress = compress
 	return nil
 }
 
-func (c *LeapClient) startReader() <-chan *common.RequestMessage {
+// startReader reads requests from the current connection. When the connection ends
+// without the client asking for it, the reason is sent on the returned error channel:
+// nil if the server closed the tunnel normally and the read error otherwise.
+func (c *LeapClient) startReader() (<-chan *common.RequestMessage, <-chan error) {
 	dataChan := make(chan *common.RequestMessage)
+	lostChan := make(chan error, 1)
+	ws := c.ws
 	go func() {
 		for {
-			var data common.RequestMessage
-			if err := c.ws.ReadJSON(&data); err != nil {
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			_, raw, err := ws.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) && c.State() == Disconnecting {
 					c.closeReadChan <- true
 				} else {
-					if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+					// a server restarting or draining asks to be left with CloseServiceRestart
+					if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseServiceRestart) {
 						log.Printf("Unexpectedly disconnected from leap server: %v\n", err)
 					}
 					// just terminate the connection
-					c.SetState(Disconnected)
-					c.quitChan <- true
-					_ = c.ws.Close()
+					_ = ws.Close()
+					if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+						lostChan <- nil
+					} else {
+						lostChan <- err
+					}
 				}
 				return
-			} else {
+			}
+
+			var message common.WSMessage
+			if err := json.Unmarshal(raw, &message); err != nil {
+				log.Printf("Malformed message from leap server: %v\n", err)
+				continue
+			}
+
+			switch message.MessageType() {
+			case common.Request:
+				var data common.RequestMessage
+				if err := json.Unmarshal(raw, &data); err != nil {
+					log.Printf("Malformed request from leap server: %v\n", err)
+					continue
+				}
 				dataChan <- &data
+			case common.Cancel:
+				var cancel common.CancelMessage
+				if err := json.Unmarshal(raw, &cancel); err == nil {
+					c.cancelRequest(cancel.ID)
+				}
 			}
 		}
 	}()
-	return dataChan
+	return dataChan, lostChan
+}
+
+// trackRequest derives a context for handling the request with the given id that is
+// canceled when the server cancels the request
+func (c *LeapClient) trackRequest(parent context.Context, id uint64) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	c.inflightMu.Lock()
+	c.inflight[id] = cancel
+	c.inflightMu.Unlock()
+	return ctx
+}
+
+func (c *LeapClient) cancelRequest(id uint64) {
+	c.inflightMu.Lock()
+	cancel, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.inflightMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (c *LeapClient) cancelAllRequests() {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	for id, cancel := range c.inflight {
+		cancel()
+		delete(c.inflight, id)
+	}
+}
+
+// writeJSON sends a message on ws, serializing writes from concurrent requests
+func (c *LeapClient) writeJSON(ws *websocket.Conn, v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return ws.WriteJSON(v)
 }
 
 func (c *LeapClient) disconnectWebsocket(code int) error {
@@ -198,9 +456,14 @@ func (c *LeapClient) disconnectWebsocket(code int) error {
 	return c.ws.Close()
 }
 
-func (c *LeapClient) requestConnectToken() (*common.TokenResponse, error) {
+func (c *LeapClient) requestConnectToken(subdomain string) (*common.TokenResponse, error) {
 	payload := common.SubdomainRequest{
-		Subdomain: c.Config.Subdomain,
+		Subdomain: subdomain,
+		Group:     c.Config.GroupKey != "",
+		GroupKey:  c.Config.GroupKey,
+		Balance:   c.Config.Balance,
+		APIKey:    c.Config.APIKey,
+		Domain:    c.Config.BaseDomain,
 	}
 
 	b, err := json.Marshal(payload)
@@ -219,6 +482,12 @@ func (c *LeapClient) requestConnectToken() (*common.TokenResponse, error) {
 	if resp.StatusCode != http.StatusOK {
 		if resp.StatusCode == http.StatusConflict {
 			return nil, ErrSubdomainOccupied
+		} else if resp.StatusCode == http.StatusForbidden {
+			return nil, ErrGroupKeyRejected
+		} else if resp.StatusCode == http.StatusUnauthorized {
+			return nil, ErrAPIKeyRejected
+		} else if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w until %s", ErrQuotaExceeded, resp.Header.Get("X-Leap-Quota-Reset"))
 		} else {
 			body, _ := ioutil.ReadAll(resp.Body)
 			fmt.Printf("%d %s\n", resp.StatusCode, string(body))
@@ -238,20 +507,58 @@ func (c *LeapClient) requestConnectToken() (*common.TokenResponse, error) {
 	return &token, nil
 }
 
-func (c *LeapClient) handleRequest(data *common.RequestMessage) error {
-	dialLocal := func() (net.Conn, error) {
-		d := net.Dialer{
-			Timeout:   time.Second * 5,
-			KeepAlive: -1,
-		}
-		return d.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", c.Config.LocalPort))
+// registerHostname binds a custom hostname to the tunnel. The server only accepts it
+// if the hostname's DNS records point at the leap server.
+func (c *LeapClient) registerHostname(token, hostname string) error {
+	payload := common.HostnameRequest{
+		Token:    token,
+		Hostname: hostname,
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+
+	hostnameURL := c.Config.getHttpURL("/api/hostname")
+	resp, err := httpClient.Post(hostnameURL, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return fmt.Errorf("hostname register: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%w: %s", ErrHostnameRejected, string(body))
+	}
+	return nil
+}
+
+// handleRequest answers the seq-th request received through the tunnel
+func (c *LeapClient) handleRequest(ctx context.Context, ws *websocket.Conn, data *common.RequestMessage, seq uint64) (err error) {
+	ex := &Exchange{
+		ID:    data.ID,
+		Start: time.Now(),
+	}
+	if c.OnExchange != nil || c.recorder != nil {
+		defer func() {
+			ex.finish(err)
+			c.exchanges.done(seq, ex, c.reportExchange)
+		}()
 	}
 
-	decodedBytes, err := base64.StdEncoding.DecodeString(data.Data)
+	replyError := func(code common.ErrorCode) {
+		ex.ErrorCode = &code
+		_ = c.writeJSON(ws, common.NewResponseErrorMessage(data.ID, code))
+	}
+
+	decodedBytes, err := data.DecodeRequest()
 	if err != nil {
-		_ = c.ws.WriteJSON(common.NewResponseErrorMessage(common.InternalError))
+		replyError(common.InternalError)
 		return fmt.Errorf("decode data: %w", err)
 	}
+	ex.RawRequest = decodedBytes
 
 	if c.OnRequest != nil {
 		req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(decodedBytes)))
@@ -262,29 +569,179 @@ func (c *LeapClient) handleRequest(data *common.RequestMessage) error {
 		}
 	}
 
-	localConn, err := dialLocal()
+	addr, decodedBytes, err := c.routeRequest(decodedBytes)
+	if err != nil {
+		replyError(common.InternalError)
+		return fmt.Errorf("route request: %w", err)
+	}
+
+	decodedBytes, err = c.applyHeaderRules(RequestHeaders, ex.RawRequest, decodedBytes)
 	if err != nil {
-		_ = c.ws.WriteJSON(common.NewResponseErrorMessage(common.Unavailable))
-		return fmt.Errorf("dial local: %w", err)
+		replyError(common.InternalError)
+		return fmt.Errorf("rewrite request headers: %w", err)
+	}
+
+	faults := c.planFaults(ex)
+	if err := faults.delay(ctx, len(decodedBytes), faults.latency); err != nil {
+		return err
+	}
+
+	// mocks take precedence over the local service unless they are only a fallback
+	noLocal := addr == "" && c.DialLocal == nil
+	var rawResponse []byte
+	var mocked bool
+	if faults.errorStatus != 0 {
+		rawResponse, mocked = faults.errorResponse(), true
+	} else if !c.Config.MockFallback || noLocal {
+		rawResponse, mocked = c.mockResponse(ex.RawRequest, noLocal)
+	}
+	if !mocked {
+		var code common.ErrorCode
+		rawResponse, code, err = c.exchangeLocal(ctx, addr, decodedBytes)
+		if err != nil && code == common.Unavailable && c.Config.MockFallback && !errors.Is(err, ErrCanceled) {
+			rawResponse, mocked = c.mockResponse(ex.RawRequest, false)
+		}
+		if err != nil && !mocked {
+			if !errors.Is(err, ErrCanceled) {
+				replyError(code)
+			}
+			return err
+		}
+	}
+
+	rawResponse, err = c.applyHeaderRules(ResponseHeaders, ex.RawRequest, rawResponse)
+	if err != nil {
+		replyError(common.InternalError)
+		return fmt.Errorf("rewrite response headers: %w", err)
+	}
+
+	if err := faults.delay(ctx, len(rawResponse), 0); err != nil {
+		return err
+	}
+	if faults.reset {
+		// an empty response makes the server close the public connection without one
+		_ = c.writeJSON(ws, common.NewResponseDataMessage(data.ID, "", ""))
+		return ErrFaultReset
+	}
+
+	ex.RawResponse = rawResponse
+	encoded, encoding := common.EncodePayload(rawResponse, c.compress)
+	_ = c.writeJSON(ws, common.NewResponseDataMessage(data.ID, encoded, encoding))
+	return nil
+}
+
+// exchangeLocal passes a request to the local service at addr and returns its raw
+// response. If the exchange fails, it also returns the error code to report to the
+// server, unless the error is ErrCanceled.
+func (c *LeapClient) exchangeLocal(ctx context.Context, addr string, request []byte) ([]byte, common.ErrorCode, error) {
+	var localConn net.Conn
+	var err error
+	if c.DialLocal != nil {
+		localConn, err = c.DialLocal(ctx, addr)
+	} else {
+		d := net.Dialer{
+			Timeout:   c.Config.DialTimeout,
+			KeepAlive: -1,
+		}
+		localConn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ErrCanceled
+		}
+		return nil, common.Unavailable, fmt.Errorf("dial local: %w", err)
 	}
 	defer localConn.Close()
-	_ = localConn.SetDeadline(time.Now().Add(localConnectionTimeout))
 
-	_, err = localConn.Write(decodedBytes)
+	var deadline time.Time
+	if c.Config.Timeout > 0 {
+		deadline = time.Now().Add(c.Config.Timeout)
+	}
+	_ = localConn.SetDeadline(deadline)
+
+	// abort the local exchange if the server gives up on the request
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = localConn.Close()
+		case <-stop:
+		}
+	}()
+
+	_, err = localConn.Write(request)
 	if err != nil {
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			_ = c.ws.WriteJSON(common.NewResponseErrorMessage(common.Timeout))
-			return ErrTimeout
+		if ctx.Err() != nil {
+			return nil, 0, ErrCanceled
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, common.Timeout, ErrTimeout
 		} else {
-			_ = c.ws.WriteJSON(common.NewResponseErrorMessage(common.InternalError))
-			return fmt.Errorf("write local: %w", err)
+			return nil, common.InternalError, fmt.Errorf("write local: %w", err)
 		}
 	}
 
+	rawResponse, err := c.readLocalResponse(localConn, deadline)
+	if ctx.Err() != nil {
+		return nil, 0, ErrCanceled
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, common.Timeout, ErrTimeout
+	} else if errors.Is(err, ErrResponseTooLarge) {
+		return nil, common.PayloadTooLarge, err
+	} else if err != nil {
+		return nil, common.InternalError, fmt.Errorf("read local: %w", err)
+	}
+	return rawResponse, 0, nil
+}
+
+func (c *LeapClient) reportExchange(ex *Exchange) {
+	if c.recorder != nil {
+		if err := c.recorder.Record(ex); err != nil {
+			err = fmt.Errorf("record exchange: %w", err)
+			if c.OnError != nil {
+				c.OnError(err)
+			} else {
+				log.Println(err)
+			}
+		}
+	}
+	if c.OnExchange != nil {
+		c.OnExchange(ex)
+	}
+}
+
+// readLocalResponse reads the raw response from the local service until it closes the
+// connection, enforcing the response header timeout and size limit
+func (c *LeapClient) readLocalResponse(conn net.Conn, deadline time.Time) ([]byte, error) {
+	// the server drops the connection rather than read a larger response
+	max := int64(common.MaxPayloadSize)
+	if c.Config.MaxResponseSize > 0 && c.Config.MaxResponseSize < max {
+		max = c.Config.MaxResponseSize
+	}
+	src := io.LimitReader(conn, max+1)
+
 	var buf bytes.Buffer
-	_, _ = io.Copy(&buf, localConn)
+	tee := io.TeeReader(src, &buf)
 
-	encodedBytes := base64.StdEncoding.EncodeToString(buf.Bytes())
-	_ = c.ws.WriteJSON(common.NewResponseDataMessage(encodedBytes))
-	return nil
+	if c.Config.ResponseHeaderTimeout > 0 {
+		headerDeadline := time.Now().Add(c.Config.ResponseHeaderTimeout)
+		if deadline.IsZero() || headerDeadline.Before(deadline) {
+			_ = conn.SetReadDeadline(headerDeadline)
+		}
+
+		// everything consumed while parsing the header is captured by tee
+		if _, err := http.ReadResponse(bufio.NewReader(tee), nil); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(deadline)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > max {
+		return nil, ErrResponseTooLarge
+	}
+
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,543 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer stands in for a leap server, handing the test every tunnel connection
+type fakeServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	subdomains []string // requested for every token, in order
+	conns      chan *websocket.Conn
+}
+
+func newFakeServer() *fakeServer {
+	s := &fakeServer{conns: make(chan *websocket.Conn, 4)}
+	var upgrader websocket.Upgrader
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		var sr common.SubdomainRequest
+		if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.subdomains = append(s.subdomains, sr.Subdomain)
+		token := fmt.Sprintf("token%d", len(s.subdomains))
+		s.mu.Unlock()
+
+		if sr.Subdomain == "" {
+			sr.Subdomain = "random"
+		}
+		_ = json.NewEncoder(w).Encode(common.TokenResponse{Subdomain: sr.Subdomain, Domain: "leap.example.com", Token: token})
+	})
+	mux.HandleFunc("/api/connect", func(w http.ResponseWriter, r *http.Request) {
+		if ws, err := upgrader.Upgrade(w, r, nil); err == nil {
+			s.conns <- ws
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// config returns a client config connecting to the server
+func (s *fakeServer) config() *Config {
+	return &Config{Domain: strings.TrimPrefix(s.URL, "http://")}
+}
+
+// accept returns the next tunnel connection
+func (s *fakeServer) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+	select {
+	case ws := <-s.conns:
+		return ws
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client didn't connect")
+		return nil
+	}
+}
+
+func (s *fakeServer) requestedSubdomains() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.subdomains...)
+}
+
+// discard reads from ws until it closes, answering pings and close messages
+func discard(ws *websocket.Conn) {
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// sendRequest sends a raw request through the tunnel
+func sendRequest(t *testing.T, ws *websocket.Conn, id uint64, raw string) {
+	t.Helper()
+	encoded, encoding := common.EncodePayload([]byte(raw), false)
+	if err := ws.WriteJSON(common.NewRequestMessage(id, encoded, encoding)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readReply returns the next response_data or response_error message from the client
+func readReply(t *testing.T, ws *websocket.Conn) (common.MessageType, []byte) {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, raw, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("no reply from the client: %v", err)
+		}
+		var message common.WSMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			t.Fatal(err)
+		}
+		if typ := message.MessageType(); typ == common.ResponseData || typ == common.ResponseError {
+			return typ, raw
+		}
+	}
+}
+
+// run runs c until the returned function is called, which returns the result of Run
+func run(c *LeapClient) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Run(ctx)
+	}()
+	return func() error {
+		cancel()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(10 * time.Second):
+			return fmt.Errorf("Run didn't return")
+		}
+	}
+}
+
+// stateRecorder collects the states a client goes through
+type stateRecorder struct {
+	mu      sync.Mutex
+	states  []State
+	changed chan struct{}
+}
+
+func recordStates(c *LeapClient) *stateRecorder {
+	r := &stateRecorder{changed: make(chan struct{}, 1)}
+	c.OnStateChange = func(state State) {
+		r.mu.Lock()
+		r.states = append(r.states, state)
+		r.mu.Unlock()
+		select {
+		case r.changed <- struct{}{}:
+		default:
+		}
+	}
+	return r
+}
+
+func (r *stateRecorder) get() []State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]State(nil), r.states...)
+}
+
+// waitFor waits until the client has gone through states, in order, since the recording
+// started
+func (r *stateRecorder) waitFor(t *testing.T, states ...State) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		seen := r.get()
+		i := 0
+		for _, state := range seen {
+			if i < len(states) && state == states[i] {
+				i++
+			}
+		}
+		if i == len(states) {
+			return
+		}
+
+		select {
+		case <-r.changed:
+		case <-timeout:
+			t.Fatalf("went through %v, want %v", seen, states)
+		}
+	}
+}
+
+func TestSetState(t *testing.T) {
+	c := New(&Config{Domain: "leap.example.com"})
+	var changes []State
+	c.OnStateChange = func(state State) {
+		changes = append(changes, state)
+	}
+
+	// read by the connection reader while the state changes
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = c.State()
+		}
+	}()
+	for _, state := range []State{GettingToken, Connecting, Connecting, Connected, Disconnecting, Disconnected} {
+		c.SetState(state)
+	}
+	wg.Wait()
+
+	want := []State{GettingToken, Connecting, Connected, Disconnecting, Disconnected}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("state changes = %v, want %v", changes, want)
+	}
+	if c.State() != Disconnected {
+		t.Errorf("State() = %v, want %v", c.State(), Disconnected)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name         string
+		pingInterval time.Duration
+		// loses the connection to the client
+		lose func(ws *websocket.Conn)
+	}{
+		{
+			name: "connection dropped",
+			lose: func(ws *websocket.Conn) { _ = ws.Close() },
+		},
+		{
+			name: "server restarting",
+			lose: func(ws *websocket.Conn) {
+				_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "draining"))
+			},
+		},
+		{
+			// pongs are only sent while the server reads, which it never does
+			name:         "pings unanswered",
+			pingInterval: 50 * time.Millisecond,
+			lose:         func(ws *websocket.Conn) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer()
+			defer server.Close()
+
+			config := server.config()
+			config.PingInterval = tt.pingInterval
+			config.PingTimeout = tt.pingInterval
+			c := New(config)
+			states := recordStates(c)
+			stop := run(c)
+
+			first := server.accept(t)
+			defer first.Close()
+			states.waitFor(t, Connected)
+			tt.lose(first)
+
+			second := server.accept(t)
+			go discard(second)
+			states.waitFor(t, Connected, Reconnecting, Connected)
+			if err := stop(); err != nil {
+				t.Errorf("Run() = %v, want nil", err)
+			}
+
+			// the assigned subdomain is kept
+			if got, want := server.requestedSubdomains(), []string{"", "random"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("requested subdomains %q, want %q", got, want)
+			}
+			if c.State() != Disconnected {
+				t.Errorf("State() = %v, want %v", c.State(), Disconnected)
+			}
+		})
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	c := New(server.config())
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Run(context.Background())
+	}()
+
+	ws := server.accept(t)
+	defer ws.Close()
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Run() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the server closed the tunnel")
+	}
+	if got := server.requestedSubdomains(); len(got) != 1 {
+		t.Errorf("requested %d tokens, want no reconnect", len(got))
+	}
+}
+
+func TestCancelWhileReconnecting(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	c := New(server.config())
+	states := recordStates(c)
+	stop := run(c)
+
+	ws := server.accept(t)
+	_ = ws.Close()
+	states.waitFor(t, Connected, Reconnecting)
+	if err := stop(); err != nil {
+		t.Errorf("Run() = %v, want nil", err)
+	}
+	if c.State() != Disconnected {
+		t.Errorf("State() = %v, want %v", c.State(), Disconnected)
+	}
+	if got := server.requestedSubdomains(); len(got) != 1 {
+		t.Errorf("requested %d tokens, want no reconnect", len(got))
+	}
+}
+
+// startLocal serves handler as the local service of config
+func startLocal(config *Config, handler http.Handler) *httptest.Server {
+	local := httptest.NewServer(handler)
+	config.LocalPort = local.Listener.Addr().(*net.TCPAddr).Port
+	return local
+}
+
+func TestCancelRequest(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	config := server.config()
+	localCanceled := make(chan struct{})
+	local := startLocal(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			close(localCanceled)
+			return
+		}
+		_, _ = io.WriteString(w, "fast")
+	}))
+	defer local.Close()
+
+	c := New(config)
+	exchanges := make(chan *Exchange, 2)
+	c.OnExchange = func(ex *Exchange) {
+		exchanges <- ex
+	}
+	stop := run(c)
+	ws := server.accept(t)
+
+	sendRequest(t, ws, 1, "GET /slow HTTP/1.1\r\nHost: foo.leap.example.com\r\nConnection: close\r\n\r\n")
+	sendRequest(t, ws, 2, "GET /fast HTTP/1.1\r\nHost: foo.leap.example.com\r\nConnection: close\r\n\r\n")
+	typ, raw := readReply(t, ws)
+	var reply common.ResponseDataMessage
+	if err := json.Unmarshal(raw, &reply); err != nil || typ != common.ResponseData || reply.ID != 2 {
+		t.Fatalf("first reply = %s, want the response to 2", raw)
+	}
+
+	if err := ws.WriteJSON(common.NewCancelMessage(1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-localCanceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the local request wasn't canceled")
+	}
+
+	// exchanges are reported in the order their requests arrived
+	for _, want := range []struct {
+		id  uint64
+		err error
+	}{{1, ErrCanceled}, {2, nil}} {
+		select {
+		case ex := <-exchanges:
+			if ex.ID != want.id || !errors.Is(ex.Err, want.err) || ex.ErrorCode != nil {
+				t.Errorf("exchange %d failed with %v, code %v, want %d with %v", ex.ID, ex.Err, ex.ErrorCode, want.id, want.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("exchange %d wasn't reported", want.id)
+		}
+	}
+
+	// nothing is sent back for the canceled request
+	sendRequest(t, ws, 3, "GET /fast HTTP/1.1\r\nHost: foo.leap.example.com\r\nConnection: close\r\n\r\n")
+	if _, raw := readReply(t, ws); json.Unmarshal(raw, &reply) != nil || reply.ID != 3 {
+		t.Errorf("reply = %s, want the response to 3", raw)
+	}
+
+	go discard(ws)
+	if err := stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocalLimits(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-header":
+			time.Sleep(300 * time.Millisecond)
+		case "/slow-body":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		case "/large":
+			_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+	port := local.Listener.Addr().(*net.TCPAddr).Port
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	_ = closed.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		closed bool
+		config Config
+		// the error code replied, or nil for a response
+		code *common.ErrorCode
+	}{
+		{name: "response", path: "/"},
+		{name: "unavailable", path: "/", closed: true, code: codeOf(common.Unavailable)},
+		{name: "within the header timeout", path: "/slow-body", config: Config{ResponseHeaderTimeout: 100 * time.Millisecond}},
+		{name: "response header timeout", path: "/slow-header", config: Config{ResponseHeaderTimeout: 100 * time.Millisecond}, code: codeOf(common.Timeout)},
+		{name: "timeout", path: "/slow-body", config: Config{Timeout: 100 * time.Millisecond}, code: codeOf(common.Timeout)},
+		{name: "within the size limit", path: "/", config: Config{MaxResponseSize: 1000}},
+		{name: "response too large", path: "/large", config: Config{MaxResponseSize: 1000}, code: codeOf(common.PayloadTooLarge)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer()
+			defer server.Close()
+
+			config := tt.config
+			config.Domain = server.config().Domain
+			config.LocalPort = port
+			if tt.closed {
+				config.LocalPort = closedPort
+			}
+			c := New(&config)
+			stop := run(c)
+			ws := server.accept(t)
+
+			sendRequest(t, ws, 1, "GET "+tt.path+" HTTP/1.1\r\nHost: foo.leap.example.com\r\nConnection: close\r\n\r\n")
+			typ, raw := readReply(t, ws)
+			if tt.code == nil {
+				var reply common.ResponseDataMessage
+				_ = json.Unmarshal(raw, &reply)
+				if response, err := reply.DecodeResponse(); typ != common.ResponseData || err != nil || !bytes.Contains(response, []byte("ok")) {
+					t.Errorf("reply = %s, want a response", raw)
+				}
+			} else {
+				var reply common.ResponseErrorMessage
+				if err := json.Unmarshal(raw, &reply); err != nil || typ != common.ResponseError || reply.Code != *tt.code {
+					t.Errorf("reply = %s, want the error code %v", raw, *tt.code)
+				}
+			}
+
+			go discard(ws)
+			if err := stop(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func codeOf(code common.ErrorCode) *common.ErrorCode {
+	return &code
+}
+
+func TestOnExchange(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	config := server.config()
+	local := startLocal(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "local")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, "created")
+	}))
+	defer local.Close()
+
+	c := New(config)
+	exchanges := make(chan *Exchange, 1)
+	c.OnExchange = func(ex *Exchange) {
+		exchanges <- ex
+	}
+	stop := run(c)
+	ws := server.accept(t)
+
+	request := "POST /items HTTP/1.1\r\nHost: foo.leap.example.com\r\nContent-Length: 4\r\nConnection: close\r\n\r\nitem"
+	sendRequest(t, ws, 7, request)
+	typ, raw := readReply(t, ws)
+	var reply common.ResponseDataMessage
+	if err := json.Unmarshal(raw, &reply); err != nil || typ != common.ResponseData {
+		t.Fatalf("reply = %s, want a response", raw)
+	}
+	response, _ := reply.DecodeResponse()
+
+	var ex *Exchange
+	select {
+	case ex = <-exchanges:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the exchange wasn't reported")
+	}
+	if ex.ID != 7 || ex.Start.IsZero() || ex.Duration <= 0 || ex.Err != nil || ex.ErrorCode != nil {
+		t.Errorf("exchange = %+v, want request 7 answered", ex)
+	}
+	if ex.Request == nil || ex.Request.Method != http.MethodPost || ex.Request.URL.Path != "/items" {
+		t.Errorf("request = %+v, want POST /items", ex.Request)
+	}
+	if string(ex.RawRequest) != request || ex.RequestBytes != int64(len(request)) {
+		t.Errorf("raw request = %q (%d bytes), want %q", ex.RawRequest, ex.RequestBytes, request)
+	}
+	if ex.StatusCode != http.StatusCreated || ex.ResponseHeader.Get("X-Served-By") != "local" {
+		t.Errorf("response = %d %v, want 201 from the local service", ex.StatusCode, ex.ResponseHeader)
+	}
+	if !bytes.Equal(ex.RawResponse, response) || ex.ResponseBytes != int64(len(response)) {
+		t.Errorf("raw response = %q (%d bytes), want what was sent back: %q", ex.RawResponse, ex.ResponseBytes, response)
+	}
+
+	go discard(ws)
+	if err := stop(); err != nil {
+		t.Error(err)
+	}
+}
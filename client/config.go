@@ -1,12 +1,74 @@
 package client
 
-import "net/url"
+import (
+	"net/url"
+	"time"
+)
 
 type Config struct {
 	Domain    string
 	Subdomain string
 	LocalPort int
 	Secure    bool
+
+	// Key to open tunnels with, for servers that require one
+	APIKey string
+
+	// Base domain to open the tunnel under, for servers serving several, or empty for
+	// Domain
+	BaseDomain string
+
+	// Share the subdomain with other clients using the same key. The first client of
+	// the group picks how requests are balanced (see common.BalanceRoundRobin).
+	GroupKey string
+	Balance  string
+
+	// Custom hostnames to bind to the tunnel. Each must have a CNAME record pointing at
+	// the leap server.
+	Hostnames []string
+
+	// Routes sending requests to other local services by path. Requests matching no
+	// route go to LocalPort.
+	Routes []Route
+
+	// Canned responses for requests by path. Unless MockFallback is set, they take
+	// precedence over local services, and LocalPort may be zero to only serve mocks.
+	// With MockFallback, they only answer when the local service is unreachable.
+	Mocks        []Mock
+	MockFallback bool
+
+	// Directory whose files are served by the client itself instead of a local service.
+	// LocalPort and the targets of Routes are then ignored.
+	Dir        string
+	DirOptions FileServerOptions
+
+	// Edits of the headers of requests to local services and their responses
+	HeaderRules []HeaderRule
+
+	// Faults injected into matching exchanges to simulate a bad network
+	FaultRules []FaultRule
+
+	// Limits on the exchange with the local service. Zero values disable the limit.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeout               time.Duration
+	// Responses are never larger than common.MaxPayloadSize, whatever the limit
+	MaxResponseSize int64
+
+	// File every exchange is recorded to in HAR format, or empty to disable recording
+	HARFile string
+	// Limits of the recording. See HAROptions.
+	HARMaxFileSize int64
+	HARMaxFiles    int
+	HARMaxBodySize int64
+
+	// How often the server is pinged, or zero to disable keepalive
+	PingInterval time.Duration
+	// How long the server may take to answer a ping before the client reconnects
+	PingTimeout time.Duration
+
+	// Send responses uncompressed, and don't ask the server to compress requests
+	DisableCompression bool
 }
 
 func (cfg *Config) getURL(scheme, path string) string {
@@ -3,7 +3,14 @@ package client
 import "errors"
 
 var (
-	ErrTimeout = errors.New("connection timed out")
-	ErrSubdomainOccupied = errors.New("subdomain occupied")
+	ErrTimeout            = errors.New("connection timed out")
+	ErrCanceled           = errors.New("request canceled by server")
+	ErrResponseTooLarge   = errors.New("response exceeded size limit")
+	ErrFaultReset         = errors.New("connection reset by fault rule")
+	ErrHostnameRejected   = errors.New("custom hostname rejected")
+	ErrGroupKeyRejected   = errors.New("group key rejected")
+	ErrAPIKeyRejected     = errors.New("api key rejected")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrSubdomainOccupied  = errors.New("subdomain occupied")
 	ErrConnectTokenFailed = errors.New("failed to obtain connect token")
 )
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/dnsge/leap/common"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Exchange is a request received through the tunnel and its outcome
+type Exchange struct {
+	// ID of the request within the tunnel connection
+	ID       uint64
+	Start    time.Time
+	Duration time.Duration
+
+	// The request as received from the server, before any route rewrote it. Request is
+	// parsed from RawRequest and is nil if it is malformed. Its body can only be read
+	// once, so callbacks sharing the exchange should read RawRequest instead.
+	Request    *http.Request
+	RawRequest []byte
+
+	// The response of the local service as sent back through the tunnel. StatusCode is
+	// zero if there was none.
+	StatusCode     int
+	ResponseHeader http.Header
+	RawResponse    []byte
+
+	// Sizes of the raw request and response, headers included
+	RequestBytes  int64
+	ResponseBytes int64
+
+	// Faults injected by Config.FaultRules, e.g. "latency 250ms" or "reset"
+	Faults []string
+
+	// Sent to the server instead of a response, if the local exchange failed
+	ErrorCode *common.ErrorCode
+	// Why the exchange failed, if it did. ErrCanceled means the server gave up on the
+	// request, in which case nothing was sent back.
+	Err error
+}
+
+// finish records the outcome of the exchange, parsing the raw messages
+func (e *Exchange) finish(err error) {
+	e.Duration = time.Since(e.Start)
+	e.Err = err
+	e.RequestBytes = int64(len(e.RawRequest))
+	e.ResponseBytes = int64(len(e.RawResponse))
+
+	if e.RawRequest != nil {
+		e.Request, _ = http.ReadRequest(bufio.NewReader(bytes.NewReader(e.RawRequest)))
+	}
+	if e.RawResponse != nil {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(e.RawResponse)), e.Request)
+		if err == nil {
+			e.StatusCode = resp.StatusCode
+			e.ResponseHeader = resp.Header
+		}
+	}
+}
+
+// Response parses the raw response again, so that its body can be read, or returns
+// nil if there was no valid response
+func (e *Exchange) Response() *http.Response {
+	if e.RawResponse == nil {
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(e.RawResponse)), e.Request)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// exchangeOrder passes finished exchanges on in the order their requests arrived, which
+// is the order HAR entries are expected in. A slow request holds back those after it.
+type exchangeOrder struct {
+	mu       sync.Mutex
+	issued   uint64
+	next     uint64
+	finished map[uint64]*Exchange
+
+	// held while passing exchanges on, taken before mu is released so that batches
+	// are passed on in order
+	reportMu sync.Mutex
+}
+
+func newExchangeOrder() *exchangeOrder {
+	return &exchangeOrder{finished: make(map[uint64]*Exchange)}
+}
+
+// arrived returns the sequence number of a request that just arrived
+func (o *exchangeOrder) arrived() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seq := o.issued
+	o.issued++
+	return seq
+}
+
+// done passes the exchange of request seq to report once those of every earlier request
+// have been
+func (o *exchangeOrder) done(seq uint64, ex *Exchange, report func(*Exchange)) {
+	o.mu.Lock()
+	o.finished[seq] = ex
+	var ready []*Exchange
+	for {
+		next, ok := o.finished[o.next]
+		if !ok {
+			break
+		}
+		delete(o.finished, o.next)
+		ready = append(ready, next)
+		o.next++
+	}
+	if len(ready) == 0 {
+		o.mu.Unlock()
+		return
+	}
+	o.reportMu.Lock()
+	o.mu.Unlock()
+
+	defer o.reportMu.Unlock()
+	for _, ex := range ready {
+		report(ex)
+	}
+}
@@ -0,0 +1,427 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The HAR types follow version 1.2 of the format: http://www.softwareishard.com/blog/har-12-spec/
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	// Why the local service did not respond, if it didn't
+	Error string `json:"_error,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// NewHAR returns an empty HAR document
+func NewHAR() *HAR {
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "leap", Version: "1.0"},
+		Entries: []*HAREntry{},
+	}}
+}
+
+// NewHAREntry converts an exchange to a HAR entry, keeping at most maxBodySize bytes of
+// each body, or whole bodies if maxBodySize is zero. scheme is the scheme the request was
+// made with publicly.
+func NewHAREntry(ex *Exchange, scheme string, maxBodySize int64) (*HAREntry, error) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(ex.RawRequest)))
+	if err != nil {
+		return nil, fmt.Errorf("parse request: %w", err)
+	}
+
+	u := *r.URL
+	u.Scheme = scheme
+	u.Host = r.Host
+
+	ms := float64(ex.Duration) / float64(time.Millisecond)
+	e := &HAREntry{
+		StartedDateTime: ex.Start,
+		Time:            ms,
+		Request: HARRequest{
+			Method:      r.Method,
+			URL:         u.String(),
+			HTTPVersion: r.Proto,
+			Cookies:     harCookies(r.Cookies()),
+			Headers:     harHeaders(r.Header),
+			QueryString: []HARNameValue{},
+		},
+		Timings: HARTimings{Blocked: -1, DNS: -1, Connect: -1, Wait: ms},
+	}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			e.Request.QueryString = append(e.Request.QueryString, HARNameValue{Name: name, Value: value})
+		}
+	}
+
+	e.Request.HeadersSize, e.Request.BodySize = rawSizes(ex.RawRequest)
+	if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+		text, comment := harText(body, maxBodySize)
+		e.Request.PostData = &HARPostData{
+			MimeType: r.Header.Get("Content-Type"),
+			Text:     text,
+			Comment:  comment,
+		}
+	}
+
+	resp := ex.Response()
+	if resp == nil {
+		e.Response = HARResponse{Cookies: []HARCookie{}, Headers: []HARNameValue{}, HeadersSize: -1, BodySize: -1}
+		switch {
+		case ex.ErrorCode != nil:
+			e.Error = ex.ErrorCode.String()
+		case ex.Err != nil:
+			e.Error = ex.Err.Error()
+		default:
+			e.Error = "malformed response"
+		}
+		return e, nil
+	}
+
+	e.Response = HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: resp.Header.Get("Location"),
+	}
+	e.Response.HeadersSize, e.Response.BodySize = rawSizes(ex.RawResponse)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	content := HARContent{
+		Size:     int64(len(body)),
+		MimeType: resp.Header.Get("Content-Type"),
+	}
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := ioutil.ReadAll(zr); err == nil {
+				content.Compression = int64(len(decoded) - len(body))
+				content.Size = int64(len(decoded))
+				body = decoded
+			}
+		}
+	}
+
+	if utf8.Valid(body) {
+		content.Text, content.Comment = harText(body, maxBodySize)
+	} else {
+		if maxBodySize > 0 && int64(len(body)) > maxBodySize {
+			body = body[:maxBodySize]
+			content.Comment = "truncated"
+		}
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	e.Response.Content = content
+	return e, nil
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []HARCookie {
+	harCookies := []HARCookie{}
+	for _, c := range cookies {
+		harCookies = append(harCookies, HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		})
+	}
+	return harCookies
+}
+
+// harText returns body as text, truncated to maxBodySize if needed
+func harText(body []byte, maxBodySize int64) (string, string) {
+	if maxBodySize > 0 && int64(len(body)) > maxBodySize {
+		return string(body[:maxBodySize]), fmt.Sprintf("truncated from %d bytes", len(body))
+	}
+	return string(body), ""
+}
+
+// rawSizes returns the size of the header and body of a raw HTTP message
+func rawSizes(raw []byte) (int64, int64) {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end == -1 {
+		return int64(len(raw)), 0
+	}
+	headersSize := int64(end + 4)
+	return headersSize, int64(len(raw)) - headersSize
+}
+
+// The end of a HAR file after its last entry
+var harTrailer = []byte("\n]}}\n")
+
+type HAROptions struct {
+	// Size a recording may reach before it is rotated, or zero for no limit
+	MaxFileSize int64
+	// How many rotated recordings are kept. If zero, the recording starts over instead.
+	MaxFiles int
+	// How much of each body is recorded, or zero to record whole bodies
+	MaxBodySize int64
+	// Scheme of the recorded URLs
+	Scheme string
+}
+
+// HARRecorder writes exchanges to a HAR file. The file is valid after every entry, so it
+// can be opened while recording. When the file would exceed the size limit, it is rotated
+// to <file>.1, shifting older recordings up to the configured number of files.
+type HARRecorder struct {
+	path string
+	opts HAROptions
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	entries int
+}
+
+// NewHARRecorder starts a recording at path, replacing any file there
+func NewHARRecorder(path string, opts HAROptions) (*HARRecorder, error) {
+	if opts.Scheme == "" {
+		opts.Scheme = "https"
+	}
+	f, size, err := createHARFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &HARRecorder{
+		path: path,
+		opts: opts,
+		file: f,
+		size: size,
+	}, nil
+}
+
+// createHARFile starts a new, empty recording at path and returns its size
+func createHARFile(path string) (*os.File, int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("create har file: %w", err)
+	}
+
+	header, err := json.Marshal(NewHAR())
+	if err != nil {
+		panic(err)
+	}
+	// cut the document open after the start of the entries array
+	header = bytes.TrimSuffix(header, []byte("]}}"))
+	if _, err := f.Write(append(header, harTrailer...)); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return nil, 0, fmt.Errorf("write har file: %w", err)
+	}
+	return f, int64(len(header) + len(harTrailer)), nil
+}
+
+// Record adds an exchange to the recording
+func (r *HARRecorder) Record(ex *Exchange) error {
+	entry, err := NewHAREntry(ex, r.opts.Scheme, r.opts.MaxBodySize)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return os.ErrClosed
+	}
+
+	// if rotating fails, the entry still goes to the current recording
+	var rotateErr error
+	if r.opts.MaxFileSize > 0 && r.entries > 0 && r.size+int64(len(b))+2 > r.opts.MaxFileSize {
+		rotateErr = r.rotate()
+	}
+
+	var buf bytes.Buffer
+	if r.entries > 0 {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\n")
+	buf.Write(b)
+	buf.Write(harTrailer)
+
+	// overwrite the trailer with the entry followed by the trailer
+	offset := r.size - int64(len(harTrailer))
+	if _, err := r.file.WriteAt(buf.Bytes(), offset); err != nil {
+		return fmt.Errorf("write har file: %w", err)
+	}
+	r.size = offset + int64(buf.Len())
+	r.entries++
+	return rotateErr
+}
+
+// rotate moves the current recording aside and starts a new one. The current recording
+// stays open until the new one is in place, so that entries keep going to it if
+// rotating fails. r.mu must be held.
+func (r *HARRecorder) rotate() error {
+	next := r.path + ".new"
+	f, size, err := createHARFile(next)
+	if err != nil {
+		return fmt.Errorf("rotate: %w", err)
+	}
+	abort := func(err error) error {
+		_ = f.Close()
+		_ = os.Remove(next)
+		return fmt.Errorf("rotate: %w", err)
+	}
+
+	if r.opts.MaxFiles > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.opts.MaxFiles))
+		for i := r.opts.MaxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return abort(err)
+		}
+	}
+	if err := os.Rename(next, r.path); err != nil {
+		return abort(err)
+	}
+
+	_ = r.file.Close()
+	r.file, r.size, r.entries = f, size, 0
+	return nil
+}
+
+func (r *HARRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// ReadHAR loads a HAR file
+func ReadHAR(path string) (*HAR, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har HAR
+	if err := json.Unmarshal(b, &har); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &har, nil
+}
+
+// WriteHAR saves a HAR document to path
+func WriteHAR(path string, har *HAR) error {
+	b, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,308 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testExchange returns an exchange of GET /item/<n> answered with body
+func testExchange(n int, body string) *Exchange {
+	ex := &Exchange{
+		ID:         uint64(n),
+		Start:      time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC),
+		RawRequest: []byte(fmt.Sprintf("GET /item/%03d HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n", n)),
+		RawResponse: []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s",
+			len(body), body)),
+	}
+	ex.finish(nil)
+	// fixed, so that every entry has the same size
+	ex.Duration = 25 * time.Millisecond
+	return ex
+}
+
+func TestNewHAREntry(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, _ = zw.Write([]byte("hello, gzip"))
+	_ = zw.Close()
+
+	timeout := common.Timeout
+	tests := []struct {
+		name        string
+		request     string
+		response    string
+		errorCode   *common.ErrorCode
+		err         error
+		maxBodySize int64
+		check       func(t *testing.T, e *HAREntry)
+	}{
+		{
+			name:     "url and query",
+			request:  "GET /search?q=leap&q=tunnel HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+			response: "HTTP/1.1 204 No Content\r\n\r\n",
+			check: func(t *testing.T, e *HAREntry) {
+				if want := "https://foo.leap.example.com/search?q=leap&q=tunnel"; e.Request.URL != want {
+					t.Errorf("url = %q, want %q", e.Request.URL, want)
+				}
+				want := []HARNameValue{{"q", "leap"}, {"q", "tunnel"}}
+				if !reflect.DeepEqual(e.Request.QueryString, want) {
+					t.Errorf("query = %v, want %v", e.Request.QueryString, want)
+				}
+				if e.Response.Status != 204 || e.Response.StatusText != "No Content" {
+					t.Errorf("status = %d %q, want 204 \"No Content\"", e.Response.Status, e.Response.StatusText)
+				}
+			},
+		},
+		{
+			name:        "truncated bodies",
+			request:     "POST /upload HTTP/1.1\r\nHost: foo.leap.example.com\r\nContent-Type: text/plain\r\nContent-Length: 10\r\n\r\n0123456789",
+			response:    "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nabcdef",
+			maxBodySize: 4,
+			check: func(t *testing.T, e *HAREntry) {
+				if e.Request.PostData == nil || e.Request.PostData.Text != "0123" || e.Request.PostData.Comment == "" {
+					t.Errorf("post data = %+v, want truncated to 0123", e.Request.PostData)
+				}
+				if e.Request.BodySize != 10 {
+					t.Errorf("request body size = %d, want 10", e.Request.BodySize)
+				}
+				if e.Response.Content.Text != "abcd" || e.Response.Content.Size != 6 {
+					t.Errorf("content = %+v, want abcd of 6 bytes", e.Response.Content)
+				}
+			},
+		},
+		{
+			name:     "gzipped response",
+			request:  "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+			response: fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", gzipped.Len(), gzipped.String()),
+			check: func(t *testing.T, e *HAREntry) {
+				c := e.Response.Content
+				if c.Text != "hello, gzip" || c.Size != 11 || c.Compression != int64(11-gzipped.Len()) {
+					t.Errorf("content = %+v, want decompressed text", c)
+				}
+			},
+		},
+		{
+			name:     "binary response",
+			request:  "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n\xff\xfe\xfd",
+			check: func(t *testing.T, e *HAREntry) {
+				c := e.Response.Content
+				if c.Encoding != "base64" || c.Text != base64.StdEncoding.EncodeToString([]byte("\xff\xfe\xfd")) {
+					t.Errorf("content = %+v, want base64", c)
+				}
+			},
+		},
+		{
+			name:      "error code",
+			request:   "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+			errorCode: &timeout,
+			check: func(t *testing.T, e *HAREntry) {
+				if e.Error != "timeout" || e.Response.Status != 0 {
+					t.Errorf("error = %q, status = %d, want timeout without response", e.Error, e.Response.Status)
+				}
+			},
+		},
+		{
+			name:    "failed exchange",
+			request: "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+			err:     errors.New("connection refused"),
+			check: func(t *testing.T, e *HAREntry) {
+				if e.Error != "connection refused" {
+					t.Errorf("error = %q, want connection refused", e.Error)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ex := &Exchange{RawRequest: []byte(tt.request), ErrorCode: tt.errorCode}
+			if tt.response != "" {
+				ex.RawResponse = []byte(tt.response)
+			}
+			ex.finish(tt.err)
+
+			e, err := NewHAREntry(ex, "https", tt.maxBodySize)
+			if err != nil {
+				t.Fatalf("NewHAREntry() error: %v", err)
+			}
+			tt.check(t, e)
+		})
+	}
+}
+
+func TestHARRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// measure the size of a recording of one and two entries, which all have the same size
+	sizeOf := func(n int) int64 {
+		path := filepath.Join(dir, "measure.har")
+		r, err := NewHARRecorder(path, HAROptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := r.Record(testExchange(i, "ok")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = r.Close()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	one, two := sizeOf(1), sizeOf(2)
+	perFile := func(entries int) int64 {
+		return one + int64(entries-1)*(two-one)
+	}
+
+	tests := []struct {
+		name        string
+		maxFileSize int64
+		maxFiles    int
+		records     int
+		// the items recorded in the file and then in each rotated file
+		want [][]int
+	}{
+		{name: "no limit", records: 5, want: [][]int{{0, 1, 2, 3, 4}}},
+		{name: "exactly full", maxFileSize: perFile(5), maxFiles: 1, records: 5, want: [][]int{{0, 1, 2, 3, 4}}},
+		{name: "keep two", maxFileSize: perFile(2), maxFiles: 2, records: 5, want: [][]int{{4}, {2, 3}, {0, 1}}},
+		{name: "keep one", maxFileSize: perFile(2), maxFiles: 1, records: 5, want: [][]int{{4}, {2, 3}}},
+		{name: "start over", maxFileSize: perFile(2), records: 5, want: [][]int{{4}}},
+		{name: "entries larger than limit", maxFileSize: 1, maxFiles: 3, records: 3, want: [][]int{{2}, {1}, {0}}},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("test%d.har", i))
+			r, err := NewHARRecorder(path, HAROptions{MaxFileSize: tt.maxFileSize, MaxFiles: tt.maxFiles})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := 0; n < tt.records; n++ {
+				if err := r.Record(testExchange(n, "ok")); err != nil {
+					t.Fatalf("Record(%d) error: %v", n, err)
+				}
+
+				// the recording is valid after every entry
+				if _, err := ReadHAR(path); err != nil {
+					t.Fatalf("after Record(%d): %v", n, err)
+				}
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for j, wantItems := range tt.want {
+				file := path
+				if j > 0 {
+					file = fmt.Sprintf("%s.%d", path, j)
+				}
+				har, err := ReadHAR(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var items []int
+				for _, e := range har.Log.Entries {
+					var item int
+					if _, err := fmt.Sscanf(e.Request.URL, "https://foo.leap.example.com/item/%d", &item); err != nil {
+						t.Fatalf("%s: unexpected url %q", file, e.Request.URL)
+					}
+					items = append(items, item)
+				}
+				if !reflect.DeepEqual(items, wantItems) {
+					t.Errorf("%s has items %v, want %v", file, items, wantItems)
+				}
+				if tt.maxFileSize > 1 {
+					if info, _ := os.Stat(file); info.Size() > tt.maxFileSize {
+						t.Errorf("%s is %d bytes, over the limit of %d", file, info.Size(), tt.maxFileSize)
+					}
+				}
+			}
+			if _, err := os.Stat(fmt.Sprintf("%s.%d", path, len(tt.want))); !os.IsNotExist(err) {
+				t.Errorf("%s.%d exists, want only %d files", path, len(tt.want), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestHARRecorderRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.har")
+	r, err := NewHARRecorder(path, HAROptions{MaxFileSize: 1, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the new recording can't be created while a directory is in its way
+	if err := os.Mkdir(path+".new", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Record(testExchange(0, "ok")); err != nil {
+		t.Fatalf("Record(0) error: %v", err)
+	}
+	if err := r.Record(testExchange(1, "ok")); err == nil {
+		t.Fatal("Record(1) succeeded, want the rotation error")
+	}
+	if err := os.Remove(path + ".new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Record(testExchange(2, "ok")); err != nil {
+		t.Fatalf("Record(2) error: %v", err)
+	}
+
+	for file, want := range map[string]int{path + ".1": 2, path: 1} {
+		har, err := ReadHAR(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(har.Log.Entries) != want {
+			t.Errorf("%s has %d entries, want %d", file, len(har.Log.Entries), want)
+		}
+	}
+}
+
+func TestExchangeOrder(t *testing.T) {
+	o := newExchangeOrder()
+	exchanges := make([]*Exchange, 5)
+	for i := range exchanges {
+		exchanges[i] = &Exchange{ID: o.arrived()}
+	}
+
+	var reported []uint64
+	report := func(ex *Exchange) {
+		reported = append(reported, ex.ID)
+	}
+	for _, i := range []int{2, 0, 4, 1} {
+		o.done(exchanges[i].ID, exchanges[i], report)
+	}
+	if want := []uint64{0, 1, 2}; !reflect.DeepEqual(reported, want) {
+		t.Fatalf("reported %v, want %v while 3 is in flight", reported, want)
+	}
+	o.done(3, exchanges[3], report)
+	if want := []uint64{0, 1, 2, 3, 4}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("reported %v, want %v", reported, want)
+	}
+}
@@ -0,0 +1,391 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var errMalformedHeader = errors.New("malformed message header")
+
+// HeaderPhase selects whether a rule applies to requests or responses
+type HeaderPhase string
+
+const (
+	RequestHeaders  HeaderPhase = "request"
+	ResponseHeaders HeaderPhase = "response"
+)
+
+type HeaderAction string
+
+const (
+	// Add a header, keeping any existing values
+	AddHeader HeaderAction = "add"
+	// Replace every value of a header with a single one
+	SetHeader HeaderAction = "set"
+	// Delete a header
+	RemoveHeader HeaderAction = "remove"
+	// Rewrite the values of a header with a regular expression
+	ReplaceHeader HeaderAction = "replace"
+)
+
+// HeaderRule edits a header of the requests passed to local services or of their
+// responses. Rules apply in order, and only to requests matching all of their conditions.
+type HeaderRule struct {
+	Phase  HeaderPhase
+	Action HeaderAction
+	Name   string
+	// Value added or set, or the replacement of Pattern, which may refer to its groups
+	// as $1
+	Value   string
+	Pattern *regexp.Regexp
+
+	// Conditions on the public request. Empty conditions match every request.
+	Methods    []string
+	PathPrefix string
+	// Exact host without port, or *.example.com for any subdomain of example.com
+	Host string
+}
+
+// ParseHeaderRule parses a rule of the form ACTION NAME[: VALUE][;path=PREFIX]
+// [;method=GET,POST][;host=HOST], for example "set X-Auth: secret;path=/api". The value
+// of a replace rule is written /PATTERN/REPLACEMENT/.
+func ParseHeaderRule(phase HeaderPhase, s string) (HeaderRule, error) {
+	r := HeaderRule{Phase: phase}
+
+	// conditions are only taken from the end, so that values may contain semicolons
+	rest := s
+	for {
+		i := strings.LastIndex(rest, ";")
+		if i == -1 {
+			break
+		}
+		key, value, ok := splitCondition(rest[i+1:])
+		if !ok {
+			break
+		}
+		switch key {
+		case "path":
+			r.PathPrefix = strings.TrimSuffix(value, "*")
+		case "method":
+			r.Methods = strings.Split(strings.ToUpper(value), ",")
+		case "host":
+			r.Host = strings.ToLower(value)
+		}
+		rest = rest[:i]
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(rest), " ", 2)
+	if len(fields) != 2 {
+		return HeaderRule{}, fmt.Errorf("header rule %q: expected ACTION NAME[: VALUE]", s)
+	}
+	r.Action = HeaderAction(strings.ToLower(fields[0]))
+
+	nameValue := strings.SplitN(fields[1], ":", 2)
+	r.Name = strings.TrimSpace(nameValue[0])
+	if len(nameValue) == 2 {
+		r.Value = strings.TrimSpace(nameValue[1])
+	}
+
+	if r.Action == ReplaceHeader {
+		pattern, replacement, err := splitReplacement(r.Value)
+		if err != nil {
+			return HeaderRule{}, fmt.Errorf("header rule %q: %w", s, err)
+		}
+		if r.Pattern, err = regexp.Compile(pattern); err != nil {
+			return HeaderRule{}, fmt.Errorf("header rule %q: %w", s, err)
+		}
+		r.Value = replacement
+	}
+
+	if err := r.validate(); err != nil {
+		return HeaderRule{}, fmt.Errorf("header rule %q: %w", s, err)
+	}
+	return r, nil
+}
+
+// splitCondition splits a KEY=VALUE rule condition, reporting whether KEY is known
+func splitCondition(s string) (string, string, bool) {
+	eq := strings.Index(s, "=")
+	if eq == -1 {
+		return "", "", false
+	}
+	key := strings.ToLower(strings.TrimSpace(s[:eq]))
+	switch key {
+	case "path", "method", "host":
+		return key, strings.TrimSpace(s[eq+1:]), true
+	}
+	return "", "", false
+}
+
+// splitReplacement splits /PATTERN/REPLACEMENT/ at the first unescaped slash
+func splitReplacement(s string) (string, string, error) {
+	if len(s) < 2 || s[0] != '/' || s[len(s)-1] != '/' {
+		return "", "", errors.New("expected /PATTERN/REPLACEMENT/")
+	}
+	inner := s[1 : len(s)-1]
+	for i := 0; i < len(inner); i++ {
+		switch inner[i] {
+		case '\\':
+			i++
+		case '/':
+			return inner[:i], inner[i+1:], nil
+		}
+	}
+	return "", "", errors.New("expected /PATTERN/REPLACEMENT/")
+}
+
+func (r *HeaderRule) validate() error {
+	if r.Phase != RequestHeaders && r.Phase != ResponseHeaders {
+		return fmt.Errorf("unknown phase %q", r.Phase)
+	}
+	if r.Name == "" {
+		return errors.New("missing header name")
+	}
+	switch r.Action {
+	case AddHeader, SetHeader, RemoveHeader:
+	case ReplaceHeader:
+		if r.Pattern == nil {
+			return errors.New("missing pattern")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+// headerRuleFile is the YAML layout of a header rules file
+type headerRuleFile struct {
+	Rules []struct {
+		Phase   HeaderPhase  `yaml:"phase"`
+		Action  HeaderAction `yaml:"action"`
+		Name    string       `yaml:"name"`
+		Value   string       `yaml:"value"`
+		Pattern string       `yaml:"pattern"`
+		Match   struct {
+			Methods []string `yaml:"methods"`
+			Path    string   `yaml:"path"`
+			Host    string   `yaml:"host"`
+		} `yaml:"match"`
+	} `yaml:"rules"`
+}
+
+// LoadHeaderRules reads header rules from a YAML file of the form
+//
+//	rules:
+//	  - phase: response
+//	    action: set
+//	    name: Access-Control-Allow-Origin
+//	    value: "*"
+//	    match:
+//	      path: /api
+//	      methods: [GET, POST]
+//
+// Replace rules take the regular expression in pattern and the replacement in value.
+func LoadHeaderRules(path string) ([]HeaderRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file headerRuleFile
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	rules := make([]HeaderRule, 0, len(file.Rules))
+	for i, fr := range file.Rules {
+		r := HeaderRule{
+			Phase:      HeaderPhase(strings.ToLower(string(fr.Phase))),
+			Action:     HeaderAction(strings.ToLower(string(fr.Action))),
+			Name:       fr.Name,
+			Value:      fr.Value,
+			PathPrefix: strings.TrimSuffix(fr.Match.Path, "*"),
+			Host:       strings.ToLower(fr.Match.Host),
+		}
+		for _, method := range fr.Match.Methods {
+			r.Methods = append(r.Methods, strings.ToUpper(method))
+		}
+		if fr.Pattern != "" {
+			if r.Pattern, err = regexp.Compile(fr.Pattern); err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+			}
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to a public request
+func (r *HeaderRule) matches(method, path, host string) bool {
+	if r.PathPrefix != "" && !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	if r.Host != "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if strings.HasPrefix(r.Host, "*.") {
+			if !strings.HasSuffix(host, r.Host[1:]) {
+				return false
+			}
+		} else if host != r.Host {
+			return false
+		}
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// apply performs the rule's action on the fields of a header
+func (r *HeaderRule) apply(m *rawMessage) {
+	switch r.Action {
+	case AddHeader:
+		m.fields = append(m.fields, headerField{r.Name, r.Value})
+	case SetHeader:
+		m.remove(r.Name)
+		m.fields = append(m.fields, headerField{r.Name, r.Value})
+	case RemoveHeader:
+		m.remove(r.Name)
+	case ReplaceHeader:
+		for i := range m.fields {
+			if strings.EqualFold(m.fields[i].name, r.Name) {
+				m.fields[i].value = r.Pattern.ReplaceAllString(m.fields[i].value, r.Value)
+			}
+		}
+	}
+}
+
+// parseRequestTarget returns the method, path and host of a raw request
+func parseRequestTarget(raw []byte) (string, string, string, error) {
+	req, err := parseRawMessage(raw)
+	if err != nil {
+		return "", "", "", err
+	}
+	requestLine := strings.Split(req.startLine, " ")
+	if len(requestLine) != 3 {
+		return "", "", "", errMalformedRequestLine
+	}
+	method, path := requestLine[0], requestLine[1]
+	if i := strings.Index(path, "?"); i != -1 {
+		path = path[:i]
+	}
+	return method, path, req.get("Host"), nil
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// rawMessage is a raw HTTP message split up for editing its header
+type rawMessage struct {
+	startLine string
+	fields    []headerField
+	body      []byte
+}
+
+func parseRawMessage(raw []byte) (*rawMessage, error) {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end == -1 {
+		return nil, errMalformedHeader
+	}
+
+	lines := strings.Split(string(raw[:end]), "\r\n")
+	m := &rawMessage{
+		startLine: lines[0],
+		body:      raw[end+4:],
+	}
+	for _, line := range lines[1:] {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(m.fields) > 0 {
+			// continuation of a folded header
+			m.fields[len(m.fields)-1].value += " " + strings.TrimSpace(line)
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			return nil, errMalformedHeader
+		}
+		m.fields = append(m.fields, headerField{line[:colon], strings.TrimSpace(line[colon+1:])})
+	}
+	return m, nil
+}
+
+func (m *rawMessage) get(name string) string {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+func (m *rawMessage) remove(name string) {
+	fields := m.fields[:0]
+	for _, f := range m.fields {
+		if !strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+	m.fields = fields
+}
+
+func (m *rawMessage) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(m.startLine + "\r\n")
+	for _, f := range m.fields {
+		buf.WriteString(f.name + ": " + f.value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(m.body)
+	return buf.Bytes()
+}
+
+// applyHeaderRules runs the rules of a phase matching the public request rawRequest on
+// the header of message, which is either the request passed to the local service or its
+// response
+func (c *LeapClient) applyHeaderRules(phase HeaderPhase, rawRequest, message []byte) ([]byte, error) {
+	if len(c.Config.HeaderRules) == 0 {
+		return message, nil
+	}
+
+	method, path, host, err := parseRequestTarget(rawRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *rawMessage
+	for i := range c.Config.HeaderRules {
+		rule := &c.Config.HeaderRules[i]
+		if rule.Phase != phase || !rule.matches(method, path, host) {
+			continue
+		}
+		if m == nil {
+			if m, err = parseRawMessage(message); err != nil {
+				return nil, err
+			}
+		}
+		rule.apply(m)
+	}
+
+	if m == nil {
+		return message, nil
+	}
+	return m.bytes(), nil
+}
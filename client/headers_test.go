@@ -0,0 +1,236 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ruleSummary is a comparable view of a header rule
+type ruleSummary struct {
+	Phase      HeaderPhase
+	Action     HeaderAction
+	Name       string
+	Value      string
+	Pattern    string
+	Methods    []string
+	PathPrefix string
+	Host       string
+}
+
+func summarizeRule(r HeaderRule) ruleSummary {
+	s := ruleSummary{
+		Phase:      r.Phase,
+		Action:     r.Action,
+		Name:       r.Name,
+		Value:      r.Value,
+		Methods:    r.Methods,
+		PathPrefix: r.PathPrefix,
+		Host:       r.Host,
+	}
+	if r.Pattern != nil {
+		s.Pattern = r.Pattern.String()
+	}
+	return s
+}
+
+func TestParseHeaderRule(t *testing.T) {
+	tests := []struct {
+		phase   HeaderPhase
+		in      string
+		want    ruleSummary
+		wantErr bool
+	}{
+		{
+			phase: RequestHeaders,
+			in:    "set X-Auth: secret",
+			want:  ruleSummary{Phase: RequestHeaders, Action: SetHeader, Name: "X-Auth", Value: "secret"},
+		},
+		{
+			phase: ResponseHeaders,
+			in:    "ADD Cache-Control: no-store;path=/api/*;method=get,post;host=*.Example.com",
+			want: ruleSummary{Phase: ResponseHeaders, Action: AddHeader, Name: "Cache-Control", Value: "no-store",
+				Methods: []string{"GET", "POST"}, PathPrefix: "/api/", Host: "*.example.com"},
+		},
+		{
+			phase: RequestHeaders,
+			in:    "remove Cookie",
+			want:  ruleSummary{Phase: RequestHeaders, Action: RemoveHeader, Name: "Cookie"},
+		},
+		{
+			phase: ResponseHeaders,
+			in:    "set Content-Security-Policy: default-src 'self'; img-src *;path=/",
+			want: ruleSummary{Phase: ResponseHeaders, Action: SetHeader, Name: "Content-Security-Policy",
+				Value: "default-src 'self'; img-src *", PathPrefix: "/"},
+		},
+		{
+			phase: ResponseHeaders,
+			in:    `replace Location: /http:\/\/localhost:(\d+)/https:\/\/example.com/`,
+			want: ruleSummary{Phase: ResponseHeaders, Action: ReplaceHeader, Name: "Location",
+				Value: `https:\/\/example.com`, Pattern: `http:\/\/localhost:(\d+)`},
+		},
+		{phase: RequestHeaders, in: "set", wantErr: true},
+		{phase: RequestHeaders, in: "rename X-A: X-B", wantErr: true},
+		{phase: RequestHeaders, in: "set : value", wantErr: true},
+		{phase: RequestHeaders, in: "replace Location: localhost", wantErr: true},
+		{phase: RequestHeaders, in: "replace Location: /(/x/", wantErr: true},
+		{phase: "both", in: "set X-Auth: secret", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseHeaderRule(tt.phase, tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseHeaderRule(%q) = %+v, want error", tt.in, summarizeRule(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseHeaderRule(%q) error: %v", tt.in, err)
+			}
+			if s := summarizeRule(got); !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("ParseHeaderRule(%q) = %+v, want %+v", tt.in, s, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadHeaderRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		file    string
+		want    []ruleSummary
+		wantErr bool
+	}{
+		{
+			name: "rules",
+			file: `
+rules:
+  - phase: Response
+    action: SET
+    name: Access-Control-Allow-Origin
+    value: "*"
+    match:
+      path: /api*
+      methods: [get, post]
+  - phase: request
+    action: replace
+    name: Host
+    pattern: ^(.*)\.leap\.example\.com$
+    value: $1.local
+    match:
+      host: "*.leap.example.com"
+`,
+			want: []ruleSummary{
+				{Phase: ResponseHeaders, Action: SetHeader, Name: "Access-Control-Allow-Origin", Value: "*",
+					Methods: []string{"GET", "POST"}, PathPrefix: "/api"},
+				{Phase: RequestHeaders, Action: ReplaceHeader, Name: "Host", Value: "$1.local",
+					Pattern: `^(.*)\.leap\.example\.com$`, Host: "*.leap.example.com"},
+			},
+		},
+		{name: "empty", file: "rules: []\n", want: []ruleSummary{}},
+		{name: "unknown field", file: "rules:\n  - phase: request\n    action: set\n    name: X\n    valeu: y\n", wantErr: true},
+		{name: "missing phase", file: "rules:\n  - action: set\n    name: X\n", wantErr: true},
+		{name: "replace without pattern", file: "rules:\n  - phase: request\n    action: replace\n    name: X\n", wantErr: true},
+		{name: "invalid pattern", file: "rules:\n  - phase: request\n    action: replace\n    name: X\n    pattern: (\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, filepath.Base(t.Name())+".yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := LoadHeaderRules(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadHeaderRules() = %d rules, want error", len(rules))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadHeaderRules() error: %v", err)
+			}
+			got := make([]ruleSummary, len(rules))
+			for j, r := range rules {
+				got[j] = summarizeRule(r)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadHeaderRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	mustParse := func(phase HeaderPhase, s string) HeaderRule {
+		r, err := ParseHeaderRule(phase, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		rules   []HeaderRule
+		request string
+		want    string
+	}{
+		{
+			name:    "no matching rule",
+			rules:   []HeaderRule{mustParse(RequestHeaders, "set X-A: 1;path=/api")},
+			request: "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+			want:    "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n",
+		},
+		{
+			name: "rules in order",
+			rules: []HeaderRule{
+				mustParse(RequestHeaders, "add X-A: 2"),
+				mustParse(RequestHeaders, "remove cookie"),
+				mustParse(RequestHeaders, "set x-b: 3"),
+			},
+			request: "GET /api HTTP/1.1\r\nHost: foo.leap.example.com\r\nX-A: 1\r\nCookie: a=b\r\nX-B: 1\r\nX-B: 2\r\n\r\n",
+			want:    "GET /api HTTP/1.1\r\nHost: foo.leap.example.com\r\nX-A: 1\r\nX-A: 2\r\nx-b: 3\r\n\r\n",
+		},
+		{
+			name:    "replace",
+			rules:   []HeaderRule{mustParse(RequestHeaders, `replace Referer: /foo\.leap\.example\.com/localhost:3000/`)},
+			request: "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\nReferer: https://foo.leap.example.com/home\r\n\r\n",
+			want:    "GET / HTTP/1.1\r\nHost: foo.leap.example.com\r\nReferer: https://localhost:3000/home\r\n\r\n",
+		},
+		{
+			name: "conditions",
+			rules: []HeaderRule{
+				mustParse(RequestHeaders, "add X-Method: post;method=POST"),
+				mustParse(RequestHeaders, "add X-Host: any;host=*.example.com"),
+				mustParse(RequestHeaders, "add X-Host: other;host=bar.leap.example.com"),
+				mustParse(ResponseHeaders, "add X-Phase: response"),
+			},
+			request: "GET /?q=1 HTTP/1.1\r\nHost: FOO.leap.example.com:443\r\n\r\n",
+			want:    "GET /?q=1 HTTP/1.1\r\nHost: FOO.leap.example.com:443\r\nX-Host: any\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &LeapClient{Config: &Config{HeaderRules: tt.rules}}
+			got, err := c.applyHeaderRules(RequestHeaders, []byte(tt.request), []byte(tt.request))
+			if err != nil {
+				t.Fatalf("applyHeaderRules() error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("applyHeaderRules() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
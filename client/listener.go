@@ -0,0 +1,230 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var ErrListenerClosed = errors.New("leap: listener closed")
+
+// tunnelAddr is the address of a tunnel listener: its public URL
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "leap"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// tunnelListener hands out the connections of requests arriving through the tunnel
+type tunnelListener struct {
+	client *LeapClient
+	addr   tunnelAddr
+	conns  chan net.Conn
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error // why the tunnel stopped, set before closed is closed
+}
+
+// asyncWriteConn is the client's end of a tunneled connection. Writes don't wait for
+// the handler to read them, so a handler that responds without consuming the whole
+// request body can't stall the exchange. They are copied and queued for a single
+// goroutine that writes them in order, and the first error it runs into is returned by
+// the following calls to Write and Close.
+type asyncWriteConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	err    error
+}
+
+func newAsyncWriteConn(conn net.Conn) *asyncWriteConn {
+	c := &asyncWriteConn{Conn: conn}
+	c.cond = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+// writeLoop writes the queue to the connection until it fails or is closed
+func (c *asyncWriteConn) writeLoop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			return
+		}
+
+		b := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+
+		c.mu.Unlock()
+		_, err := c.Conn.Write(b)
+		c.mu.Lock()
+		if err != nil {
+			if c.err == nil {
+				c.err = err
+			}
+			c.queue = nil
+			return
+		}
+	}
+}
+
+func (c *asyncWriteConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.queue = append(c.queue, append([]byte(nil), b...))
+	c.cond.Signal()
+	return len(b), nil
+}
+
+// Close closes the connection, dropping writes that haven't gone through yet
+func (c *asyncWriteConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	err := c.err
+	c.cond.Signal()
+	c.mu.Unlock()
+
+	if closeErr := c.Conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Listen opens a tunnel and returns a listener that accepts a connection for every
+// request made to it. Requests never reach a local port: Config.LocalPort and the
+// targets of Config.Routes are ignored, although routes still rewrite paths.
+//
+// The String of the listener's Addr is the tunnel's public URL. The tunnel reconnects
+// after losing the server, and is closed along with the listener or when ctx is done.
+func Listen(ctx context.Context, config *Config) (net.Listener, error) {
+	return New(config).Listen(ctx)
+}
+
+// Listen opens the tunnel as the package-level Listen does, keeping the client's hooks
+func (c *LeapClient) Listen(ctx context.Context) (net.Listener, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &tunnelListener{
+		client: c,
+		conns:  make(chan net.Conn),
+		cancel: cancel,
+		closed: make(chan struct{}),
+	}
+	c.DialLocal = l.dial
+
+	if err := c.startRecording(); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := c.connect(ctx, c.Config.Subdomain); err != nil {
+		c.stopRecording()
+		cancel()
+		return nil, err
+	}
+	l.addr = tunnelAddr(c.PublicURL())
+
+	go func() {
+		err := c.serveConnected(ctx)
+		c.stopRecording()
+		l.shutdown(err)
+	}()
+	return l, nil
+}
+
+// Serve serves HTTP requests made to a new tunnel with handler until ctx is done
+func Serve(ctx context.Context, config *Config, handler http.Handler) error {
+	return New(config).Serve(ctx, handler)
+}
+
+// Serve serves HTTP requests made to the client's tunnel with handler until ctx is done
+func (c *LeapClient) Serve(ctx context.Context, handler http.Handler) error {
+	l, err := c.Listen(ctx)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) || errors.Is(err, ErrListenerClosed) {
+		return nil
+	}
+	return err
+}
+
+// dial passes one end of a new in-memory connection to Accept
+func (l *tunnelListener) dial(ctx context.Context, _ string) (net.Conn, error) {
+	if l.client.Config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.client.Config.DialTimeout)
+		defer cancel()
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- remote:
+		return newAsyncWriteConn(local), nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+// Close disconnects the tunnel
+func (l *tunnelListener) Close() error {
+	l.shutdown(nil)
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *tunnelListener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		l.cancel()
+		if err == nil {
+			err = ErrListenerClosed
+		}
+		l.err = err
+		close(l.closed)
+	})
+}
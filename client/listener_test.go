@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo" {
+			body, _ := ioutil.ReadAll(r.Body)
+			_, _ = fmt.Fprintf(w, "%s %s %s", r.Method, r.Host, body)
+			return
+		}
+		// answers without reading the body
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, server.config(), handler)
+	}()
+	ws := server.accept(t)
+
+	large := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		request string
+		status  int
+		body    string
+	}{
+		{
+			request: "POST /echo HTTP/1.1\r\nHost: random.leap.example.com\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello",
+			status:  http.StatusOK,
+			body:    "POST random.leap.example.com hello",
+		},
+		{
+			request: fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: random.leap.example.com\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(large), large),
+			status:  http.StatusNotFound,
+			body:    "not found\n",
+		},
+	}
+	for i, tt := range tests {
+		sendRequest(t, ws, uint64(i), tt.request)
+		typ, raw := readReply(t, ws)
+		var reply common.ResponseDataMessage
+		if err := json.Unmarshal(raw, &reply); err != nil || typ != common.ResponseData {
+			t.Fatalf("reply = %s, want a response", raw)
+		}
+		rawResponse, err := reply.DecodeResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(rawResponse)), nil)
+		if err != nil {
+			t.Fatalf("malformed response %q: %v", rawResponse, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || string(body) != tt.body {
+			t.Errorf("response %d = %d %q, want %d %q", i, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+
+	go discard(ws)
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() = %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	l, err := Listen(context.Background(), server.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := server.accept(t)
+	go discard(ws)
+	if got := l.Addr().String(); got != "http://random.leap.example.com" {
+		t.Errorf("Addr() = %q, want the public URL", got)
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, ErrListenerClosed) {
+			t.Errorf("Accept() = %v, want %v", err, ErrListenerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return after Close")
+	}
+}
+
+func TestAsyncWriteConn(t *testing.T) {
+	local, remote := net.Pipe()
+	conn := newAsyncWriteConn(local)
+
+	// writes return before the other end reads them
+	for _, s := range []string{"one ", "two ", "three"} {
+		if n, err := conn.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	buf := make([]byte, len("one two three"))
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "one two three" {
+		t.Fatalf("read %q, %v, want the writes in order", buf, err)
+	}
+
+	// the first write error is returned by the following calls
+	_ = remote.Close()
+	_, _ = conn.Write([]byte("lost"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := conn.Write([]byte("after")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Write kept succeeding after the other end closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conn.Close(); err == nil {
+		t.Error("Close() = nil, want the write error")
+	}
+	if _, err := conn.Write([]byte("closed")); err == nil {
+		t.Error("Write() after Close succeeded")
+	}
+}
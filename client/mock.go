@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Mock is a canned response served for requests whose path starts with PathPrefix
+type Mock struct {
+	PathPrefix string
+	// Methods the mock answers, or empty for every method
+	Methods []string
+
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// mockFile is the YAML layout of a mocks file
+type mockFile struct {
+	Mocks []struct {
+		Path     string            `yaml:"path"`
+		Methods  []string          `yaml:"methods"`
+		Status   int               `yaml:"status"`
+		Headers  map[string]string `yaml:"headers"`
+		Body     string            `yaml:"body"`
+		BodyFile string            `yaml:"body_file"`
+	} `yaml:"mocks"`
+}
+
+// LoadMocks reads mocks from a YAML file of the form
+//
+//	mocks:
+//	  - path: /webhook
+//	    methods: [GET]
+//	    status: 200
+//	    headers:
+//	      Content-Type: application/json
+//	    body: '{"ok": true}'
+//
+// A body can be read from body_file instead, relative to the mocks file. The status
+// defaults to 200.
+func LoadMocks(path string) ([]Mock, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file mockFile
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	mocks := make([]Mock, 0, len(file.Mocks))
+	for i, fm := range file.Mocks {
+		if !strings.HasPrefix(fm.Path, "/") {
+			return nil, fmt.Errorf("%s: mock %d: path must start with /", path, i+1)
+		}
+
+		m := Mock{
+			PathPrefix: strings.TrimSuffix(fm.Path, "*"),
+			Status:     fm.Status,
+			Header:     make(http.Header),
+			Body:       []byte(fm.Body),
+		}
+		if m.Status == 0 {
+			m.Status = http.StatusOK
+		}
+		for _, method := range fm.Methods {
+			m.Methods = append(m.Methods, strings.ToUpper(method))
+		}
+		for name, value := range fm.Headers {
+			m.Header.Set(name, value)
+		}
+
+		if fm.BodyFile != "" {
+			bodyPath := fm.BodyFile
+			if !filepath.IsAbs(bodyPath) {
+				bodyPath = filepath.Join(filepath.Dir(path), bodyPath)
+			}
+			if m.Body, err = ioutil.ReadFile(bodyPath); err != nil {
+				return nil, fmt.Errorf("%s: mock %d: %w", path, i+1, err)
+			}
+		}
+		mocks = append(mocks, m)
+	}
+	return mocks, nil
+}
+
+// matchMock returns the mock with the longest path prefix answering the request
+func matchMock(mocks []Mock, method, path string) (*Mock, bool) {
+	var best *Mock
+	for i := range mocks {
+		m := &mocks[i]
+		if !strings.HasPrefix(path, m.PathPrefix) || (best != nil && len(m.PathPrefix) <= len(best.PathPrefix)) {
+			continue
+		}
+		if len(m.Methods) == 0 {
+			best = m
+			continue
+		}
+		for _, allowed := range m.Methods {
+			if allowed == method {
+				best = m
+				break
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// rawResponse formats the mock as a raw HTTP response
+func (m *Mock) rawResponse() []byte {
+	header := m.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(m.Body)))
+	header.Set("Connection", "close")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", m.Status, http.StatusText(m.Status))
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+// mockResponse returns the raw response of the mock matching a public request, if any.
+// Without a local service to fall back on, unmatched requests get a 404 response.
+func (c *LeapClient) mockResponse(rawRequest []byte, required bool) ([]byte, bool) {
+	if len(c.Config.Mocks) == 0 && !required {
+		return nil, false
+	}
+
+	method, path, _, err := parseRequestTarget(rawRequest)
+	if err != nil {
+		return nil, false
+	}
+
+	if m, ok := matchMock(c.Config.Mocks, method, path); ok {
+		return m.rawResponse(), true
+	}
+	if !required {
+		return nil, false
+	}
+
+	notFound := Mock{
+		Status: http.StatusNotFound,
+		Header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:   []byte(fmt.Sprintf("No mock matches %s %s\n", method, path)),
+	}
+	return notFound.rawResponse(), true
+}
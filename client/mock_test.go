@@ -0,0 +1,146 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadMocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-mocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "users.json"), []byte(`[{"id": 1}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		want    []Mock
+		wantErr bool
+	}{
+		{
+			name: "mocks",
+			file: `
+mocks:
+  - path: /webhook
+    methods: [post, Put]
+    status: 202
+    headers:
+      content-type: application/json
+    body: '{"ok": true}'
+  - path: /api/users*
+    body_file: users.json
+`,
+			want: []Mock{
+				{
+					PathPrefix: "/webhook",
+					Methods:    []string{"POST", "PUT"},
+					Status:     202,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       []byte(`{"ok": true}`),
+				},
+				{
+					PathPrefix: "/api/users",
+					Status:     200,
+					Header:     http.Header{},
+					Body:       []byte(`[{"id": 1}]`),
+				},
+			},
+		},
+		{name: "empty", file: "mocks: []\n", want: []Mock{}},
+		{name: "relative path", file: "mocks:\n  - path: webhook\n", wantErr: true},
+		{name: "missing body file", file: "mocks:\n  - path: /\n    body_file: missing.json\n", wantErr: true},
+		{name: "unknown field", file: "mocks:\n  - path: /\n    code: 200\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, filepath.Base(t.Name())+".yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mocks, err := LoadMocks(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadMocks() = %d mocks, want error", len(mocks))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadMocks() error: %v", err)
+			}
+			if !reflect.DeepEqual(mocks, tt.want) {
+				t.Errorf("LoadMocks() = %+v, want %+v", mocks, tt.want)
+			}
+		})
+	}
+}
+
+func TestMockResponse(t *testing.T) {
+	mocks := []Mock{
+		{PathPrefix: "/", Status: 200, Body: []byte("root")},
+		{PathPrefix: "/api", Methods: []string{"POST"}, Status: 201, Body: []byte("created")},
+		{PathPrefix: "/api/health", Status: 200, Header: http.Header{"Content-Type": {"text/plain"}}, Body: []byte("ok")},
+	}
+
+	tests := []struct {
+		name     string
+		mocks    []Mock
+		required bool
+		request  string
+		want     string
+		ok       bool
+	}{
+		{
+			name:    "longest prefix",
+			mocks:   mocks,
+			request: "GET /api/health HTTP/1.1\r\nHost: foo\r\n\r\n",
+			want:    "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n\r\nok",
+			ok:      true,
+		},
+		{
+			name:    "method",
+			mocks:   mocks,
+			request: "POST /api/users HTTP/1.1\r\nHost: foo\r\n\r\n",
+			want:    "HTTP/1.1 201 Created\r\nConnection: close\r\nContent-Length: 7\r\n\r\ncreated",
+			ok:      true,
+		},
+		{
+			name:    "other method falls back",
+			mocks:   mocks,
+			request: "GET /api/users HTTP/1.1\r\nHost: foo\r\n\r\n",
+			want:    "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 4\r\n\r\nroot",
+			ok:      true,
+		},
+		{
+			name:    "unmatched",
+			mocks:   mocks[1:],
+			request: "GET / HTTP/1.1\r\nHost: foo\r\n\r\n",
+		},
+		{
+			name:     "unmatched without local service",
+			mocks:    mocks[1:],
+			required: true,
+			request:  "GET / HTTP/1.1\r\nHost: foo\r\n\r\n",
+			want:     "HTTP/1.1 404 Not Found\r\nConnection: close\r\nContent-Length: 22\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nNo mock matches GET /\n",
+			ok:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &LeapClient{Config: &Config{Mocks: tt.mocks}}
+			got, ok := c.mockResponse([]byte(tt.request), tt.required)
+			if ok != tt.ok || string(got) != tt.want {
+				t.Errorf("mockResponse() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
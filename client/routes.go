@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errMalformedRequestLine = errors.New("malformed request line")
+
+// Route sends requests whose path is Prefix or under it to the service at Target. The
+// prefix /api covers /api and /api/users but not /apiary.
+type Route struct {
+	Prefix string
+	// Address of the local service, either host:port or just :port for 127.0.0.1
+	Target string
+	// Remove Prefix from the path before forwarding the request
+	StripPrefix bool
+	// Replace Prefix with Rewrite before forwarding the request. Takes precedence over
+	// StripPrefix.
+	Rewrite string
+}
+
+// ParseRoute parses a route of the form PREFIX=TARGET[;strip][;rewrite=PATH], for
+// example "/api/*=:8080;strip". A trailing * on the prefix is optional.
+func ParseRoute(s string) (Route, error) {
+	parts := strings.Split(s, ";")
+	eq := strings.Index(parts[0], "=")
+	if eq == -1 {
+		return Route{}, fmt.Errorf("route %q: expected PREFIX=TARGET", s)
+	}
+
+	r := Route{
+		Prefix: strings.TrimSuffix(strings.TrimSpace(parts[0][:eq]), "*"),
+		Target: strings.TrimSpace(parts[0][eq+1:]),
+	}
+	if !strings.HasPrefix(r.Prefix, "/") {
+		return Route{}, fmt.Errorf("route %q: prefix must start with /", s)
+	}
+	if _, err := r.address(); err != nil {
+		return Route{}, fmt.Errorf("route %q: %w", s, err)
+	}
+
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt == "strip":
+			r.StripPrefix = true
+		case strings.HasPrefix(opt, "rewrite="):
+			r.Rewrite = strings.TrimPrefix(opt, "rewrite=")
+		default:
+			return Route{}, fmt.Errorf("route %q: unknown option %q", s, opt)
+		}
+	}
+
+	return r, nil
+}
+
+// address returns the dial address of the route's target
+func (r *Route) address() (string, error) {
+	target := r.Target
+	if _, err := strconv.Atoi(target); err == nil {
+		target = ":" + target
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// rewritePath applies the route's prefix stripping or rewriting to path
+func (r *Route) rewritePath(path string) string {
+	switch {
+	case r.Rewrite != "":
+		return r.Rewrite + strings.TrimPrefix(path, r.Prefix)
+	case r.StripPrefix:
+		rest := strings.TrimPrefix(path, r.Prefix)
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		return rest
+	default:
+		return path
+	}
+}
+
+// matches reports whether path is the route's prefix or under it
+func (r *Route) matches(path string) bool {
+	if !strings.HasPrefix(path, r.Prefix) {
+		return false
+	}
+	return len(path) == len(r.Prefix) || strings.HasSuffix(r.Prefix, "/") || path[len(r.Prefix)] == '/'
+}
+
+// matchRoute returns the route with the longest prefix matching path
+func matchRoute(routes []Route, path string) (*Route, bool) {
+	var best *Route
+	for i := range routes {
+		r := &routes[i]
+		if r.matches(path) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	return best, best != nil
+}
+
+// routeRequest picks the local address for a raw request and rewrites its request
+// line as the matching route requires. Requests matching no route go to the local port,
+// or to no address if there is none.
+func (c *LeapClient) routeRequest(raw []byte) (string, []byte, error) {
+	var defaultAddr string
+	if c.Config.LocalPort != 0 {
+		defaultAddr = fmt.Sprintf("127.0.0.1:%d", c.Config.LocalPort)
+	}
+	if len(c.Config.Routes) == 0 {
+		return defaultAddr, raw, nil
+	}
+
+	lineEnd := bytes.Index(raw, []byte("\r\n"))
+	if lineEnd == -1 {
+		return "", nil, errMalformedRequestLine
+	}
+	fields := strings.Split(string(raw[:lineEnd]), " ")
+	if len(fields) != 3 {
+		return "", nil, errMalformedRequestLine
+	}
+
+	target := fields[1]
+	path, query := target, ""
+	if i := strings.Index(target, "?"); i != -1 {
+		path, query = target[:i], target[i:]
+	}
+
+	route, ok := matchRoute(c.Config.Routes, path)
+	if !ok {
+		return defaultAddr, raw, nil
+	}
+
+	addr, err := route.address()
+	if err != nil {
+		return "", nil, err
+	}
+
+	newTarget := route.rewritePath(path) + query
+	if newTarget == target {
+		return addr, raw, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(raw) + len(newTarget) - len(target))
+	buf.WriteString(fields[0] + " " + newTarget + " " + fields[2])
+	buf.Write(raw[lineEnd:])
+	return addr, buf.Bytes(), nil
+}
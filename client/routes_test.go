@@ -0,0 +1,96 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		in       string
+		want     Route
+		wantAddr string
+		wantErr  bool
+	}{
+		{in: "/api=:8080", want: Route{Prefix: "/api", Target: ":8080"}, wantAddr: "127.0.0.1:8080"},
+		{in: "/api/*=8080", want: Route{Prefix: "/api/", Target: "8080"}, wantAddr: "127.0.0.1:8080"},
+		{in: " /static = localhost:3000 ", want: Route{Prefix: "/static", Target: "localhost:3000"}, wantAddr: "localhost:3000"},
+		{in: "/api/*=:8080;strip", want: Route{Prefix: "/api/", Target: ":8080", StripPrefix: true}, wantAddr: "127.0.0.1:8080"},
+		{in: "/v1=:8080;rewrite=/api/v1", want: Route{Prefix: "/v1", Target: ":8080", Rewrite: "/api/v1"}, wantAddr: "127.0.0.1:8080"},
+		{in: "/=[::1]:9000; strip ", want: Route{Prefix: "/", Target: "[::1]:9000", StripPrefix: true}, wantAddr: "[::1]:9000"},
+		{in: "/api", wantErr: true},
+		{in: "api=:8080", wantErr: true},
+		{in: "/api=", wantErr: true},
+		{in: "/api=localhost", wantErr: true},
+		{in: "/api=:8080;gzip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRoute(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseRoute(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRoute(%q) error: %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRoute(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+			if addr, _ := got.address(); addr != tt.wantAddr {
+				t.Errorf("address() = %q, want %q", addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	c := &LeapClient{Config: &Config{
+		LocalPort: 3000,
+		Routes: []Route{
+			{Prefix: "/api/", Target: ":8080", StripPrefix: true},
+			{Prefix: "/api/v1/", Target: ":8081", Rewrite: "/v1/"},
+			{Prefix: "/static", Target: "files:80"},
+			{Prefix: "/api", Target: ":8079"},
+		},
+	}}
+
+	tests := []struct {
+		target     string
+		wantAddr   string
+		wantTarget string
+	}{
+		{"/", "127.0.0.1:3000", "/"},
+		{"/apis", "127.0.0.1:3000", "/apis"},
+		{"/apiary", "127.0.0.1:3000", "/apiary"},
+		{"/api", "127.0.0.1:8079", "/api"},
+		{"/api/users?page=2", "127.0.0.1:8080", "/users?page=2"},
+		{"/api/", "127.0.0.1:8080", "/"},
+		{"/api/v1/users", "127.0.0.1:8081", "/v1/users"},
+		{"/static/app.js", "files:80", "/static/app.js"},
+		{"/static", "files:80", "/static"},
+		{"/static?v=2", "files:80", "/static?v=2"},
+		{"/statics/app.js", "127.0.0.1:3000", "/statics/app.js"},
+		{"/static-old/app.js", "127.0.0.1:3000", "/static-old/app.js"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			raw := []byte("GET " + tt.target + " HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n")
+			addr, routed, err := c.routeRequest(raw)
+			if err != nil {
+				t.Fatalf("routeRequest() error: %v", err)
+			}
+			if addr != tt.wantAddr {
+				t.Errorf("address = %q, want %q", addr, tt.wantAddr)
+			}
+			want := "GET " + tt.wantTarget + " HTTP/1.1\r\nHost: foo.leap.example.com\r\n\r\n"
+			if string(routed) != want {
+				t.Errorf("request = %q, want %q", routed, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// FileServerOptions configures a FileServer
+type FileServerOptions struct {
+	// List the files of directories without an index.html
+	Listing bool
+	// Answer requests for missing files with the root index.html, for single-page
+	// applications that route on the client
+	SPA bool
+}
+
+// fileServer serves the files of a directory like http.FileServer, which handles index
+// files and range requests, optionally hiding listings and falling back to index.html
+type fileServer struct {
+	fs    http.FileSystem
+	files http.Handler
+	spa   bool
+}
+
+// NewFileServer returns a handler serving the files of dir
+func NewFileServer(dir string, opts FileServerOptions) (http.Handler, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	var fs http.FileSystem = http.Dir(dir)
+	if !opts.Listing {
+		fs = noListingFS{fs}
+	}
+	return &fileServer{
+		fs:    fs,
+		files: http.FileServer(fs),
+		spa:   opts.SPA,
+	}, nil
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.spa && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		f, err := s.fs.Open(path.Clean("/" + r.URL.Path))
+		if os.IsNotExist(err) && s.serveIndex(w, r) {
+			return
+		}
+		if err == nil {
+			_ = f.Close()
+		}
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+// serveIndex serves the root index.html, reporting whether there is one. Serving it
+// directly avoids http.FileServer's redirect of /index.html to /.
+func (s *fileServer) serveIndex(w http.ResponseWriter, r *http.Request) bool {
+	f, err := s.fs.Open("/index.html")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	http.ServeContent(w, r, "index.html", info.ModTime(), f)
+	return true
+}
+
+// noListingFS hides directories without an index.html, so that they are not listed
+type noListingFS struct {
+	http.FileSystem
+}
+
+func (fs noListingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := fs.FileSystem.Open(strings.TrimSuffix(name, "/") + "/index.html")
+		if err != nil {
+			_ = f.Close()
+			return nil, os.ErrNotExist
+		}
+		_ = index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"index.html":        "home",
+		"app.js":            "console.log(1)",
+		"docs/index.html":   "docs",
+		"assets/logo.svg":   "<svg/>",
+		"assets/style.css":  "body {}",
+		"assets/fonts/a.tt": "font",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(filepath.Dir(dir), "leap-static-secret")
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outside)
+
+	tests := []struct {
+		name   string
+		opts   FileServerOptions
+		method string
+		path   string
+		status int
+		// contained in the body, if set
+		body string
+	}{
+		{name: "index", path: "/", status: http.StatusOK, body: "home"},
+		{name: "file", path: "/app.js", status: http.StatusOK, body: "console.log(1)"},
+		{name: "directory index", path: "/docs/", status: http.StatusOK, body: "docs"},
+		{name: "directory redirect", path: "/docs", status: http.StatusMovedPermanently},
+		{name: "missing", path: "/missing.js", status: http.StatusNotFound},
+		{name: "listing hidden", path: "/assets/", status: http.StatusNotFound},
+		{name: "listing", opts: FileServerOptions{Listing: true}, path: "/assets/", status: http.StatusOK, body: "logo.svg"},
+		{name: "traversal", path: "/../leap-static-secret", status: http.StatusNotFound},
+		{name: "spa route", opts: FileServerOptions{SPA: true}, path: "/users/42", status: http.StatusOK, body: "home"},
+		{name: "spa file", opts: FileServerOptions{SPA: true}, path: "/app.js", status: http.StatusOK, body: "console.log(1)"},
+		{name: "spa head", opts: FileServerOptions{SPA: true}, method: http.MethodHead, path: "/users/42", status: http.StatusOK},
+		{name: "spa post", opts: FileServerOptions{SPA: true}, method: http.MethodPost, path: "/users/42", status: http.StatusNotFound},
+		{name: "spa hidden listing", opts: FileServerOptions{SPA: true}, path: "/assets/", status: http.StatusOK, body: "home"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := NewFileServer(dir, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "http://foo.leap.example.com/", nil)
+			// set directly, as parsing a URL would clean the traversal away
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) || strings.Contains(w.Body.String(), "secret") {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestNewFileServerErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing"), file} {
+		if _, err := NewFileServer(path, FileServerOptions{}); err == nil {
+			t.Errorf("NewFileServer(%q) succeeded, want an error", path)
+		}
+	}
+}
@@ -57,7 +57,7 @@ func drawString(s tcell.Screen, x, y int, str string) {
 }
 
 func drawCenteredStringStyle(s tcell.Screen, x, y int, str string, style tcell.Style) {
-	centerX := x - len(str) / 2
+	centerX := x - len(str)/2
 	drawStringStyle(s, centerX, y, str, style)
 }
 
@@ -66,5 +66,27 @@ func drawCenteredString(s tcell.Screen, x, y int, str string) {
 }
 
 func drawStringLeft(s tcell.Screen, x, y int, str string) {
-	drawString(s, x - len(str), y, str)
-}
\ No newline at end of file
+	drawString(s, x-len(str), y, str)
+}
+
+func drawHorizontalLineStyle(s tcell.Screen, x, y, w int, r rune, style tcell.Style) {
+	for i := 0; i < w; i++ {
+		s.SetCell(x+i, y, style, r)
+	}
+}
+
+// drawClippedStringStyle draws str, cutting it off after w cells
+func drawClippedStringStyle(s tcell.Screen, x, y, w int, str string, style tcell.Style) {
+	i := 0
+	for _, r := range str {
+		if i >= w {
+			return
+		}
+		s.SetCell(x+i, y, style, r)
+		i++
+	}
+}
+
+func drawClippedString(s tcell.Screen, x, y, w int, str string) {
+	drawClippedStringStyle(s, x, y, w, str, tcell.StyleDefault)
+}
@@ -0,0 +1,254 @@
+package ui
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/client"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// How many requests are kept for the list
+	maxEntries = 500
+	// How much of each body is kept for the detail view
+	maxBodySize = 64 * 1024
+)
+
+// entry is a request shown in the list along with its response
+type entry struct {
+	time    time.Time
+	method  string
+	host    string
+	path    string
+	status  int
+	failure string // why there is no response, if there is none
+	elapsed time.Duration
+	size    int64
+	faults  []string // injected by fault rules
+
+	requestHeader  http.Header
+	requestBody    []byte
+	responseProto  string
+	responseStatus string
+	responseHeader http.Header
+	responseBody   []byte
+}
+
+// newEntry creates the entry of an exchange, or returns nil if its request is malformed
+func newEntry(ex *client.Exchange) *entry {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(ex.RawRequest)))
+	if err != nil {
+		return nil
+	}
+
+	e := &entry{
+		time:          ex.Start,
+		method:        r.Method,
+		host:          r.Host,
+		path:          r.URL.RequestURI(),
+		elapsed:       ex.Duration,
+		faults:        ex.Faults,
+		requestHeader: r.Header,
+	}
+	e.requestBody, _ = readBody(r.Body, r.Header)
+
+	resp := ex.Response()
+	if resp == nil {
+		switch {
+		case ex.ErrorCode != nil:
+			e.failure = ex.ErrorCode.String()
+		case errors.Is(ex.Err, client.ErrCanceled):
+			e.failure = "canceled"
+		case errors.Is(ex.Err, client.ErrFaultReset):
+			e.failure = "reset"
+		default:
+			e.failure = "failed"
+		}
+		if ex.Err != nil {
+			e.responseStatus = ex.Err.Error()
+		}
+		return e
+	}
+
+	e.status = resp.StatusCode
+	e.responseProto = resp.Proto
+	e.responseStatus = resp.Status
+	e.responseHeader = resp.Header
+	e.responseBody, e.size = readBody(resp.Body, resp.Header)
+	if resp.ContentLength > 0 {
+		e.size = resp.ContentLength
+	}
+	return e
+}
+
+// readBody reads up to maxBodySize of a body, decompressing it if it is gzipped, and
+// returns its full size on the wire
+func readBody(body io.ReadCloser, header http.Header) ([]byte, int64) {
+	if body == nil {
+		return nil, 0
+	}
+	defer body.Close()
+
+	raw, _ := ioutil.ReadAll(body)
+	size := int64(len(raw))
+
+	if strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		if zr, err := gzip.NewReader(bytes.NewReader(raw)); err == nil {
+			if decoded, err := ioutil.ReadAll(io.LimitReader(zr, maxBodySize)); err == nil {
+				raw = decoded
+			}
+		}
+	}
+
+	if len(raw) > maxBodySize {
+		raw = raw[:maxBodySize]
+	}
+	return raw, size
+}
+
+// matches reports whether the entry contains the filter text in its method, status,
+// host or path
+func (e *entry) matches(filter string) bool {
+	if filter == "" {
+		return true
+	}
+	text := fmt.Sprintf("%s %d %s %s%s %s", e.method, e.status, e.failure, e.host, e.path, strings.Join(e.faults, " "))
+	return strings.Contains(strings.ToLower(text), strings.ToLower(filter))
+}
+
+// summary formats the entry as a row of the list
+func (e *entry) summary(width int) string {
+	status := strconv.Itoa(e.status)
+	if e.failure != "" {
+		status = "ERR"
+	}
+	prefix := fmt.Sprintf("%s  %-7s %3s %8s %9s  ", e.time.Format("15:04:05"), e.method, status,
+		formatDuration(e.elapsed), formatSize(e.size))
+	path := e.path
+	if len(e.faults) > 0 {
+		path = "! " + path
+	}
+	return prefix + truncate(path, width-utf8.RuneCountInString(prefix))
+}
+
+// detailLines formats the request and response for the detail view
+func (e *entry) detailLines() []string {
+	lines := []string{fmt.Sprintf("%s %s", e.method, e.path), "Host: " + e.host}
+	lines = append(lines, headerLines(e.requestHeader)...)
+	lines = append(lines, bodyLines(e.requestBody, e.requestHeader)...)
+
+	lines = append(lines, "", strings.Repeat("─", 40), "")
+	if len(e.faults) > 0 {
+		lines = append(lines, "Injected faults: "+strings.Join(e.faults, ", "), "")
+	}
+	if e.failure != "" {
+		lines = append(lines, fmt.Sprintf("No response: %s  (%s)", e.failure, formatDuration(e.elapsed)))
+		if e.responseStatus != "" {
+			lines = append(lines, e.responseStatus)
+		}
+		return lines
+	}
+	lines = append(lines, fmt.Sprintf("%s %s  (%s, %s)", e.responseProto, e.responseStatus,
+		formatDuration(e.elapsed), formatSize(e.size)))
+	lines = append(lines, headerLines(e.responseHeader)...)
+	lines = append(lines, bodyLines(e.responseBody, e.responseHeader)...)
+	return lines
+}
+
+func headerLines(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		for _, value := range header[name] {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	return lines
+}
+
+// bodyLines pretty-prints JSON and form bodies and shows other text as is
+func bodyLines(body []byte, header http.Header) []string {
+	if len(body) == 0 {
+		return nil
+	}
+
+	lines := []string{""}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	switch {
+	case strings.Contains(contentType, "json"):
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, body, "", "  "); err == nil {
+			return append(lines, strings.Split(buf.String(), "\n")...)
+		}
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				for _, value := range values[key] {
+					lines = append(lines, key+" = "+value)
+				}
+			}
+			return lines
+		}
+	}
+
+	if !utf8.Valid(body) {
+		return append(lines, fmt.Sprintf("<%s of binary data>", formatSize(int64(len(body)))))
+	}
+	text := strings.ReplaceAll(string(body), "\r\n", "\n")
+	return append(lines, strings.Split(strings.ReplaceAll(text, "\t", "    "), "\n")...)
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1fKB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+	}
+}
+
+// truncate shortens s to at most width runes
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	if width == 1 {
+		return string(r[:1])
+	}
+	return string(r[:width-1]) + "…"
+}
@@ -0,0 +1,267 @@
+package ui
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/client"
+	"github.com/dnsge/leap/common"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewEntry(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, _ = zw.Write([]byte(`{"ok":true}`))
+	_ = zw.Close()
+
+	request := "POST /api/items?page=2 HTTP/1.1\r\nHost: foo.leap.example.com\r\nContent-Length: 7\r\n\r\nname=x&"
+	timeout := common.Timeout
+	tests := []struct {
+		name     string
+		ex       *client.Exchange
+		want     *entry
+		checkRaw bool // compare the bodies as well
+	}{
+		{
+			name: "response",
+			ex: &client.Exchange{
+				RawRequest:  []byte(request),
+				RawResponse: []byte("HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok"),
+			},
+			want: &entry{method: "POST", host: "foo.leap.example.com", path: "/api/items?page=2", status: 201, size: 2,
+				requestBody: []byte("name=x&"), responseProto: "HTTP/1.1", responseStatus: "201 Created", responseBody: []byte("ok")},
+			checkRaw: true,
+		},
+		{
+			name: "gzipped response",
+			ex: &client.Exchange{
+				RawRequest: []byte(request),
+				RawResponse: []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s",
+					gzipped.Len(), gzipped.String())),
+			},
+			want: &entry{method: "POST", host: "foo.leap.example.com", path: "/api/items?page=2", status: 200, size: int64(gzipped.Len()),
+				requestBody: []byte("name=x&"), responseProto: "HTTP/1.1", responseStatus: "200 OK", responseBody: []byte(`{"ok":true}`)},
+			checkRaw: true,
+		},
+		{
+			name: "error code",
+			ex:   &client.Exchange{RawRequest: []byte(request), ErrorCode: &timeout, Err: client.ErrTimeout},
+			want: &entry{method: "POST", host: "foo.leap.example.com", path: "/api/items?page=2", failure: "timeout",
+				responseStatus: client.ErrTimeout.Error()},
+		},
+		{
+			name: "canceled",
+			ex:   &client.Exchange{RawRequest: []byte(request), Err: client.ErrCanceled},
+			want: &entry{method: "POST", host: "foo.leap.example.com", path: "/api/items?page=2", failure: "canceled",
+				responseStatus: client.ErrCanceled.Error()},
+		},
+		{
+			name: "reset",
+			ex:   &client.Exchange{RawRequest: []byte(request), Faults: []string{"reset"}, Err: client.ErrFaultReset},
+			want: &entry{method: "POST", host: "foo.leap.example.com", path: "/api/items?page=2", failure: "reset",
+				faults: []string{"reset"}, responseStatus: client.ErrFaultReset.Error()},
+		},
+		{
+			name: "failed",
+			ex:   &client.Exchange{RawRequest: []byte(request), Err: errors.New("broken pipe")},
+			want: &entry{method: "POST", host: "foo.leap.example.com", path: "/api/items?page=2", failure: "failed",
+				responseStatus: "broken pipe"},
+		},
+		{
+			name: "malformed request",
+			ex:   &client.Exchange{RawRequest: []byte("nonsense")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEntry(tt.ex)
+			if tt.want == nil {
+				if e != nil {
+					t.Errorf("newEntry() = %+v, want nil", e)
+				}
+				return
+			}
+			if e == nil {
+				t.Fatal("newEntry() = nil")
+			}
+
+			got := *e
+			got.requestHeader, got.responseHeader = nil, nil
+			if !tt.checkRaw {
+				got.requestBody, got.responseBody = nil, nil
+			}
+			if !reflect.DeepEqual(&got, tt.want) {
+				t.Errorf("newEntry() =\n%+v\nwant\n%+v", &got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryMatches(t *testing.T) {
+	e := &entry{method: "GET", status: 404, host: "foo.leap.example.com", path: "/Users/42", faults: []string{"latency 1s"}}
+	failed := &entry{method: "POST", host: "foo.leap.example.com", path: "/", failure: "timeout"}
+
+	tests := []struct {
+		e      *entry
+		filter string
+		want   bool
+	}{
+		{e, "", true},
+		{e, "get", true},
+		{e, "404", true},
+		{e, "users/4", true},
+		{e, "foo.leap.example.com/users", true},
+		{e, "latency", true},
+		{e, "post", false},
+		{failed, "timeout", true},
+		{failed, "404", false},
+	}
+	for _, tt := range tests {
+		if got := tt.e.matches(tt.filter); got != tt.want {
+			t.Errorf("%s %s matches(%q) = %t, want %t", tt.e.method, tt.e.path, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestEntrySummary(t *testing.T) {
+	start := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+	tests := []struct {
+		e     *entry
+		width int
+		want  string
+	}{
+		{
+			e:     &entry{time: start, method: "GET", status: 200, elapsed: 25 * time.Millisecond, size: 2048, path: "/items"},
+			width: 80,
+			want:  "15:09:26  GET     200     25ms     2.0KB  /items",
+		},
+		{
+			e:     &entry{time: start, method: "DELETE", failure: "timeout", elapsed: 30 * time.Second, path: "/items/1"},
+			width: 80,
+			want:  "15:09:26  DELETE  ERR   30.00s        0B  /items/1",
+		},
+		{
+			e:     &entry{time: start, method: "GET", status: 200, path: "/a/long/path", faults: []string{"latency 1s"}},
+			width: 46,
+			want:  "15:09:26  GET     200      0ms        0B  ! /…",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.e.summary(tt.width); got != tt.want {
+			t.Errorf("summary(%d) = %q, want %q", tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	durations := map[time.Duration]string{
+		0:                       "0ms",
+		999 * time.Millisecond:  "999ms",
+		time.Second:             "1.00s",
+		1234 * time.Millisecond: "1.23s",
+	}
+	for d, want := range durations {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%v) = %q, want %q", d, got, want)
+		}
+	}
+
+	sizes := map[int64]string{
+		0:               "0B",
+		1023:            "1023B",
+		1024:            "1.0KB",
+		1536:            "1.5KB",
+		1024 * 1024:     "1.0MB",
+		5 * 1024 * 1024: "5.0MB",
+	}
+	for n, want := range sizes {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+
+	truncations := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 4, "hel…"},
+		{"héllo", 3, "hé…"},
+		{"hello", 1, "h"},
+		{"hello", 0, ""},
+		{"hello", -1, ""},
+	}
+	for _, tt := range truncations {
+		if got := truncate(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderLines(t *testing.T) {
+	header := http.Header{
+		"X-Trace":      {"b", "a"},
+		"Content-Type": {"text/plain"},
+	}
+	want := []string{"Content-Type: text/plain", "X-Trace: b", "X-Trace: a"}
+	if got := headerLines(header); !reflect.DeepEqual(got, want) {
+		t.Errorf("headerLines() = %q, want %q", got, want)
+	}
+}
+
+func TestBodyLines(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        []string
+	}{
+		{name: "empty", contentType: "application/json"},
+		{
+			name:        "json",
+			body:        `{"a":1,"b":[true]}`,
+			contentType: "application/json; charset=utf-8",
+			want:        []string{"", "{", `  "a": 1,`, `  "b": [`, "    true", "  ]", "}"},
+		},
+		{
+			name:        "invalid json",
+			body:        `{"a":`,
+			contentType: "application/json",
+			want:        []string{"", `{"a":`},
+		},
+		{
+			name:        "form",
+			body:        "b=2&a=1&a=3",
+			contentType: "application/x-www-form-urlencoded",
+			want:        []string{"", "a = 1", "a = 3", "b = 2"},
+		},
+		{
+			name:        "text",
+			body:        "line one\r\n\tline two",
+			contentType: "text/plain",
+			want:        []string{"", "line one", "    line two"},
+		},
+		{
+			name:        "binary",
+			body:        "\xff\xfe\xfd",
+			contentType: "application/octet-stream",
+			want:        []string{"", "<3B of binary data>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bodyLines([]byte(tt.body), http.Header{"Content-Type": {tt.contentType}})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bodyLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
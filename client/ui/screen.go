@@ -5,14 +5,30 @@ import (
 	"fmt"
 	"github.com/dnsge/leap/client"
 	"github.com/gdamore/tcell"
-	"math"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
 const updateInterval = time.Millisecond * 100
 
+// Rows above and below the request list
+const (
+	listTop    = 3
+	listBottom = 1
+)
+
+var (
+	styleBar      = tcell.StyleDefault.Background(tcell.ColorWhite).Foreground(tcell.ColorBlack)
+	styleURL      = tcell.StyleDefault.Foreground(tcell.ColorYellow).Underline(true)
+	styleDim      = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	styleSelected = tcell.StyleDefault.Background(tcell.ColorNavy).Foreground(tcell.ColorWhite)
+	styleSuccess  = tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	styleRedirect = tcell.StyleDefault.Foreground(tcell.ColorTeal)
+	styleFailure  = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
 func makeScreen() tcell.Screen {
 	s, err := tcell.NewScreen()
 	if err != nil {
@@ -37,8 +53,20 @@ type LeapUI struct {
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 
+	mu           sync.Mutex
 	status       string
 	requestCount int
+
+	entries  []*entry
+	selected int  // index of the selected entry among those matching the filter
+	follow   bool // keep the newest entry selected
+	offset   int  // first visible row of the list
+
+	filter        string
+	editingFilter bool
+
+	detail       *entry // entry shown in the detail view, if open
+	detailOffset int
 }
 
 func New(c *client.LeapClient, ctx context.Context, cancelFunc context.CancelFunc) *LeapUI {
@@ -50,10 +78,13 @@ func New(c *client.LeapClient, ctx context.Context, cancelFunc context.CancelFun
 		cancelFunc:   cancelFunc,
 		status:       "",
 		requestCount: 0,
+		follow:       true,
 	}
 
 	c.OnStateChange = func(state client.State) {
+		u.mu.Lock()
 		u.status = state.String()
+		u.mu.Unlock()
 		if state == client.Disconnected {
 			time.Sleep(time.Second * 2)
 			cancelFunc()
@@ -61,7 +92,22 @@ func New(c *client.LeapClient, ctx context.Context, cancelFunc context.CancelFun
 	}
 
 	c.OnRequest = func(*http.Request) {
+		u.mu.Lock()
 		u.requestCount++
+		u.mu.Unlock()
+	}
+
+	c.OnExchange = func(ex *client.Exchange) {
+		e := newEntry(ex)
+		if e == nil {
+			return
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.entries = append(u.entries, e)
+		if len(u.entries) > maxEntries {
+			u.entries = u.entries[len(u.entries)-maxEntries:]
+		}
 	}
 
 	return u
@@ -84,15 +130,27 @@ func (u *LeapUI) Run() {
 }
 
 func (u *LeapUI) formatProxyString() string {
-	s := ""
-	if u.client.Config.Secure {
-		s = "s"
-	}
+	return fmt.Sprintf("%s --> %s", u.client.PublicURL(), u.client.LocalTarget())
+}
 
-	return fmt.Sprintf("http%s://%s.%s --> http://127.0.0.1:%d", s, u.client.Subdomain(), u.client.Config.Domain, u.client.Config.LocalPort)
+// visibleEntries returns the entries matching the filter, oldest first. u.mu must be held.
+func (u *LeapUI) visibleEntries() []*entry {
+	if u.filter == "" {
+		return u.entries
+	}
+	var visible []*entry
+	for _, e := range u.entries {
+		if e.matches(u.filter) {
+			visible = append(visible, e)
+		}
+	}
+	return visible
 }
 
 func (u *LeapUI) drawScreen() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
 	u.screen.Clear()
 	w, h := u.screen.Size()
 
@@ -100,34 +158,232 @@ func (u *LeapUI) drawScreen() {
 		return
 	}
 
-	boxW := int(math.Min(float64(w), 75)) - 1
-	boxH := int(math.Min(float64(h), 11)) - 1
+	drawHorizontalLineStyle(u.screen, 0, 0, w, ' ', styleBar)
+	header := fmt.Sprintf(" Leap Client  |  %s  |  Requests: %d", u.status, u.requestCount)
+	drawClippedStringStyle(u.screen, 0, 0, w, header, styleBar)
 
-	boxX := (w - boxW) / 2
-	boxY := (h - boxH) / 2
+	if u.detail != nil {
+		u.drawDetail(w, h)
+	} else {
+		u.drawList(w, h)
+	}
+	u.screen.Show()
+}
 
-	boxCenterX := boxX + boxW/2
-	//boxCenterY := boxY + boxH/2
+func (u *LeapUI) drawList(w, h int) {
+	drawClippedStringStyle(u.screen, 1, 1, w-1, u.formatProxyString(), styleURL)
 
-	drawBorder(u.screen, boxX, boxY, boxW, boxH)
-	drawCenteredString(u.screen, boxCenterX, boxY+1, "-- Leap Client --")
-	drawCenteredString(u.screen, boxCenterX, boxY+4, fmt.Sprintf("Status: %s", u.status))
-	drawCenteredStringStyle(u.screen, boxCenterX, boxY+5, u.formatProxyString(), tcell.StyleDefault.Foreground(tcell.ColorYellow).Underline(true))
-	drawString(u.screen, boxX+2, boxY+boxH-1, "Press Ctrl-C or Esc to exit")
-	drawStringLeft(u.screen, boxX+boxW-1, boxY+boxH-1, fmt.Sprintf("Requests: %d", u.requestCount))
-	u.screen.Show()
+	switch {
+	case u.editingFilter:
+		drawClippedString(u.screen, 1, 2, w-1, "Filter: "+u.filter+"_")
+	case u.filter != "":
+		drawClippedString(u.screen, 1, 2, w-1, "Filter: "+u.filter)
+	default:
+		drawClippedStringStyle(u.screen, 1, 2, w-1, "Time      Method  Sta  Latency      Size  Path", styleDim)
+	}
+
+	visible := u.visibleEntries()
+	rows := h - listTop - listBottom
+	u.clampSelection(len(visible), rows)
+
+	if len(visible) == 0 {
+		drawClippedStringStyle(u.screen, 1, listTop, w-1, "Waiting for requests...", styleDim)
+	}
+	for row := 0; row < rows && u.offset+row < len(visible); row++ {
+		i := u.offset + row
+		e := visible[i]
+		style := statusStyle(e.status)
+		if i == u.selected {
+			style = styleSelected
+			drawHorizontalLineStyle(u.screen, 0, listTop+row, w, ' ', style)
+		}
+		drawClippedStringStyle(u.screen, 1, listTop+row, w-1, e.summary(w-2), style)
+	}
+
+	help := "↑/↓ select  Enter details  / filter  Esc exit"
+	if u.editingFilter {
+		help = "Enter apply  Esc clear"
+	}
+	drawClippedStringStyle(u.screen, 1, h-1, w-1, help, styleDim)
+}
+
+func (u *LeapUI) drawDetail(w, h int) {
+	lines := u.detail.detailLines()
+	rows := h - 2
+	if u.detailOffset > len(lines)-rows {
+		u.detailOffset = len(lines) - rows
+	}
+	if u.detailOffset < 0 {
+		u.detailOffset = 0
+	}
+
+	for row := 0; row < rows && u.detailOffset+row < len(lines); row++ {
+		drawClippedString(u.screen, 1, 1+row, w-2, lines[u.detailOffset+row])
+	}
+	drawClippedStringStyle(u.screen, 1, h-1, w-1, "↑/↓ scroll  Esc back", styleDim)
+}
+
+// clampSelection keeps the selection within the list and scrolled into view. u.mu must
+// be held.
+func (u *LeapUI) clampSelection(count, rows int) {
+	if u.follow || u.selected >= count {
+		u.selected = count - 1
+	}
+	if u.selected < 0 {
+		u.selected = 0
+	}
+
+	if rows < 1 {
+		rows = 1
+	}
+	if u.selected < u.offset {
+		u.offset = u.selected
+	} else if u.selected >= u.offset+rows {
+		u.offset = u.selected - rows + 1
+	}
+	if u.offset > count-rows {
+		u.offset = count - rows
+	}
+	if u.offset < 0 {
+		u.offset = 0
+	}
+}
+
+func statusStyle(status int) tcell.Style {
+	switch {
+	case status == 0, status >= 400:
+		return styleFailure
+	case status >= 300:
+		return styleRedirect
+	default:
+		return styleSuccess
+	}
 }
 
 func (u *LeapUI) pollEvents() {
 	for {
 		ev := u.screen.PollEvent()
 		switch ev := ev.(type) {
+		case *tcell.EventResize:
+			u.screen.Sync()
 		case *tcell.EventKey:
-			switch ev.Key() {
-			case tcell.KeyEscape, tcell.KeyCtrlC:
+			if ev.Key() == tcell.KeyCtrlC {
+				u.cancelFunc()
+				return
+			}
+
+			u.mu.Lock()
+			quit := u.handleKey(ev)
+			u.mu.Unlock()
+			if quit {
 				u.cancelFunc()
 				return
 			}
 		}
 	}
 }
+
+// handleKey updates the view for a key press, reporting whether the client should
+// exit. u.mu must be held.
+func (u *LeapUI) handleKey(ev *tcell.EventKey) bool {
+	_, h := u.screen.Size()
+	page := h - listTop - listBottom
+
+	if u.editingFilter {
+		switch ev.Key() {
+		case tcell.KeyEnter:
+			u.editingFilter = false
+		case tcell.KeyEscape:
+			u.editingFilter = false
+			u.filter = ""
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if r := []rune(u.filter); len(r) > 0 {
+				u.filter = string(r[:len(r)-1])
+			}
+		case tcell.KeyRune:
+			u.filter += string(ev.Rune())
+		}
+		u.follow = true
+		return false
+	}
+
+	if u.detail != nil {
+		switch ev.Key() {
+		case tcell.KeyEscape, tcell.KeyLeft, tcell.KeyBackspace, tcell.KeyBackspace2:
+			u.detail = nil
+		case tcell.KeyUp:
+			u.detailOffset--
+		case tcell.KeyDown:
+			u.detailOffset++
+		case tcell.KeyPgUp:
+			u.detailOffset -= page
+		case tcell.KeyPgDn:
+			u.detailOffset += page
+		case tcell.KeyHome:
+			u.detailOffset = 0
+		case tcell.KeyEnd:
+			u.detailOffset = len(u.detail.detailLines())
+		case tcell.KeyRune:
+			switch ev.Rune() {
+			case 'k':
+				u.detailOffset--
+			case 'j':
+				u.detailOffset++
+			case 'q':
+				u.detail = nil
+			}
+		}
+		return false
+	}
+
+	visible := u.visibleEntries()
+	move := func(delta int) {
+		u.follow = false
+		u.selected += delta
+		if u.selected >= len(visible)-1 {
+			u.follow = true
+		}
+	}
+
+	switch ev.Key() {
+	case tcell.KeyEscape:
+		if u.filter == "" {
+			return true
+		}
+		u.filter = ""
+		u.follow = true
+	case tcell.KeyUp:
+		move(-1)
+	case tcell.KeyDown:
+		move(1)
+	case tcell.KeyPgUp:
+		move(-page)
+	case tcell.KeyPgDn:
+		move(page)
+	case tcell.KeyHome:
+		move(-len(visible))
+	case tcell.KeyEnd:
+		move(len(visible))
+	case tcell.KeyEnter, tcell.KeyRight:
+		if u.selected >= 0 && u.selected < len(visible) {
+			u.detail = visible[u.selected]
+			u.detailOffset = 0
+		}
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'k':
+			move(-1)
+		case 'j':
+			move(1)
+		case 'g':
+			move(-len(visible))
+		case 'G':
+			move(len(visible))
+		case '/':
+			u.editingFilter = true
+		case 'q':
+			return true
+		}
+	}
+	return false
+}
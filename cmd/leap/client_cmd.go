@@ -2,35 +2,120 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/dnsge/leap/client"
 	"github.com/dnsge/leap/client/ui"
+	"github.com/mattn/go-isatty"
 	"github.com/urfave/cli/v2"
-	"log"
-	"net/http"
+	"os"
 )
 
 func runClient(c *cli.Context) error {
+	var routes []client.Route
+	for _, r := range c.StringSlice("route") {
+		route, err := client.ParseRoute(r)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, route)
+	}
+
+	var mocks []client.Mock
+	if path := c.String("mock"); path != "" {
+		loaded, err := client.LoadMocks(path)
+		if err != nil {
+			return err
+		}
+		mocks = loaded
+	} else if c.Int("port") == 0 && c.String("dir") == "" {
+		return errors.New("a local port is required unless mocks or a directory are given")
+	}
+
+	var headerRules []client.HeaderRule
+	if path := c.String("header-rules"); path != "" {
+		rules, err := client.LoadHeaderRules(path)
+		if err != nil {
+			return err
+		}
+		headerRules = rules
+	}
+	for _, flag := range []struct {
+		name  string
+		phase client.HeaderPhase
+	}{
+		{"request-header", client.RequestHeaders},
+		{"response-header", client.ResponseHeaders},
+	} {
+		for _, r := range c.StringSlice(flag.name) {
+			rule, err := client.ParseHeaderRule(flag.phase, r)
+			if err != nil {
+				return err
+			}
+			headerRules = append(headerRules, rule)
+		}
+	}
+
+	var faultRules []client.FaultRule
+	for _, r := range c.StringSlice("fault") {
+		rule, err := client.ParseFaultRule(r)
+		if err != nil {
+			return err
+		}
+		faultRules = append(faultRules, rule)
+	}
+
 	leapClient := client.New(&client.Config{
 		Domain:    c.String("domain"),
 		Subdomain: c.String("subdomain"),
 		LocalPort: c.Int("port"),
 		Secure:    c.Bool("secure"),
+		APIKey:    c.String("api-key"),
+		GroupKey:  c.String("group-key"),
+		Balance:   c.String("balance"),
+		Hostnames: c.StringSlice("hostname"),
+		Routes:    routes,
+
+		BaseDomain: c.String("base-domain"),
+
+		Mocks:        mocks,
+		MockFallback: c.Bool("mock-fallback"),
+		HeaderRules:  headerRules,
+		FaultRules:   faultRules,
+
+		Dir: c.String("dir"),
+		DirOptions: client.FileServerOptions{
+			Listing: c.Bool("dir-listing"),
+			SPA:     c.Bool("spa"),
+		},
+
+		DialTimeout:           c.Duration("dial-timeout"),
+		ResponseHeaderTimeout: c.Duration("response-header-timeout"),
+		Timeout:               c.Duration("timeout"),
+		MaxResponseSize:       c.Int64("max-response-size"),
+
+		HARFile:        c.String("har"),
+		HARMaxFileSize: c.Int64("har-max-size"),
+		HARMaxFiles:    c.Int("har-max-files"),
+		HARMaxBodySize: c.Int64("har-max-body"),
+
+		PingInterval: c.Duration("ping-interval"),
+		PingTimeout:  c.Duration("ping-timeout"),
+
+		DisableCompression: c.Bool("no-compression"),
 	})
 
 	var actualCtx context.Context
 
-	if true {
+	// the terminal UI needs a terminal, so fall back to plain output without one
+	headless := c.Bool("no-ui") || c.IsSet("log-format") || !isatty.IsTerminal(os.Stdout.Fd())
+	if !headless {
 		ctx, cancel := context.WithCancel(c.Context)
 		u := ui.New(leapClient, ctx, cancel)
 		go u.Run()
 		actualCtx = ctx
 	} else {
-		leapClient.OnStateChange = func(state client.State) {
-			log.Printf("New state: %s", state)
-		}
-		leapClient.OnRequest = func(r *http.Request) {
-			fmt.Printf("%s %s\n%s\n", r.Method, r.URL, r.Header)
+		if err := attachHeadlessOutput(leapClient, c.String("log-format")); err != nil {
+			return err
 		}
 		actualCtx = c.Context
 	}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/client"
+	"github.com/urfave/cli/v2"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// writeHAROutput writes a recording to the file named by the output flag, or stdout
+func writeHAROutput(c *cli.Context, har *client.HAR) error {
+	if output := c.String("output"); output != "" {
+		return client.WriteHAR(output, har)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(har)
+}
+
+func readHARArg(c *cli.Context) (*client.HAR, error) {
+	if c.NArg() != 1 {
+		return nil, errors.New("expected a single HAR file")
+	}
+	return client.ReadHAR(c.Args().First())
+}
+
+func runHARMerge(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("expected at least one HAR file")
+	}
+
+	merged := client.NewHAR()
+	for _, path := range c.Args().Slice() {
+		har, err := client.ReadHAR(path)
+		if err != nil {
+			return err
+		}
+		merged.Log.Entries = append(merged.Log.Entries, har.Log.Entries...)
+	}
+
+	sort.SliceStable(merged.Log.Entries, func(i, j int) bool {
+		return merged.Log.Entries[i].StartedDateTime.Before(merged.Log.Entries[j].StartedDateTime)
+	})
+	return writeHAROutput(c, merged)
+}
+
+func runHARTrim(c *cli.Context) error {
+	har, err := readHARArg(c)
+	if err != nil {
+		return err
+	}
+
+	since, until := c.Timestamp("since"), c.Timestamp("until")
+	host, pathPrefix := c.String("host"), c.String("path")
+
+	var kept []*client.HAREntry
+	for _, e := range har.Log.Entries {
+		if since != nil && e.StartedDateTime.Before(*since) {
+			continue
+		}
+		if until != nil && e.StartedDateTime.After(*until) {
+			continue
+		}
+		if host != "" || pathPrefix != "" {
+			u, err := url.Parse(e.Request.URL)
+			if err != nil {
+				continue
+			}
+			if host != "" && !strings.EqualFold(u.Hostname(), host) && !strings.EqualFold(u.Host, host) {
+				continue
+			}
+			if !strings.HasPrefix(u.Path, pathPrefix) {
+				continue
+			}
+		}
+		if c.Bool("strip-bodies") {
+			e.Request.PostData = nil
+			e.Response.Content.Text = ""
+			e.Response.Content.Encoding = ""
+		}
+		kept = append(kept, e)
+	}
+
+	if last := c.Int("last"); last > 0 && len(kept) > last {
+		kept = kept[len(kept)-last:]
+	}
+
+	har.Log.Entries = append([]*client.HAREntry{}, kept...)
+	return writeHAROutput(c, har)
+}
+
+func runHARConvert(c *cli.Context) error {
+	har, err := readHARArg(c)
+	if err != nil {
+		return err
+	}
+
+	switch format := c.String("to"); format {
+	case "curl":
+		for _, e := range har.Log.Entries {
+			fmt.Println(curlCommand(e))
+		}
+	case "jsonl":
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range har.Log.Entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
+
+// Headers curl sets by itself
+var curlSkippedHeaders = map[string]bool{
+	"host":           true,
+	"content-length": true,
+	"connection":     true,
+}
+
+// curlCommand formats the request of an entry as a curl command line
+func curlCommand(e *client.HAREntry) string {
+	parts := []string{"curl"}
+	if e.Request.Method != "GET" {
+		parts = append(parts, "-X", e.Request.Method)
+	}
+	parts = append(parts, shellQuote(e.Request.URL))
+
+	for _, h := range e.Request.Headers {
+		if curlSkippedHeaders[strings.ToLower(h.Name)] {
+			continue
+		}
+		parts = append(parts, "-H", shellQuote(h.Name+": "+h.Value))
+	}
+	if e.Request.PostData != nil {
+		parts = append(parts, "--data-raw", shellQuote(e.Request.PostData.Text))
+	}
+	return strings.Join(parts, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dnsge/leap/client"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// headlessEvent is a line of --log-format json output
+type headlessEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	State  string    `json:"state,omitempty"`
+	URL    string    `json:"url,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Method string    `json:"method,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Status int       `json:"status,omitempty"`
+	// Duration of the exchange in milliseconds
+	Duration      float64  `json:"duration_ms,omitempty"`
+	RequestBytes  int64    `json:"request_bytes,omitempty"`
+	ResponseBytes int64    `json:"response_bytes,omitempty"`
+	Faults        []string `json:"faults,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// headlessOutput reports the client's activity without the terminal UI. In text mode,
+// the public URL is printed alone on stdout once the tunnel is up and everything else
+// is logged to stderr. In json mode, every event is a JSON line on stdout.
+type headlessOutput struct {
+	client *client.LeapClient
+	json   bool
+
+	mu        sync.Mutex
+	enc       *json.Encoder
+	publicURL string // last printed public URL
+}
+
+func attachHeadlessOutput(c *client.LeapClient, format string) error {
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	h := &headlessOutput{
+		client: c,
+		json:   format == logFormatJSON,
+		enc:    json.NewEncoder(os.Stdout),
+	}
+	c.OnStateChange = h.stateChanged
+	c.OnExchange = h.exchange
+	c.OnError = h.error
+	return nil
+}
+
+func (h *headlessOutput) emit(e headlessEvent) {
+	e.Time = time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_ = h.enc.Encode(e)
+}
+
+func (h *headlessOutput) stateChanged(state client.State) {
+	if h.json {
+		h.emit(headlessEvent{Event: "state", State: state.String()})
+	} else {
+		log.Printf("State: %s\n", state)
+	}
+
+	if state != client.Connected {
+		return
+	}
+
+	publicURL := h.client.PublicURL()
+	target := h.client.LocalTarget()
+	if h.json {
+		h.emit(headlessEvent{Event: "tunnel", URL: publicURL, Target: target})
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if publicURL != h.publicURL {
+		h.publicURL = publicURL
+		log.Printf("Forwarding %s --> %s\n", publicURL, target)
+		fmt.Println(publicURL)
+	}
+}
+
+func (h *headlessOutput) exchange(ex *client.Exchange) {
+	if ex.Request == nil {
+		return
+	}
+
+	var failure string
+	if ex.ErrorCode != nil {
+		failure = ex.ErrorCode.String()
+	} else if ex.Err != nil {
+		failure = ex.Err.Error()
+	}
+
+	var injected string
+	if len(ex.Faults) > 0 {
+		injected = fmt.Sprintf(" [%s]", strings.Join(ex.Faults, ", "))
+	}
+
+	if h.json {
+		h.emit(headlessEvent{
+			Event:         "request",
+			Method:        ex.Request.Method,
+			Host:          ex.Request.Host,
+			Path:          ex.Request.URL.Path,
+			Status:        ex.StatusCode,
+			Duration:      float64(ex.Duration) / float64(time.Millisecond),
+			RequestBytes:  ex.RequestBytes,
+			ResponseBytes: ex.ResponseBytes,
+			Faults:        ex.Faults,
+			Error:         failure,
+		})
+	} else if failure != "" {
+		log.Printf("%s %s failed after %v: %s%s\n", ex.Request.Method, ex.Request.URL, ex.Duration.Round(time.Millisecond), failure, injected)
+	} else {
+		log.Printf("%s %s %d %v %dB%s\n", ex.Request.Method, ex.Request.URL, ex.StatusCode, ex.Duration.Round(time.Millisecond), ex.ResponseBytes, injected)
+	}
+}
+
+func (h *headlessOutput) error(err error) {
+	if h.json {
+		h.emit(headlessEvent{Event: "error", Error: err.Error()})
+	} else {
+		log.Printf("Error: %v\n", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/dnsge/leap/client"
+	"github.com/dnsge/leap/common"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testExchanges returns an answered and a failed exchange
+func testExchanges() []*client.Exchange {
+	get, _ := http.NewRequest(http.MethodGet, "http://foo.leap.example.com/items?page=2", nil)
+	post, _ := http.NewRequest(http.MethodPost, "http://foo.leap.example.com/upload", nil)
+	timeout := common.Timeout
+	return []*client.Exchange{
+		{
+			Request:       get,
+			StatusCode:    http.StatusOK,
+			Duration:      1500 * time.Microsecond,
+			RequestBytes:  80,
+			ResponseBytes: 512,
+			Faults:        []string{"latency 1ms"},
+		},
+		{
+			Request:   post,
+			Duration:  30 * time.Second,
+			ErrorCode: &timeout,
+			Err:       errors.New("connection timed out"),
+		},
+		// malformed requests are left out
+		{},
+	}
+}
+
+func TestHeadlessJSON(t *testing.T) {
+	c := client.New(&client.Config{Domain: "leap.example.com", LocalPort: 8080})
+	var buf bytes.Buffer
+	h := &headlessOutput{client: c, json: true, enc: json.NewEncoder(&buf)}
+
+	h.stateChanged(client.Connecting)
+	h.stateChanged(client.Connected)
+	for _, ex := range testExchanges() {
+		h.exchange(ex)
+	}
+	h.error(errors.New("connection lost"))
+
+	want := []headlessEvent{
+		{Event: "state", State: "Connecting"},
+		{Event: "state", State: "Connected"},
+		{Event: "tunnel", URL: c.PublicURL(), Target: "http://127.0.0.1:8080"},
+		{Event: "request", Method: "GET", Host: "foo.leap.example.com", Path: "/items", Status: 200, Duration: 1.5,
+			RequestBytes: 80, ResponseBytes: 512, Faults: []string{"latency 1ms"}},
+		{Event: "request", Method: "POST", Host: "foo.leap.example.com", Path: "/upload", Duration: 30000, Error: "timeout"},
+		{Event: "error", Error: "connection lost"},
+	}
+	var got []headlessEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e headlessEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event %q has no time", e.Event)
+		}
+		e.Time = time.Time{}
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestHeadlessText(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	c := client.New(&client.Config{Domain: "leap.example.com", LocalPort: 8080})
+	h := &headlessOutput{client: c}
+	h.stateChanged(client.Connected)
+	h.stateChanged(client.Reconnecting)
+	h.stateChanged(client.Connected)
+	for _, ex := range testExchanges() {
+		h.exchange(ex)
+	}
+	h.error(errors.New("connection lost"))
+
+	_ = w.Close()
+	printed, _ := ioutil.ReadAll(r)
+	if want := c.PublicURL() + "\n"; string(printed) != want {
+		t.Errorf("stdout = %q, want the public URL once", printed)
+	}
+
+	for _, want := range []string{
+		"State: Reconnecting",
+		"Forwarding " + c.PublicURL() + " --> http://127.0.0.1:8080",
+		"GET http://foo.leap.example.com/items?page=2 200 2ms 512B [latency 1ms]",
+		"POST http://foo.leap.example.com/upload failed after 30s: timeout",
+		"Error: connection lost",
+	} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log is missing %q:\n%s", want, logged.String())
+		}
+	}
+	if n := strings.Count(logged.String(), "Forwarding"); n != 1 {
+		t.Errorf("logged the tunnel %d times, want once", n)
+	}
+}
@@ -2,16 +2,18 @@ package main
 
 import (
 	"context"
+	"github.com/dnsge/leap/server"
 	"github.com/urfave/cli/v2"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func signalInterrupterContext() context.Context {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGKILL)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
@@ -32,9 +34,9 @@ func main() {
 		Usage: "A tunnel to your local environment for HTTP requests",
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
-				Name:  "debug",
-				Usage: "Enable debug mode",
-				Value: false,
+				Name:   "debug",
+				Usage:  "Enable debug mode",
+				Value:  false,
 				Hidden: true,
 			},
 		},
@@ -59,12 +61,10 @@ func main() {
 						DefaultText: "random",
 					},
 					&cli.IntFlag{
-						Name:     "port",
-						Aliases:  []string{"p"},
-						Usage:    "Local port to expose",
-						EnvVars:  []string{"LEAP_PORT"},
-						Required: true,
-						Value:    80,
+						Name:    "port",
+						Aliases: []string{"p"},
+						Usage:   "Local port to expose (required unless --mock or --dir is given)",
+						EnvVars: []string{"LEAP_PORT"},
 					},
 					&cli.BoolFlag{
 						Name:        "secure",
@@ -73,6 +73,159 @@ func main() {
 						Value:       true,
 						DefaultText: "true",
 					},
+					&cli.StringFlag{
+						Name:    "api-key",
+						Usage:   "Key to open tunnels with, if the leap server requires one",
+						EnvVars: []string{"LEAP_API_KEY"},
+					},
+					&cli.StringFlag{
+						Name:        "base-domain",
+						Usage:       "Base domain to open the tunnel under, for leap servers serving several",
+						EnvVars:     []string{"LEAP_BASE_DOMAIN"},
+						DefaultText: "the server domain",
+					},
+					&cli.StringFlag{
+						Name:    "group-key",
+						Usage:   "Share the subdomain with other clients using the same key",
+						EnvVars: []string{"LEAP_GROUP_KEY"},
+					},
+					&cli.StringFlag{
+						Name:        "balance",
+						Usage:       "How a shared subdomain spreads requests: round-robin or least-inflight",
+						EnvVars:     []string{"LEAP_BALANCE"},
+						DefaultText: "round-robin",
+					},
+					&cli.StringSliceFlag{
+						Name:    "route",
+						Usage:   "Route requests by path to another local service, as PREFIX=TARGET[;strip][;rewrite=PATH] (e.g. /api/*=:8080;strip)",
+						EnvVars: []string{"LEAP_ROUTE"},
+					},
+					&cli.StringFlag{
+						Name:    "mock",
+						Usage:   "YAML file of canned responses by path, served instead of the local service",
+						EnvVars: []string{"LEAP_MOCK"},
+					},
+					&cli.BoolFlag{
+						Name:    "mock-fallback",
+						Usage:   "Only serve mocks when the local service is unreachable",
+						EnvVars: []string{"LEAP_MOCK_FALLBACK"},
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Usage:   "Serve the files of a directory instead of a local service",
+						EnvVars: []string{"LEAP_DIR"},
+					},
+					&cli.BoolFlag{
+						Name:    "dir-listing",
+						Usage:   "List the files of served directories without an index.html",
+						EnvVars: []string{"LEAP_DIR_LISTING"},
+					},
+					&cli.BoolFlag{
+						Name:    "spa",
+						Usage:   "Serve index.html for missing files of the served directory",
+						EnvVars: []string{"LEAP_SPA"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "fault",
+						Usage:   "Inject faults, as KEY=VALUE;... with keys latency, jitter, bandwidth (bytes/s), error (PERCENT%[:STATUS]), reset (PERCENT%), path and method (e.g. \"latency=300ms;jitter=100ms;error=5%:502;path=/api\")",
+						EnvVars: []string{"LEAP_FAULT"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "request-header",
+						Usage:   "Edit request headers, as ACTION NAME[: VALUE][;path=PREFIX][;method=M,...][;host=HOST] with ACTION add, set, remove or replace (e.g. \"set Authorization: Bearer x;path=/api\")",
+						EnvVars: []string{"LEAP_REQUEST_HEADER"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "response-header",
+						Usage:   "Edit response headers like --request-header; replace takes /PATTERN/REPLACEMENT/ (e.g. \"replace Set-Cookie: /;\\s*Domain=[^;]*//\")",
+						EnvVars: []string{"LEAP_RESPONSE_HEADER"},
+					},
+					&cli.StringFlag{
+						Name:    "header-rules",
+						Usage:   "YAML file of header rules, applied before those given by flags",
+						EnvVars: []string{"LEAP_HEADER_RULES"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "hostname",
+						Usage:   "Custom hostname to route to the tunnel (needs a CNAME record pointing at the leap server)",
+						EnvVars: []string{"LEAP_HOSTNAME"},
+					},
+					&cli.DurationFlag{
+						Name:    "dial-timeout",
+						Usage:   "How long to wait when connecting to the local port",
+						EnvVars: []string{"LEAP_DIAL_TIMEOUT"},
+						Value:   time.Second * 5,
+					},
+					&cli.DurationFlag{
+						Name:        "response-header-timeout",
+						Usage:       "How long to wait for the local service to send response headers",
+						EnvVars:     []string{"LEAP_RESPONSE_HEADER_TIMEOUT"},
+						DefaultText: "disabled",
+					},
+					&cli.DurationFlag{
+						Name:    "timeout",
+						Usage:   "How long the whole exchange with the local service may take",
+						EnvVars: []string{"LEAP_TIMEOUT"},
+						Value:   time.Second * 10,
+					},
+					&cli.Int64Flag{
+						Name:        "max-response-size",
+						Usage:       "Maximum size in bytes of a local service response",
+						EnvVars:     []string{"LEAP_MAX_RESPONSE_SIZE"},
+						DefaultText: "unlimited",
+					},
+					&cli.DurationFlag{
+						Name:    "ping-interval",
+						Usage:   "How often to ping the leap server, or 0 to disable keepalive",
+						EnvVars: []string{"LEAP_PING_INTERVAL"},
+						Value:   time.Second * 30,
+					},
+					&cli.DurationFlag{
+						Name:    "ping-timeout",
+						Usage:   "How long the leap server may take to answer a ping",
+						EnvVars: []string{"LEAP_PING_TIMEOUT"},
+						Value:   time.Second * 10,
+					},
+					&cli.BoolFlag{
+						Name:    "no-compression",
+						Usage:   "Send tunnel traffic uncompressed",
+						EnvVars: []string{"LEAP_NO_COMPRESSION"},
+					},
+					&cli.BoolFlag{
+						Name:        "no-ui",
+						Usage:       "Print plain log lines instead of the terminal UI",
+						EnvVars:     []string{"LEAP_NO_UI"},
+						DefaultText: "true when stdout is not a terminal",
+					},
+					&cli.StringFlag{
+						Name:    "log-format",
+						Usage:   "Format of the output without the terminal UI, text or json",
+						EnvVars: []string{"LEAP_LOG_FORMAT"},
+						Value:   "text",
+					},
+					&cli.StringFlag{
+						Name:    "har",
+						Usage:   "Record every request and response to a HAR file",
+						EnvVars: []string{"LEAP_HAR"},
+					},
+					&cli.Int64Flag{
+						Name:        "har-max-size",
+						Usage:       "Size in bytes at which the HAR file is rotated",
+						EnvVars:     []string{"LEAP_HAR_MAX_SIZE"},
+						DefaultText: "unlimited",
+					},
+					&cli.IntFlag{
+						Name:    "har-max-files",
+						Usage:   "Number of rotated HAR files to keep",
+						EnvVars: []string{"LEAP_HAR_MAX_FILES"},
+						Value:   5,
+					},
+					&cli.Int64Flag{
+						Name:    "har-max-body",
+						Usage:   "Maximum size in bytes of a body recorded in the HAR file, or 0 for no limit",
+						EnvVars: []string{"LEAP_HAR_MAX_BODY"},
+						Value:   1024 * 1024,
+					},
 				},
 			},
 			{
@@ -81,11 +234,16 @@ func main() {
 				Action: runServer,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:     "domain",
-						Aliases:  []string{"d"},
-						Usage:    "Domain of the leap server",
-						EnvVars:  []string{"LEAP_DOMAIN"},
-						Required: true,
+						Name:    "domain",
+						Aliases: []string{"d"},
+						Usage:   "Domain of the leap server, required unless set in the config file",
+						EnvVars: []string{"LEAP_DOMAIN"},
+					},
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Usage:   "YAML configuration file overriding the flags, reloaded on SIGHUP",
+						EnvVars: []string{"LEAP_CONFIG"},
 					},
 					&cli.StringFlag{
 						Name:    "bind",
@@ -94,6 +252,251 @@ func main() {
 						EnvVars: []string{"LEAP_BIND"},
 						Value:   "0.0.0.0:8080",
 					},
+					&cli.DurationFlag{
+						Name:    "connect-timeout",
+						Usage:   "How long an issued tunnel token stays valid before the client connects",
+						EnvVars: []string{"LEAP_CONNECT_TIMEOUT"},
+						Value:   time.Second * 30,
+					},
+					&cli.DurationFlag{
+						Name:        "idle-timeout",
+						Usage:       "Close tunnels that have had no traffic for this long",
+						EnvVars:     []string{"LEAP_IDLE_TIMEOUT"},
+						DefaultText: "disabled",
+					},
+					&cli.DurationFlag{
+						Name:    "request-timeout",
+						Usage:   "How long to wait for a tunnel to answer a request before responding with 504",
+						EnvVars: []string{"LEAP_REQUEST_TIMEOUT"},
+						Value:   time.Second * 30,
+					},
+					&cli.DurationFlag{
+						Name:    "ping-interval",
+						Usage:   "How often to ping the client, or 0 to disable keepalive",
+						EnvVars: []string{"LEAP_PING_INTERVAL"},
+						Value:   time.Second * 30,
+					},
+					&cli.DurationFlag{
+						Name:    "ping-timeout",
+						Usage:   "How long the client may take to answer a ping",
+						EnvVars: []string{"LEAP_PING_TIMEOUT"},
+						Value:   time.Second * 10,
+					},
+					&cli.BoolFlag{
+						Name:    "no-compression",
+						Usage:   "Never compress tunnel traffic, even for clients that accept it",
+						EnvVars: []string{"LEAP_NO_COMPRESSION"},
+					},
+					&cli.StringFlag{
+						Name:        "resolver",
+						Usage:       "DNS server (host:port) used to verify custom hostnames",
+						EnvVars:     []string{"LEAP_RESOLVER"},
+						DefaultText: "system resolver",
+					},
+					&cli.StringFlag{
+						Name:    "tls-bind",
+						Usage:   "Address to bind the TLS listener to",
+						EnvVars: []string{"LEAP_TLS_BIND"},
+					},
+					&cli.StringFlag{
+						Name:    "tls-cert",
+						Usage:   "Certificate file for the leap domain and its subdomains",
+						EnvVars: []string{"LEAP_TLS_CERT"},
+					},
+					&cli.StringFlag{
+						Name:    "tls-key",
+						Usage:   "Key file for the leap domain certificate",
+						EnvVars: []string{"LEAP_TLS_KEY"},
+					},
+					&cli.StringFlag{
+						Name:    "cert-cache",
+						Usage:   "Directory to store certificates issued for custom hostnames",
+						EnvVars: []string{"LEAP_CERT_CACHE"},
+						Value:   "certs",
+					},
+					&cli.StringFlag{
+						Name:    "acme-email",
+						Usage:   "Contact email for the ACME account",
+						EnvVars: []string{"LEAP_ACME_EMAIL"},
+					},
+					&cli.StringFlag{
+						Name:        "acme-directory",
+						Usage:       "ACME directory URL used to issue certificates",
+						EnvVars:     []string{"LEAP_ACME_DIRECTORY"},
+						DefaultText: "Let's Encrypt",
+					},
+					&cli.StringFlag{
+						Name:    "cluster-bind",
+						Usage:   "Address of the internal listener for other nodes, enabling cluster mode. Members of a tunnel group must connect to the same node",
+						EnvVars: []string{"LEAP_CLUSTER_BIND"},
+					},
+					&cli.StringFlag{
+						Name:        "cluster-advertise",
+						Usage:       "Address other nodes use to reach this node's internal listener",
+						EnvVars:     []string{"LEAP_CLUSTER_ADVERTISE"},
+						DefaultText: "cluster bind address",
+					},
+					&cli.StringFlag{
+						Name:    "cluster-secret",
+						Usage:   "Shared secret authenticating requests between nodes",
+						EnvVars: []string{"LEAP_CLUSTER_SECRET"},
+					},
+					&cli.StringFlag{
+						Name:        "cluster-registry",
+						Usage:       "URL of the node serving the cluster registry (e.g. http://10.0.0.1:7070)",
+						EnvVars:     []string{"LEAP_CLUSTER_REGISTRY"},
+						DefaultText: "serve the registry from this node",
+					},
+					&cli.StringFlag{
+						Name:        "node-id",
+						Usage:       "Unique name of this node in the cluster",
+						EnvVars:     []string{"LEAP_NODE_ID"},
+						DefaultText: "random",
+					},
+					&cli.StringFlag{
+						Name:    "webhook-url",
+						Usage:   "URL tunnel and request events are posted to as JSON",
+						EnvVars: []string{"LEAP_WEBHOOK_URL"},
+					},
+					&cli.StringFlag{
+						Name:    "webhook-secret",
+						Usage:   "Key signing webhook payloads with HMAC-SHA256 in the X-Leap-Signature header",
+						EnvVars: []string{"LEAP_WEBHOOK_SECRET"},
+					},
+					&cli.StringFlag{
+						Name:    "pages-dir",
+						Usage:   "Directory of HTML templates replacing the landing and error pages, e.g. tunnel_offline.html",
+						EnvVars: []string{"LEAP_PAGES_DIR"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "reserved",
+						Usage:   "Subdomain clients may not open tunnels on (repeatable)",
+						EnvVars: []string{"LEAP_RESERVED"},
+					},
+					&cli.StringFlag{
+						Name:        "log-file",
+						Usage:       "File to append the log to, reopened on SIGHUP",
+						EnvVars:     []string{"LEAP_LOG_FILE"},
+						DefaultText: "stderr",
+					},
+					&cli.StringSliceFlag{
+						Name:    "api-key",
+						Usage:   "Key clients must present to open tunnels, as KEY[;name=NAME][;quota=SIZE][;domain=DOMAIN] (e.g. \"s3cret;name=alice;quota=10g\")",
+						EnvVars: []string{"LEAP_API_KEY"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "extra-domain",
+						Usage:   "Another base domain to serve tunnels under, as NAME[;quota=SIZE][;bandwidth=SIZE][;cert=FILE;key=FILE]",
+						EnvVars: []string{"LEAP_EXTRA_DOMAIN"},
+					},
+					&cli.StringFlag{
+						Name:    "quota-period",
+						Usage:   "How often usage and quotas reset, daily or monthly",
+						EnvVars: []string{"LEAP_QUOTA_PERIOD"},
+						Value:   string(server.QuotaMonthly),
+					},
+					&cli.StringFlag{
+						Name:        "tunnel-quota",
+						Usage:       "Bytes each subdomain may transfer per quota period, as a SIZE (e.g. 10g)",
+						EnvVars:     []string{"LEAP_TUNNEL_QUOTA"},
+						DefaultText: "unlimited",
+					},
+					&cli.StringFlag{
+						Name:        "tunnel-bandwidth",
+						Usage:       "Bytes per second the traffic of each tunnel is throttled to, as a SIZE (e.g. 512k)",
+						EnvVars:     []string{"LEAP_TUNNEL_BANDWIDTH"},
+						DefaultText: "unlimited",
+					},
+					&cli.StringFlag{
+						Name:    "admin-token",
+						Usage:   "Bearer token of the admin API under /api/admin, which is disabled without one",
+						EnvVars: []string{"LEAP_ADMIN_TOKEN"},
+					},
+					&cli.DurationFlag{
+						Name:    "drain-timeout",
+						Usage:   "How long requests in flight may take to finish when shutting down",
+						EnvVars: []string{"LEAP_DRAIN_TIMEOUT"},
+						Value:   time.Second * 30,
+					},
+					&cli.BoolFlag{
+						Name:    "hot-restart",
+						Usage:   "On SIGUSR2, start a new server process that takes over the listeners, then drain this one",
+						EnvVars: []string{"LEAP_HOT_RESTART"},
+					},
+				},
+			},
+			{
+				Name:  "har",
+				Usage: "inspect and edit HAR recordings made with expose --har",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "merge",
+						Usage:     "combine recordings, such as rotated files, ordered by time",
+						ArgsUsage: "FILE...",
+						Action:    runHARMerge,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:        "output",
+								Aliases:     []string{"o"},
+								Usage:       "File to write the merged recording to",
+								DefaultText: "stdout",
+							},
+						},
+					},
+					{
+						Name:      "trim",
+						Usage:     "keep only some entries of a recording",
+						ArgsUsage: "FILE",
+						Action:    runHARTrim,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:        "output",
+								Aliases:     []string{"o"},
+								Usage:       "File to write the trimmed recording to",
+								DefaultText: "stdout",
+							},
+							&cli.IntFlag{
+								Name:        "last",
+								Usage:       "Keep only the last N entries",
+								DefaultText: "all",
+							},
+							&cli.TimestampFlag{
+								Name:   "since",
+								Usage:  "Drop entries started before this time",
+								Layout: time.RFC3339,
+							},
+							&cli.TimestampFlag{
+								Name:   "until",
+								Usage:  "Drop entries started after this time",
+								Layout: time.RFC3339,
+							},
+							&cli.StringFlag{
+								Name:  "host",
+								Usage: "Keep only requests to this host",
+							},
+							&cli.StringFlag{
+								Name:  "path",
+								Usage: "Keep only requests whose path starts with this prefix",
+							},
+							&cli.BoolFlag{
+								Name:  "strip-bodies",
+								Usage: "Remove request and response bodies",
+							},
+						},
+					},
+					{
+						Name:      "convert",
+						Usage:     "print the requests of a recording in another format",
+						ArgsUsage: "FILE",
+						Action:    runHARConvert,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "to",
+								Usage: "Output format: curl (a command per request) or jsonl (an entry per line)",
+								Value: "curl",
+							},
+						},
+					},
 				},
 			},
 		},
@@ -1,15 +1,104 @@
 package main
 
 import (
+	"fmt"
+	"github.com/dnsge/leap/common"
 	"github.com/dnsge/leap/server"
 	"github.com/urfave/cli/v2"
 )
 
+// sizeFlag returns the number of bytes given to a flag as a size like 10g, or zero if the
+// flag is not set
+func sizeFlag(c *cli.Context, name string) (int64, error) {
+	if c.String(name) == "" {
+		return 0, nil
+	}
+	n, err := common.ParseSize(c.String(name))
+	if err != nil {
+		return 0, fmt.Errorf("--%s: %w", name, err)
+	}
+	return n, nil
+}
+
 func runServer(c *cli.Context) error {
-	s := server.New(&server.Config{
+	var apiKeys []server.APIKey
+	for _, k := range c.StringSlice("api-key") {
+		key, err := server.ParseAPIKey(k)
+		if err != nil {
+			return err
+		}
+		apiKeys = append(apiKeys, key)
+	}
+
+	var domains []server.DomainConfig
+	for _, d := range c.StringSlice("extra-domain") {
+		domain, err := server.ParseDomain(d)
+		if err != nil {
+			return err
+		}
+		domains = append(domains, domain)
+	}
+
+	tunnelQuota, err := sizeFlag(c, "tunnel-quota")
+	if err != nil {
+		return err
+	}
+	tunnelBandwidth, err := sizeFlag(c, "tunnel-bandwidth")
+	if err != nil {
+		return err
+	}
+
+	config := &server.Config{
 		Domain: c.String("domain"),
 		Bind:   c.String("bind"),
 		Debug:  c.Bool("debug"),
-	})
-	return s.Run(c.Context)
+
+		Domains: domains,
+
+		ConnectTimeout: c.Duration("connect-timeout"),
+		IdleTimeout:    c.Duration("idle-timeout"),
+		RequestTimeout: c.Duration("request-timeout"),
+		PingInterval:   c.Duration("ping-interval"),
+		PingTimeout:    c.Duration("ping-timeout"),
+
+		DisableCompression: c.Bool("no-compression"),
+
+		Resolver:      c.String("resolver"),
+		TLSBind:       c.String("tls-bind"),
+		TLSCertFile:   c.String("tls-cert"),
+		TLSKeyFile:    c.String("tls-key"),
+		CertCacheDir:  c.String("cert-cache"),
+		ACMEEmail:     c.String("acme-email"),
+		ACMEDirectory: c.String("acme-directory"),
+
+		ClusterBind:      c.String("cluster-bind"),
+		ClusterAdvertise: c.String("cluster-advertise"),
+		ClusterSecret:    c.String("cluster-secret"),
+		ClusterRegistry:  c.String("cluster-registry"),
+		NodeID:           c.String("node-id"),
+
+		WebhookURL:    c.String("webhook-url"),
+		WebhookSecret: c.String("webhook-secret"),
+
+		APIKeys:         apiKeys,
+		QuotaPeriod:     server.QuotaPeriod(c.String("quota-period")),
+		TunnelQuota:     tunnelQuota,
+		TunnelBandwidth: tunnelBandwidth,
+		AdminToken:      c.String("admin-token"),
+
+		Reserved: c.StringSlice("reserved"),
+		LogFile:  c.String("log-file"),
+		PagesDir: c.String("pages-dir"),
+
+		DrainTimeout: c.Duration("drain-timeout"),
+		HotRestart:   c.Bool("hot-restart"),
+	}
+
+	if path := c.String("config"); path != "" {
+		var err error
+		if config, err = server.LoadConfigFile(path, config); err != nil {
+			return err
+		}
+	}
+	return server.New(config).Run(c.Context)
 }
@@ -1,10 +1,38 @@
 package common
 
+const (
+	BalanceRoundRobin    = "round-robin"
+	BalanceLeastInflight = "least-inflight"
+)
+
 type SubdomainRequest struct {
 	Subdomain string `json:"subdomain"`
+
+	// Group lets several clients holding the same GroupKey share the subdomain. Balance
+	// picks how requests are spread across them and is set by the first client.
+	Group    bool   `json:"group,omitempty"`
+	GroupKey string `json:"group_key,omitempty"`
+	Balance  string `json:"balance,omitempty"`
+
+	// Key required by servers that restrict who may open tunnels
+	APIKey string `json:"api_key,omitempty"`
+
+	// Base domain to open the tunnel under, for servers serving several. Empty means
+	// the domain the request was sent to.
+	Domain string `json:"domain,omitempty"`
 }
 
 type TokenResponse struct {
 	Subdomain string `json:"subdomain"`
-	Token     string `json:"token"`
+	// Base domain the subdomain is under
+	Domain string `json:"domain,omitempty"`
+	Token  string `json:"token"`
+	// Payload encodings the server accepts, besides plain base64. A client that accepts
+	// one as well asks for it when connecting.
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+type HostnameRequest struct {
+	Token    string `json:"token"`
+	Hostname string `json:"hostname"`
 }
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+)
+
+// EncodingGzip marks payloads that were gzipped before being base64-encoded
+const EncodingGzip = "gzip"
+
+// MinCompressSize is the size under which payloads are not worth compressing
+const MinCompressSize = 1024
+
+// MaxPayloadSize is the largest raw HTTP message carried through a tunnel
+const MaxPayloadSize = 128 << 20
+
+// MaxMessageSize is the largest websocket message a tunnel reads: a payload of
+// MaxPayloadSize encoded in base64, with room for the rest of the message
+var MaxMessageSize = int64(base64.StdEncoding.EncodedLen(MaxPayloadSize) + 4096)
+
+// ErrPayloadTooLarge is returned when decoding a payload larger than MaxPayloadSize
+var ErrPayloadTooLarge = fmt.Errorf("payload larger than %d bytes", MaxPayloadSize)
+
+// Content types whose bodies are already compressed
+var compressedTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/octet-stream",
+	"application/pdf", "application/wasm",
+}
+
+// EncodePayload encodes a raw HTTP message for a websocket message, gzipping it first
+// if compress is set and the message is worth compressing. It returns the encoded data
+// and its encoding, which is empty for plain base64.
+func EncodePayload(raw []byte, compress bool) (string, string) {
+	if compress && worthCompressing(raw) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(raw); err == nil && zw.Close() == nil && buf.Len() < len(raw) {
+			return base64.StdEncoding.EncodeToString(buf.Bytes()), EncodingGzip
+		}
+	}
+	return base64.StdEncoding.EncodeToString(raw), ""
+}
+
+// DecodePayload reverses EncodePayload, failing with ErrPayloadTooLarge rather than
+// decompressing more than MaxPayloadSize bytes
+func DecodePayload(data, encoding string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch encoding {
+	case "":
+		return b, nil
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := ioutil.ReadAll(io.LimitReader(zr, MaxPayloadSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > MaxPayloadSize {
+			return nil, ErrPayloadTooLarge
+		}
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("unknown payload encoding %q", encoding)
+	}
+}
+
+// worthCompressing reports whether a raw HTTP message is large enough and its body
+// isn't compressed already
+func worthCompressing(raw []byte) bool {
+	if len(raw) < MinCompressSize {
+		return false
+	}
+
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end == -1 {
+		return true
+	}
+	for _, line := range strings.Split(strings.ToLower(string(raw[:end])), "\r\n")[1:] {
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		name, value := line[:colon], strings.TrimSpace(line[colon+1:])
+		switch name {
+		case "content-encoding":
+			if value != "" && value != "identity" {
+				return false
+			}
+		case "content-type":
+			for _, t := range compressedTypes {
+				if strings.HasPrefix(value, t) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// CompressionStats counts the bytes of the payloads sent through tunnels before and
+// after compression. It is safe for concurrent use.
+type CompressionStats struct {
+	raw     int64
+	encoded int64
+}
+
+// Add counts a payload given its raw bytes and the data it was encoded to
+func (s *CompressionStats) Add(raw []byte, data string) {
+	atomic.AddInt64(&s.raw, int64(len(raw)))
+	var padding int
+	if n := len(data); n >= 2 {
+		padding = strings.Count(data[n-2:], "=")
+	}
+	atomic.AddInt64(&s.encoded, int64(base64.StdEncoding.DecodedLen(len(data))-padding))
+}
+
+// Bytes returns the total size of the payloads before and after compression
+func (s *CompressionStats) Bytes() (int64, int64) {
+	return atomic.LoadInt64(&s.raw), atomic.LoadInt64(&s.encoded)
+}
+
+// Ratio returns the compressed size of the payloads as a fraction of their raw size,
+// or 1 if there were none
+func (s *CompressionStats) Ratio() float64 {
+	raw, encoded := s.Bytes()
+	if raw == 0 {
+		return 1
+	}
+	return float64(encoded) / float64(raw)
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	textBody := strings.Repeat("hello, tunnel ", 200)
+	tests := []struct {
+		name         string
+		raw          string
+		compress     bool
+		wantEncoding string
+	}{
+		{
+			name:         "compressible",
+			raw:          "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n" + textBody,
+			compress:     true,
+			wantEncoding: EncodingGzip,
+		},
+		{
+			name: "compression disabled",
+			raw:  "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n" + textBody,
+		},
+		{
+			name:     "small",
+			raw:      "HTTP/1.1 204 No Content\r\n\r\n",
+			compress: true,
+		},
+		{
+			name:     "already encoded",
+			raw:      "HTTP/1.1 200 OK\r\nContent-Encoding: br\r\n\r\n" + textBody,
+			compress: true,
+		},
+		{
+			name:     "compressed type",
+			raw:      "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\n\r\n" + textBody,
+			compress: true,
+		},
+		{
+			name:         "identity encoding",
+			raw:          "HTTP/1.1 200 OK\r\nContent-Encoding: identity\r\n\r\n" + textBody,
+			compress:     true,
+			wantEncoding: EncodingGzip,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, encoding := EncodePayload([]byte(tt.raw), tt.compress)
+			if encoding != tt.wantEncoding {
+				t.Errorf("encoding = %q, want %q", encoding, tt.wantEncoding)
+			}
+			raw, err := DecodePayload(data, encoding)
+			if err != nil {
+				t.Fatalf("DecodePayload() error: %v", err)
+			}
+			if string(raw) != tt.raw {
+				t.Errorf("DecodePayload() = %q, want %q", raw, tt.raw)
+			}
+		})
+	}
+}
+
+func TestDecodePayloadErrors(t *testing.T) {
+	gzipped := func(n int) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		chunk := make([]byte, 1<<20)
+		for n > 0 {
+			m := n
+			if m > len(chunk) {
+				m = len(chunk)
+			}
+			_, _ = zw.Write(chunk[:m])
+			n -= m
+		}
+		_ = zw.Close()
+		return base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		encoding string
+		wantErr  bool
+		tooLarge bool
+	}{
+		{name: "largest payload", data: gzipped(MaxPayloadSize), encoding: EncodingGzip},
+		{name: "too large", data: gzipped(MaxPayloadSize + 1), encoding: EncodingGzip, wantErr: true, tooLarge: true},
+		{name: "invalid base64", data: "not base64!", wantErr: true},
+		{name: "invalid gzip", data: base64.StdEncoding.EncodeToString([]byte("plain")), encoding: EncodingGzip, wantErr: true},
+		{name: "unknown encoding", data: "", encoding: "br", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodePayload(tt.data, tt.encoding)
+			switch {
+			case !tt.wantErr && err != nil:
+				t.Errorf("DecodePayload() = %v, want nil", err)
+			case tt.wantErr && err == nil:
+				t.Errorf("DecodePayload() succeeded, want error")
+			case tt.tooLarge && !errors.Is(err, ErrPayloadTooLarge):
+				t.Errorf("DecodePayload() = %v, want %v", err, ErrPayloadTooLarge)
+			}
+		})
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	var stats CompressionStats
+	if ratio := stats.Ratio(); ratio != 1 {
+		t.Errorf("Ratio() = %v with no payloads, want 1", ratio)
+	}
+
+	raw := []byte(strings.Repeat("a", 4000))
+	data, _ := EncodePayload(raw, true)
+	stats.Add(raw, data)
+	stats.Add([]byte("abcd"), base64.StdEncoding.EncodeToString([]byte("abcd")))
+
+	gotRaw, gotEncoded := stats.Bytes()
+	decoded, _ := base64.StdEncoding.DecodeString(data)
+	if gotRaw != 4004 || gotEncoded != int64(len(decoded))+4 {
+		t.Errorf("Bytes() = %d, %d, want 4004, %d", gotRaw, gotEncoded, len(decoded)+4)
+	}
+	if ratio := stats.Ratio(); ratio >= 0.1 {
+		t.Errorf("Ratio() = %v, want well under 0.1", ratio)
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// KeepAlive pings conn every interval until done is closed. The read deadline of conn is
+// pushed back whenever a pong arrives, so a peer that stops answering for longer than
+// interval + timeout surfaces as a read error in the connection's reader.
+//
+// KeepAlive must be called before the reader starts. It does nothing if interval is zero.
+func KeepAlive(conn *websocket.Conn, interval, timeout time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	extendDeadline := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	}
+	_ = extendDeadline("")
+	conn.SetPongHandler(extendDeadline)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
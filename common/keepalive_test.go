@@ -0,0 +1,76 @@
+package common
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the peer reads, which answers pings
+		answer bool
+	}{
+		{name: "answered", answer: true},
+		{name: "unanswered"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := make(chan *websocket.Conn, 1)
+			var upgrader websocket.Upgrader
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if ws, err := upgrader.Upgrade(w, r, nil); err == nil {
+					peers <- ws
+				}
+			}))
+			defer server.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			peer := <-peers
+			defer peer.Close()
+			if tt.answer {
+				go func() {
+					for {
+						if _, _, err := peer.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+			KeepAlive(conn, 20*time.Millisecond, 100*time.Millisecond, done)
+
+			readErr := make(chan error, 1)
+			go func() {
+				_, _, err := conn.ReadMessage()
+				readErr <- err
+			}()
+
+			select {
+			case err := <-readErr:
+				if tt.answer {
+					t.Fatalf("read failed while the peer answered pings: %v", err)
+				}
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					t.Errorf("read error = %v, want a timeout", err)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if !tt.answer {
+					t.Fatal("read didn't time out while the peer ignored pings")
+				}
+			}
+		})
+	}
+}
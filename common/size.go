@@ -0,0 +1,28 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a number of bytes like 512, 64k, 10MB or 2g, with binary multiples
+func ParseSize(s string) (int64, error) {
+	lower := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	multiplier := int64(1)
+	for i, suffix := range []string{"k", "m", "g", "t"} {
+		if strings.HasSuffix(lower, suffix) {
+			multiplier, lower = int64(1)<<(10*(i+1)), strings.TrimSuffix(lower, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,49 @@
+package common
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512b", want: 512},
+		{in: "64k", want: 64 << 10},
+		{in: "64KB", want: 64 << 10},
+		{in: "10MB", want: 10 << 20},
+		{in: " 2g ", want: 2 << 30},
+		{in: "1t", want: 1 << 40},
+		{in: "8388607t", want: 8388607 << 40},
+		{in: "9223372036854775807", want: 9223372036854775807},
+		{in: "", wantErr: true},
+		{in: "k", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1.5m", wantErr: true},
+		{in: "10x", wantErr: true},
+		{in: "10 mb", wantErr: true},
+		{in: "8388608t", wantErr: true},
+		{in: "9999999999t", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseSize(%q) = %d, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSize(%q) error: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,12 @@
 package common
 
-import "encoding/base64"
-
 type MessageType int
 
 const (
 	Request MessageType = iota
 	ResponseData
 	ResponseError
+	Cancel
 	Unknown
 )
 
@@ -17,8 +16,23 @@ const (
 	Unavailable ErrorCode = iota
 	Timeout
 	InternalError
+	PayloadTooLarge
 )
 
+func (e ErrorCode) String() string {
+	switch e {
+	case Unavailable:
+		return "unavailable"
+	case Timeout:
+		return "timeout"
+	case InternalError:
+		return "internal error"
+	case PayloadTooLarge:
+		return "payload too large"
+	}
+	return "unknown"
+}
+
 type WSMessage struct {
 	Type string `json:"type"`
 }
@@ -31,6 +45,8 @@ func (w *WSMessage) MessageType() MessageType {
 		return ResponseData
 	case "response_error":
 		return ResponseError
+	case "cancel":
+		return Cancel
 	default:
 		return Unknown
 	}
@@ -38,40 +54,70 @@ func (w *WSMessage) MessageType() MessageType {
 
 type RequestMessage struct {
 	WSMessage
+	ID   uint64 `json:"id"`
 	Data string `json:"data"`
+	// Encoding of Data, see EncodePayload
+	Encoding string `json:"encoding,omitempty"`
 }
 
-func NewRequestMessage(data string) *RequestMessage {
+func NewRequestMessage(id uint64, data, encoding string) *RequestMessage {
 	return &RequestMessage{
 		WSMessage: WSMessage{"request"},
+		ID:        id,
 		Data:      data,
+		Encoding:  encoding,
 	}
 }
 
 type ResponseDataMessage struct {
 	WSMessage
+	ID       uint64 `json:"id"`
 	Response string `json:"response"`
+	// Encoding of Response, see EncodePayload
+	Encoding string `json:"encoding,omitempty"`
 }
 
-func NewResponseDataMessage(data string) *ResponseDataMessage {
+func NewResponseDataMessage(id uint64, data, encoding string) *ResponseDataMessage {
 	return &ResponseDataMessage{
 		WSMessage: WSMessage{"response_data"},
+		ID:        id,
 		Response:  data,
+		Encoding:  encoding,
 	}
 }
 
 type ResponseErrorMessage struct {
 	WSMessage
+	ID   uint64    `json:"id"`
 	Code ErrorCode `json:"code"`
 }
 
-func NewResponseErrorMessage(code ErrorCode) *ResponseErrorMessage {
+func NewResponseErrorMessage(id uint64, code ErrorCode) *ResponseErrorMessage {
 	return &ResponseErrorMessage{
 		WSMessage: WSMessage{"response_error"},
+		ID:        id,
 		Code:      code,
 	}
 }
 
+// CancelMessage tells the client that the server is no longer waiting for the response
+// to a request
+type CancelMessage struct {
+	WSMessage
+	ID uint64 `json:"id"`
+}
+
+func NewCancelMessage(id uint64) *CancelMessage {
+	return &CancelMessage{
+		WSMessage: WSMessage{"cancel"},
+		ID:        id,
+	}
+}
+
+func (rm *RequestMessage) DecodeRequest() ([]byte, error) {
+	return DecodePayload(rm.Data, rm.Encoding)
+}
+
 func (rm *ResponseDataMessage) DecodeResponse() ([]byte, error) {
-	return base64.StdEncoding.DecodeString(rm.Response)
+	return DecodePayload(rm.Response, rm.Encoding)
 }
@@ -6,5 +6,8 @@ require (
 	github.com/gdamore/tcell v1.4.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-isatty v0.0.12
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	gopkg.in/yaml.v2 v2.2.8
 )
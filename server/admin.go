@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdminToken rejects requests without the admin token as a bearer token, and all
+// requests while no admin token is configured
+func (s *LeapServer) requireAdminToken(c *gin.Context) {
+	adminToken := s.conf().AdminToken
+	if adminToken == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+type subdomainUsage struct {
+	// Name of the subdomain's tunnels, see Tunnel.Name
+	Subdomain string `json:"subdomain"`
+	Domain    string `json:"domain"`
+	// Tunnels currently open on the subdomain
+	Tunnels int `json:"tunnels"`
+	usage
+	Quota int64 `json:"quota,omitempty"`
+}
+
+type keyUsage struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain"`
+	usage
+	Quota int64 `json:"quota,omitempty"`
+}
+
+type usageResponse struct {
+	Period      QuotaPeriod      `json:"period"`
+	PeriodStart time.Time        `json:"period_start"`
+	PeriodEnd   time.Time        `json:"period_end"`
+	Subdomains  []subdomainUsage `json:"subdomains"`
+	Keys        []keyUsage       `json:"keys"`
+}
+
+// getUsage reports the traffic of every subdomain and API key in the current period
+func (s *LeapServer) getUsage(c *gin.Context) {
+	start, end, tunnels, keys := s.usage.snapshot()
+	live := s.conf()
+
+	open := make(map[string]int)
+	for _, tun := range s.registry.List() {
+		open[tun.name]++
+	}
+	for subdomain := range open {
+		if _, ok := tunnels[subdomain]; !ok {
+			tunnels[subdomain] = usage{}
+		}
+	}
+
+	resp := usageResponse{
+		Period:      s.usage.period,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Subdomains:  make([]subdomainUsage, 0, len(tunnels)),
+		Keys:        make([]keyUsage, 0, len(live.APIKeys)),
+	}
+	for name, u := range tunnels {
+		su := subdomainUsage{
+			Subdomain: name,
+			Tunnels:   open[name],
+			usage:     u,
+		}
+		// usage of domains that have since been removed is reported without one
+		if d, ok := live.domainOfName(name); ok {
+			su.Domain, su.Quota = d.name, d.quota
+		}
+		resp.Subdomains = append(resp.Subdomains, su)
+	}
+	for _, key := range live.APIKeys {
+		domain := key.Domain
+		if domain == "" {
+			domain = live.Domain
+		}
+		resp.Keys = append(resp.Keys, keyUsage{
+			Name:   key.Name,
+			Domain: domain,
+			usage:  keys[key.Name],
+			Quota:  key.Quota,
+		})
+	}
+
+	sort.Slice(resp.Subdomains, func(i, j int) bool {
+		return resp.Subdomains[i].Subdomain < resp.Subdomains[j].Subdomain
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
+// setUsageHeaders reports the usage of the tunnels registered under name and of an API
+// key in the headers of a response, and returns the key's usage
+func (s *LeapServer) setUsageHeaders(c *gin.Context, name string, key *APIKey, quota int64) usage {
+	var keyName string
+	if key != nil {
+		keyName = key.Name
+	}
+	tunnelUsage, keyUsage, end := s.usage.used(name, keyName)
+
+	c.Header("X-Leap-Quota-Reset", end.Format(http.TimeFormat))
+	if name != "" {
+		c.Header("X-Leap-Tunnel-Usage", strconv.FormatInt(tunnelUsage.total(), 10))
+		if quota > 0 {
+			c.Header("X-Leap-Tunnel-Quota", strconv.FormatInt(quota, 10))
+		}
+	}
+	if key != nil {
+		c.Header("X-Leap-Key-Usage", strconv.FormatInt(keyUsage.total(), 10))
+		if key.Quota > 0 {
+			c.Header("X-Leap-Key-Quota", strconv.FormatInt(key.Quota, 10))
+		}
+	}
+	return keyUsage
+}
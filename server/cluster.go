@@ -0,0 +1,638 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long a node's claim on a subdomain lasts unless it is refreshed
+	clusterClaimTTL = time.Second * 30
+	// How often a node refreshes the claims on its subdomains
+	clusterRefreshInterval = time.Second * 10
+
+	// Carries the shared cluster secret on node-to-node requests
+	clusterSecretHeader = "X-Leap-Cluster-Secret"
+	// Marks a public request forwarded by another node
+	clusterForwardedHeader = "X-Leap-Forwarded-By"
+)
+
+var ErrSubdomainClaimed = errors.New("subdomain is claimed by another node")
+var ErrHostnameBound = errors.New("hostname is bound to another subdomain")
+
+// Node is a leap server in a cluster
+type Node struct {
+	ID string `json:"id"`
+	// Internal address other nodes forward public requests to
+	Address string `json:"address"`
+}
+
+// ClusterRegistry records which node holds the tunnels of each subdomain
+type ClusterRegistry interface {
+	// Claim records that node holds subdomain until ttl passes. Claiming a subdomain the
+	// node already holds refreshes the claim. It returns ErrSubdomainClaimed if another
+	// node holds the subdomain.
+	//
+	// A node claims a subdomain again with a higher generation each time it starts serving
+	// it anew, which keeps a late release of the previous claim from removing the new one.
+	Claim(subdomain string, node Node, generation uint64, ttl time.Duration) error
+	// Release removes the node's claim on subdomain, if it holds one whose generation is
+	// not newer than generation
+	Release(subdomain, nodeID string, generation uint64) error
+	// Lookup returns the node holding subdomain
+	Lookup(subdomain string) (Node, bool, error)
+
+	// BindHostname records that a custom hostname leads to subdomain, which the node must
+	// hold with the claim of the given generation. It returns ErrHostnameBound if the
+	// hostname leads to another subdomain that is still claimed. Bindings are dropped
+	// along with the claim.
+	BindHostname(hostname, subdomain, nodeID string, generation uint64) error
+	// UnbindHostname removes the binding of hostname to subdomain, if there is one
+	UnbindHostname(hostname, subdomain string) error
+	// LookupHostname returns the subdomain a custom hostname leads to and the node
+	// holding it
+	LookupHostname(hostname string) (string, Node, bool, error)
+}
+
+type clusterClaim struct {
+	node       Node
+	generation uint64
+	expires    time.Time
+}
+
+type memoryClusterRegistry struct {
+	mu        sync.Mutex
+	claims    map[string]clusterClaim
+	hostnames map[string]string // custom hostname -> subdomain
+}
+
+// NewMemoryClusterRegistry returns a registry kept in process memory. Other nodes can
+// share it through the registry endpoints of the node's cluster listener.
+func NewMemoryClusterRegistry() ClusterRegistry {
+	return &memoryClusterRegistry{
+		claims:    make(map[string]clusterClaim),
+		hostnames: make(map[string]string),
+	}
+}
+
+func (m *memoryClusterRegistry) Claim(subdomain string, node Node, generation uint64, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	claim, ok := m.claims[subdomain]
+	if ok && claim.node.ID != node.ID && now.Before(claim.expires) {
+		return ErrSubdomainClaimed
+	}
+	if ok && claim.node.ID == node.ID && claim.generation >= generation {
+		// a refresh, possibly a late one of an earlier claim
+		generation = claim.generation
+	} else {
+		m.unbindHostnames(subdomain)
+	}
+	m.claims[subdomain] = clusterClaim{node: node, generation: generation, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *memoryClusterRegistry) Release(subdomain, nodeID string, generation uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if claim, ok := m.claims[subdomain]; ok && claim.node.ID == nodeID && claim.generation <= generation {
+		delete(m.claims, subdomain)
+		m.unbindHostnames(subdomain)
+	}
+	return nil
+}
+
+func (m *memoryClusterRegistry) Lookup(subdomain string) (Node, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	claim, ok := m.lookup(subdomain)
+	return claim.node, ok, nil
+}
+
+// lookup returns the unexpired claim on subdomain. m.mu must be held.
+func (m *memoryClusterRegistry) lookup(subdomain string) (clusterClaim, bool) {
+	claim, ok := m.claims[subdomain]
+	if !ok || time.Now().After(claim.expires) {
+		return clusterClaim{}, false
+	}
+	return claim, true
+}
+
+// unbindHostnames removes the hostnames bound to subdomain. m.mu must be held.
+func (m *memoryClusterRegistry) unbindHostnames(subdomain string) {
+	for hostname, bound := range m.hostnames {
+		if bound == subdomain {
+			delete(m.hostnames, hostname)
+		}
+	}
+}
+
+func (m *memoryClusterRegistry) BindHostname(hostname, subdomain, nodeID string, generation uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if claim, ok := m.lookup(subdomain); !ok || claim.node.ID != nodeID || claim.generation != generation {
+		return ErrSubdomainClaimed
+	}
+	if bound, ok := m.hostnames[hostname]; ok && bound != subdomain {
+		if _, claimed := m.lookup(bound); claimed {
+			return ErrHostnameBound
+		}
+	}
+	m.hostnames[hostname] = subdomain
+	return nil
+}
+
+func (m *memoryClusterRegistry) UnbindHostname(hostname, subdomain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.hostnames[hostname] == subdomain {
+		delete(m.hostnames, hostname)
+	}
+	return nil
+}
+
+func (m *memoryClusterRegistry) LookupHostname(hostname string) (string, Node, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subdomain, ok := m.hostnames[hostname]
+	if !ok {
+		return "", Node{}, false, nil
+	}
+	claim, ok := m.lookup(subdomain)
+	if !ok {
+		return "", Node{}, false, nil
+	}
+	return subdomain, claim.node, true, nil
+}
+
+type clusterClaimRequest struct {
+	Subdomain  string `json:"subdomain"`
+	Node       Node   `json:"node"`
+	Generation uint64 `json:"generation"`
+	TTL        int64  `json:"ttl_ms"`
+}
+
+type clusterHostnameRequest struct {
+	Hostname   string `json:"hostname"`
+	Subdomain  string `json:"subdomain"`
+	Node       Node   `json:"node"`
+	Generation uint64 `json:"generation"`
+}
+
+type clusterHostnameResponse struct {
+	Subdomain string `json:"subdomain"`
+	Node      Node   `json:"node"`
+}
+
+type remoteClusterRegistry struct {
+	baseURL string
+	secret  string
+	client  *http.Client
+}
+
+// NewRemoteClusterRegistry returns a registry served by the cluster listener of another
+// node at baseURL
+func NewRemoteClusterRegistry(baseURL, secret string) ClusterRegistry {
+	return &remoteClusterRegistry{
+		baseURL: baseURL,
+		secret:  secret,
+		client:  &http.Client{Timeout: time.Second * 5},
+	}
+}
+
+func (r *remoteClusterRegistry) do(method, path string, payload interface{}) (*http.Response, error) {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, r.baseURL+path, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(clusterSecretHeader, r.secret)
+	req.Header.Set("Content-Type", "application/json")
+	return r.client.Do(req)
+}
+
+func (r *remoteClusterRegistry) Claim(subdomain string, node Node, generation uint64, ttl time.Duration) error {
+	resp, err := r.do(http.MethodPost, "/cluster/registry/claim", clusterClaimRequest{
+		Subdomain:  subdomain,
+		Node:       node,
+		Generation: generation,
+		TTL:        ttl.Milliseconds(),
+	})
+	if err != nil {
+		return fmt.Errorf("claim: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return ErrSubdomainClaimed
+	default:
+		return fmt.Errorf("claim: unexpected status %d", resp.StatusCode)
+	}
+}
+
+func (r *remoteClusterRegistry) Release(subdomain, nodeID string, generation uint64) error {
+	resp, err := r.do(http.MethodPost, "/cluster/registry/release", clusterClaimRequest{
+		Subdomain:  subdomain,
+		Node:       Node{ID: nodeID},
+		Generation: generation,
+	})
+	if err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("release: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *remoteClusterRegistry) Lookup(subdomain string) (Node, bool, error) {
+	resp, err := r.do(http.MethodGet, "/cluster/registry/lookup?subdomain="+url.QueryEscape(subdomain), nil)
+	if err != nil {
+		return Node{}, false, fmt.Errorf("lookup: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return Node{}, false, fmt.Errorf("lookup: %w", err)
+		}
+		var node Node
+		if err := json.Unmarshal(b, &node); err != nil {
+			return Node{}, false, fmt.Errorf("lookup: %w", err)
+		}
+		return node, true, nil
+	case http.StatusNotFound:
+		return Node{}, false, nil
+	default:
+		return Node{}, false, fmt.Errorf("lookup: unexpected status %d", resp.StatusCode)
+	}
+}
+
+func (r *remoteClusterRegistry) BindHostname(hostname, subdomain, nodeID string, generation uint64) error {
+	resp, err := r.do(http.MethodPost, "/cluster/registry/hostname/bind", clusterHostnameRequest{
+		Hostname:   hostname,
+		Subdomain:  subdomain,
+		Node:       Node{ID: nodeID},
+		Generation: generation,
+	})
+	if err != nil {
+		return fmt.Errorf("bind hostname: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return ErrHostnameBound
+	case http.StatusPreconditionFailed:
+		return ErrSubdomainClaimed
+	default:
+		return fmt.Errorf("bind hostname: unexpected status %d", resp.StatusCode)
+	}
+}
+
+func (r *remoteClusterRegistry) UnbindHostname(hostname, subdomain string) error {
+	resp, err := r.do(http.MethodPost, "/cluster/registry/hostname/unbind", clusterHostnameRequest{
+		Hostname:  hostname,
+		Subdomain: subdomain,
+	})
+	if err != nil {
+		return fmt.Errorf("unbind hostname: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unbind hostname: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *remoteClusterRegistry) LookupHostname(hostname string) (string, Node, bool, error) {
+	resp, err := r.do(http.MethodGet, "/cluster/registry/hostname/lookup?hostname="+url.QueryEscape(hostname), nil)
+	if err != nil {
+		return "", Node{}, false, fmt.Errorf("lookup hostname: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", Node{}, false, fmt.Errorf("lookup hostname: %w", err)
+		}
+		var payload clusterHostnameResponse
+		if err := json.Unmarshal(b, &payload); err != nil {
+			return "", Node{}, false, fmt.Errorf("lookup hostname: %w", err)
+		}
+		return payload.Subdomain, payload.Node, true, nil
+	case http.StatusNotFound:
+		return "", Node{}, false, nil
+	default:
+		return "", Node{}, false, fmt.Errorf("lookup hostname: unexpected status %d", resp.StatusCode)
+	}
+}
+
+// cluster is the state of a node that is part of a leap cluster
+type cluster struct {
+	node     Node
+	secret   string
+	registry ClusterRegistry
+	// generation of the latest claim, accessed atomically. See ClusterRegistry.Claim.
+	generation uint64
+}
+
+func newCluster(config *Config) *cluster {
+	if config.ClusterBind == "" {
+		return nil
+	}
+
+	nodeID := config.NodeID
+	if nodeID == "" {
+		nodeID = generateToken(8)
+	}
+
+	advertise := config.ClusterAdvertise
+	if advertise == "" {
+		advertise = config.ClusterBind
+	}
+
+	var registry ClusterRegistry
+	if config.ClusterRegistry != "" {
+		registry = NewRemoteClusterRegistry(config.ClusterRegistry, config.ClusterSecret)
+	} else {
+		registry = NewMemoryClusterRegistry()
+	}
+
+	return &cluster{
+		node:     Node{ID: nodeID, Address: advertise},
+		secret:   config.ClusterSecret,
+		registry: registry,
+		// a restarted node keeps claiming with higher generations
+		generation: uint64(time.Now().UnixNano()),
+	}
+}
+
+// nextGeneration returns the generation of a new claim
+func (cl *cluster) nextGeneration() uint64 {
+	return atomic.AddUint64(&cl.generation, 1)
+}
+
+// claimSubdomain records in the cluster registry that this node holds subdomain
+func (s *LeapServer) claimSubdomain(subdomain string, generation uint64) error {
+	if s.cluster == nil {
+		return nil
+	}
+	return s.cluster.registry.Claim(subdomain, s.cluster.node, generation, clusterClaimTTL)
+}
+
+// releaseSubdomain gives up the claim of the given generation on subdomain. If a tunnel
+// on it has been opened again since, it was claimed with a newer generation that the
+// registry keeps.
+func (s *LeapServer) releaseSubdomain(subdomain string, generation uint64) {
+	if s.cluster == nil {
+		return
+	}
+
+	if err := s.cluster.registry.Release(subdomain, s.cluster.node.ID, generation); err != nil {
+		log.Printf("Failed to release %q in the cluster registry: %v\n", subdomain, err)
+	}
+}
+
+func (s *LeapServer) maintainClaims(ctx context.Context) {
+	ticker := time.NewTicker(clusterRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.refreshClaims()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshClaims keeps the claims on the subdomains served by this node from expiring
+func (s *LeapServer) refreshClaims() {
+	subdomains := make(map[string]uint64)
+	for _, tun := range s.registry.List() {
+		subdomains[tun.name] = tun.group.generation
+	}
+
+	for sub, generation := range subdomains {
+		if err := s.claimSubdomain(sub, generation); err != nil {
+			log.Printf("Failed to refresh the claim on %q: %v\n", sub, err)
+		}
+	}
+}
+
+// forwardToNode proxies a public request for a subdomain held by another node to that node
+func (s *LeapServer) forwardToNode(c *gin.Context, node Node) {
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = node.Address
+			r.Header.Set(clusterSecretHeader, s.cluster.secret)
+			r.Header.Set(clusterForwardedHeader, s.cluster.node.ID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to forward request to node %q: %v\n", node.ID, err)
+			s.showPage(c, PageError, http.StatusBadGateway, "")
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// lookupHostnameNode returns the other node holding the tunnels a custom hostname is
+// bound to, if any
+func (s *LeapServer) lookupHostnameNode(host string) (Node, bool) {
+	if s.cluster == nil {
+		return Node{}, false
+	}
+
+	hostname := strings.ToLower(stripPort(host))
+	_, node, ok, err := s.cluster.registry.LookupHostname(hostname)
+	if err != nil {
+		log.Printf("Cluster registry lookup for %q failed: %v\n", hostname, err)
+		return Node{}, false
+	}
+	return node, ok && node.ID != s.cluster.node.ID
+}
+
+// lookupNode returns the other node holding subdomain, if any
+func (s *LeapServer) lookupNode(subdomain string) (Node, bool) {
+	if s.cluster == nil {
+		return Node{}, false
+	}
+
+	node, ok, err := s.cluster.registry.Lookup(subdomain)
+	if err != nil {
+		log.Printf("Cluster registry lookup for %q failed: %v\n", subdomain, err)
+		return Node{}, false
+	}
+	return node, ok && node.ID != s.cluster.node.ID
+}
+
+func (s *LeapServer) requireClusterSecret(c *gin.Context) {
+	secret := c.GetHeader(clusterSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.cluster.secret)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	// requests forwarded by other nodes never reach the registry endpoints
+	if c.GetHeader(clusterForwardedHeader) != "" {
+		c.Abort()
+		c.Request.Header.Del(clusterSecretHeader)
+		c.Request.Header.Del(clusterForwardedHeader)
+		s.serveTunnelRequest(c, false)
+	}
+}
+
+func (s *LeapServer) clusterClaim(c *gin.Context) {
+	var req clusterClaimRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	err := s.cluster.registry.Claim(req.Subdomain, req.Node, req.Generation, time.Duration(req.TTL)*time.Millisecond)
+	if errors.Is(err, ErrSubdomainClaimed) {
+		c.Status(http.StatusConflict)
+	} else if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (s *LeapServer) clusterRelease(c *gin.Context) {
+	var req clusterClaimRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	if err := s.cluster.registry.Release(req.Subdomain, req.Node.ID, req.Generation); err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *LeapServer) clusterBindHostname(c *gin.Context) {
+	var req clusterHostnameRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	err := s.cluster.registry.BindHostname(req.Hostname, req.Subdomain, req.Node.ID, req.Generation)
+	if errors.Is(err, ErrHostnameBound) {
+		c.Status(http.StatusConflict)
+	} else if errors.Is(err, ErrSubdomainClaimed) {
+		c.Status(http.StatusPreconditionFailed)
+	} else if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (s *LeapServer) clusterUnbindHostname(c *gin.Context) {
+	var req clusterHostnameRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	if err := s.cluster.registry.UnbindHostname(req.Hostname, req.Subdomain); err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *LeapServer) clusterLookupHostname(c *gin.Context) {
+	subdomain, node, ok, err := s.cluster.registry.LookupHostname(c.Query("hostname"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	} else if !ok {
+		c.Status(http.StatusNotFound)
+	} else {
+		c.JSON(http.StatusOK, clusterHostnameResponse{Subdomain: subdomain, Node: node})
+	}
+}
+
+func (s *LeapServer) clusterLookup(c *gin.Context) {
+	node, ok, err := s.cluster.registry.Lookup(c.Query("subdomain"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	} else if !ok {
+		c.Status(http.StatusNotFound)
+	} else {
+		c.JSON(http.StatusOK, node)
+	}
+}
+
+// makeClusterServer starts the internal listener that serves requests forwarded by
+// other nodes and, when this node keeps the registry in memory, the registry endpoints
+func (s *LeapServer) makeClusterServer() (*http.Server, error) {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(s.requireClusterSecret)
+
+	if _, ok := s.cluster.registry.(*memoryClusterRegistry); ok {
+		r.POST("/cluster/registry/claim", s.clusterClaim)
+		r.POST("/cluster/registry/release", s.clusterRelease)
+		r.GET("/cluster/registry/lookup", s.clusterLookup)
+		r.POST("/cluster/registry/hostname/bind", s.clusterBindHostname)
+		r.POST("/cluster/registry/hostname/unbind", s.clusterUnbindHostname)
+		r.GET("/cluster/registry/hostname/lookup", s.clusterLookupHostname)
+	}
+
+	l, err := s.listen("cluster", s.conf().ClusterBind)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: r}
+	go func() {
+		log.Printf("Starting cluster listener for node %q\n", s.cluster.node.ID)
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Fatalf("listen cluster: %v", err)
+		}
+	}()
+
+	return server, nil
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClusterRegistryGenerations(t *testing.T) {
+	a := Node{ID: "a", Address: "10.0.0.1:7000"}
+	b := Node{ID: "b", Address: "10.0.0.2:7000"}
+
+	type step struct {
+		claim   *Node // claims with the generation if set, releases otherwise
+		release string
+		gen     uint64
+		err     error
+	}
+	tests := []struct {
+		name   string
+		steps  []step
+		holder string // empty if the subdomain should be free
+	}{
+		{
+			name:   "claim",
+			steps:  []step{{claim: &a, gen: 1}},
+			holder: "a",
+		},
+		{
+			name:  "release",
+			steps: []step{{claim: &a, gen: 1}, {release: "a", gen: 1}},
+		},
+		{
+			name:   "release by another node",
+			steps:  []step{{claim: &a, gen: 1}, {release: "b", gen: 1}},
+			holder: "a",
+		},
+		{
+			name:   "claimed by another node",
+			steps:  []step{{claim: &a, gen: 1}, {claim: &b, gen: 2, err: ErrSubdomainClaimed}},
+			holder: "a",
+		},
+		{
+			name:   "stale release after a new claim",
+			steps:  []step{{claim: &a, gen: 1}, {claim: &a, gen: 2}, {release: "a", gen: 1}},
+			holder: "a",
+		},
+		{
+			name:   "late refresh of an earlier claim",
+			steps:  []step{{claim: &a, gen: 2}, {claim: &a, gen: 1}, {release: "a", gen: 1}},
+			holder: "a",
+		},
+		{
+			name:  "release of a claim that never arrived",
+			steps: []step{{claim: &a, gen: 1}, {release: "a", gen: 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, kind := range []string{"memory", "remote"} {
+			t.Run(tt.name+" "+kind, func(t *testing.T) {
+				r := NewMemoryClusterRegistry()
+				if kind == "remote" {
+					node := startClusterNode(t, "registry", "")
+					defer node.Close()
+					r = NewRemoteClusterRegistry("http://"+node.cluster.node.Address, "secret")
+				}
+				for i, st := range tt.steps {
+					var err error
+					if st.claim != nil {
+						err = r.Claim("foo", *st.claim, st.gen, time.Minute)
+					} else {
+						err = r.Release("foo", st.release, st.gen)
+					}
+					if err != st.err {
+						t.Fatalf("step %d: error = %v, want %v", i, err, st.err)
+					}
+				}
+
+				node, ok, err := r.Lookup("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != (tt.holder != "") || node.ID != tt.holder {
+					t.Errorf("Lookup() = %q, %t, want %q", node.ID, ok, tt.holder)
+				}
+			})
+		}
+	}
+}
+
+// blockingRegistry holds up every release until it is let through
+type blockingRegistry struct {
+	ClusterRegistry
+	releasing chan struct{}
+	proceed   chan struct{}
+	released  chan struct{}
+}
+
+func (r *blockingRegistry) Release(subdomain, nodeID string, generation uint64) error {
+	r.releasing <- struct{}{}
+	<-r.proceed
+	defer func() { r.released <- struct{}{} }()
+	return r.ClusterRegistry.Release(subdomain, nodeID, generation)
+}
+
+func TestReleaseSubdomainRacingClaim(t *testing.T) {
+	s := New(&Config{ClusterBind: "127.0.0.1:0", NodeID: "a"})
+	registry := &blockingRegistry{
+		ClusterRegistry: NewMemoryClusterRegistry(),
+		releasing:       make(chan struct{}),
+		proceed:         make(chan struct{}),
+		released:        make(chan struct{}),
+	}
+	s.cluster.registry = registry
+	domain := &baseDomain{name: "leap.example.com", primary: true}
+	sr := &common.SubdomainRequest{Subdomain: "foo"}
+
+	open := func() *Tunnel {
+		tun, _, message := s.issueTunnel(sr, domain, nil)
+		if tun == nil {
+			t.Fatalf("issueTunnel() failed: %s", message)
+		}
+		if err := s.claimSubdomain(tun.name, tun.group.generation); err != nil {
+			t.Fatalf("claimSubdomain() error: %v", err)
+		}
+		return tun
+	}
+	holder := func() string {
+		node, _, err := registry.Lookup("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node.ID
+	}
+
+	first := open()
+	s.removeTunnel(first)
+	<-registry.releasing
+
+	// the release is in flight without holding s.mu, so the subdomain can be opened again
+	second := open()
+	registry.proceed <- struct{}{}
+	<-registry.released
+	if id := holder(); id != "a" {
+		t.Fatalf("after the stale release, foo is held by %q, want a", id)
+	}
+
+	s.removeTunnel(second)
+	<-registry.releasing
+	registry.proceed <- struct{}{}
+	<-registry.released
+	if id := holder(); id != "" {
+		t.Errorf("after closing every tunnel, foo is held by %q", id)
+	}
+}
+
+func TestClusterRegistryHostnames(t *testing.T) {
+	a := Node{ID: "a"}
+	b := Node{ID: "b"}
+
+	tests := []struct {
+		name string
+		// run against a registry where a holds foo and b holds bar, both with generation 1
+		run       func(r ClusterRegistry) error
+		err       error
+		subdomain string // empty if app.customer.com should not be bound
+	}{
+		{
+			name:      "bind",
+			run:       func(r ClusterRegistry) error { return r.BindHostname("app.customer.com", "foo", "a", 1) },
+			subdomain: "foo",
+		},
+		{
+			name: "bind to a subdomain of another node",
+			run:  func(r ClusterRegistry) error { return r.BindHostname("app.customer.com", "bar", "a", 1) },
+			err:  ErrSubdomainClaimed,
+		},
+		{
+			name: "bind with a stale generation",
+			run:  func(r ClusterRegistry) error { return r.BindHostname("app.customer.com", "foo", "a", 0) },
+			err:  ErrSubdomainClaimed,
+		},
+		{
+			name: "bound to another subdomain",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "bar", "b", 1)
+				return r.BindHostname("app.customer.com", "foo", "a", 1)
+			},
+			err:       ErrHostnameBound,
+			subdomain: "bar",
+		},
+		{
+			name: "bound to a released subdomain",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "bar", "b", 1)
+				_ = r.Release("bar", "b", 1)
+				return r.BindHostname("app.customer.com", "foo", "a", 1)
+			},
+			subdomain: "foo",
+		},
+		{
+			name: "unbind",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "foo", "a", 1)
+				return r.UnbindHostname("app.customer.com", "foo")
+			},
+		},
+		{
+			name: "unbind from another subdomain",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "foo", "a", 1)
+				return r.UnbindHostname("app.customer.com", "bar")
+			},
+			subdomain: "foo",
+		},
+		{
+			name: "dropped on release",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "foo", "a", 1)
+				return r.Release("foo", "a", 1)
+			},
+		},
+		{
+			name: "dropped on a new claim",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "foo", "a", 1)
+				return r.Claim("foo", a, 2, time.Minute)
+			},
+		},
+		{
+			name: "kept on refresh",
+			run: func(r ClusterRegistry) error {
+				_ = r.BindHostname("app.customer.com", "foo", "a", 1)
+				return r.Claim("foo", a, 1, time.Minute)
+			},
+			subdomain: "foo",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, kind := range []string{"memory", "remote"} {
+			t.Run(tt.name+" "+kind, func(t *testing.T) {
+				r := NewMemoryClusterRegistry()
+				if kind == "remote" {
+					node := startClusterNode(t, "registry", "")
+					defer node.Close()
+					r = NewRemoteClusterRegistry("http://"+node.cluster.node.Address, "secret")
+				}
+				_ = r.Claim("foo", a, 1, time.Minute)
+				_ = r.Claim("bar", b, 1, time.Minute)
+
+				if err := tt.run(r); err != tt.err {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				sub, _, ok, err := r.LookupHostname("app.customer.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != (tt.subdomain != "") || sub != tt.subdomain {
+					t.Errorf("LookupHostname() = %q, %t, want %q", sub, ok, tt.subdomain)
+				}
+			})
+		}
+	}
+}
+
+// startClusterNode starts a node of a cluster whose registry is served by the node at
+// registryURL, or by the node itself if it is empty
+func startClusterNode(t *testing.T, id, registryURL string) *testServer {
+	s := startTestServer(t, &Config{ClusterBind: "127.0.0.1:0", ClusterSecret: "secret", ClusterRegistry: registryURL, NodeID: id})
+	// advertise the port picked for the cluster listener
+	s.cluster.node.Address = s.listeners["cluster"].Addr().String()
+	return s
+}
+
+// newClusterNode returns a node of a cluster sharing registry, ready to serve requests
+func newClusterNode(t *testing.T, id string, registry ClusterRegistry) *LeapServer {
+	s := New(&Config{Domain: "leap.example.com", ClusterBind: "127.0.0.1:0", ClusterSecret: "secret", NodeID: id})
+	live, err := newLiveConfig(s.conf().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.Store(live)
+	s.cluster.registry = registry
+	return s
+}
+
+func TestServeTunnelRequestForwarding(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var forwardedBy, secret string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy, secret = r.Header.Get(clusterForwardedHeader), r.Header.Get(clusterSecretHeader)
+		_, _ = io.WriteString(w, "served by b at "+r.Host)
+	}))
+	defer other.Close()
+
+	registry := NewMemoryClusterRegistry()
+	b := Node{ID: "b", Address: strings.TrimPrefix(other.URL, "http://")}
+	_ = registry.Claim("foo", b, 1, time.Minute)
+	_ = registry.BindHostname("app.customer.com", "foo", "b", 1)
+	s := newClusterNode(t, "a", registry)
+
+	tests := []struct {
+		host         string
+		allowForward bool
+		status       int
+		body         string
+	}{
+		{host: "foo.leap.example.com", allowForward: true, status: http.StatusOK, body: "served by b at foo.leap.example.com"},
+		{host: "app.customer.com", allowForward: true, status: http.StatusOK, body: "served by b at app.customer.com"},
+		{host: "APP.customer.com:443", allowForward: true, status: http.StatusOK, body: "served by b at APP.customer.com:443"},
+		{host: "foo.leap.example.com", status: http.StatusNotFound},
+		{host: "app.customer.com", status: http.StatusNotFound},
+		{host: "bar.leap.example.com", allowForward: true, status: http.StatusNotFound},
+		{host: "www.customer.com", allowForward: true, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s forward=%t", tt.host, tt.allowForward), func(t *testing.T) {
+			forwardedBy, secret = "", ""
+			r := gin.New()
+			r.Use(func(c *gin.Context) { s.serveTunnelRequest(c, tt.allowForward) })
+			node := httptest.NewServer(r)
+			defer node.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, node.URL, nil)
+			req.Host = tt.host
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if forwardedBy != "a" || secret != "secret" {
+				t.Errorf("forwarded by %q with secret %q, want a with the cluster secret", forwardedBy, secret)
+			}
+		})
+	}
+}
+
+func TestCluster(t *testing.T) {
+	a := startClusterNode(t, "a", "")
+	defer a.Close()
+	b := startClusterNode(t, "b", "http://"+a.cluster.node.Address)
+	defer b.Close()
+
+	ws := b.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+	go answer(ws, "served by b")
+
+	// a forwards requests for the subdomain held by b
+	resp := a.request(t, http.MethodGet, "foo.leap.example.com", "/", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "served by b" {
+		t.Errorf("response through a = %d %q, want 200 \"served by b\"", resp.StatusCode, body)
+	}
+	for _, sr := range []common.SubdomainRequest{
+		{Subdomain: "foo"},
+		{Subdomain: "foo", Group: true, GroupKey: "key"},
+	} {
+		if status, _ := a.requestTunnel(t, sr); status != http.StatusConflict {
+			t.Errorf("tunnel request %+v on a: status = %d, want %d", sr, status, http.StatusConflict)
+		}
+	}
+
+	// the subdomain is released once b's tunnel closes
+	_ = ws.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := a.lookupNode("foo"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b didn't release foo")
+		}
+	}
+	resp = a.request(t, http.MethodGet, "foo.leap.example.com", "/", nil)
+	if readBody(t, resp); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status through a = %d, want %d once released", resp.StatusCode, http.StatusNotFound)
+	}
+	if status, _ := a.requestTunnel(t, common.SubdomainRequest{Subdomain: "foo"}); status != http.StatusOK {
+		t.Errorf("tunnel request on a: status = %d, want %d once released", status, http.StatusOK)
+	}
+}
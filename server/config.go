@@ -1,7 +1,92 @@
 package server
 
+import "time"
+
 type Config struct {
 	Domain string
 	Bind   string
 	Debug  bool
+
+	// Base domains served in addition to Domain, each with its own policies
+	Domains []DomainConfig
+
+	// How long an issued token remains valid before the client connects
+	ConnectTimeout time.Duration
+	// How long a connected tunnel may go without traffic before it is closed, or zero to disable
+	IdleTimeout time.Duration
+
+	// How long to wait for the client to answer a public request, or zero to wait indefinitely
+	RequestTimeout time.Duration
+
+	// How often connected clients are pinged, or zero to disable keepalive
+	PingInterval time.Duration
+	// How long a client may take to answer a ping before the tunnel is torn down
+	PingTimeout time.Duration
+
+	// Send requests to clients uncompressed, and don't offer compression to them
+	DisableCompression bool
+
+	// How long requests in flight may take to finish when the server shuts down
+	DrainTimeout time.Duration
+	// Hand the listeners over to a new process started from the same executable on
+	// SIGUSR2, then drain, for upgrades without downtime
+	HotRestart bool
+
+	// DNS server used to verify custom hostnames, or empty for the system resolver
+	Resolver string
+
+	// Address of the TLS listener, or empty to serve plain HTTP only
+	TLSBind string
+	// Certificate for the base domain and its subdomains, usually a wildcard
+	TLSCertFile string
+	TLSKeyFile  string
+	// Where certificates issued on demand for custom hostnames are stored
+	CertCacheDir  string
+	ACMEEmail     string
+	ACMEDirectory string
+
+	// Address of the internal listener for other nodes of a cluster, or empty to run standalone
+	ClusterBind string
+	// Address other nodes use to reach the internal listener, if different from ClusterBind
+	ClusterAdvertise string
+	// Shared secret authenticating requests between nodes
+	ClusterSecret string
+	// URL of the node serving the cluster registry, or empty to serve it from this node
+	ClusterRegistry string
+	NodeID          string
+
+	// Keys clients must present to open tunnels, or empty to let anyone open tunnels
+	APIKeys []APIKey
+	// How often usage and quotas reset, QuotaMonthly if empty
+	QuotaPeriod QuotaPeriod
+	// Bytes each subdomain may transfer per quota period, or zero for no quota
+	TunnelQuota int64
+	// Bytes per second the traffic of each tunnel is throttled to, or zero for no limit
+	TunnelBandwidth int64
+	// Bearer token required by the admin API, or empty to disable it
+	AdminToken string
+
+	// Subdomains clients may not open tunnels on
+	Reserved []string
+	// File the log is appended to instead of stderr, reopened on reload so it can be rotated
+	LogFile string
+
+	// Directory of templates replacing the default landing and error pages, named after
+	// the pages (see Page), e.g. tunnel_offline.html
+	PagesDir string
+
+	// Where tunnels are stored, or nil for NewMemoryTunnelRegistry
+	Registry TunnelRegistry
+
+	// Receivers of tunnel and request events
+	Hooks []Hook
+	// URL events are posted to as JSON, or empty to disable the webhook
+	WebhookURL string
+	// Key signing webhook payloads, or empty to send them unsigned
+	WebhookSecret string
+
+	// YAML file the configuration was loaded from with LoadConfigFile, reread on SIGHUP
+	ConfigFile string
+	// the configuration ConfigFile was applied to
+	base *Config
 }
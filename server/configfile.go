@@ -0,0 +1,350 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// configFile is the YAML layout of a server configuration file. Settings left out keep
+// the values given on the command line.
+type configFile struct {
+	Domain    *string `yaml:"domain"`
+	Listeners struct {
+		Bind    *string `yaml:"bind"`
+		TLS     *string `yaml:"tls"`
+		Cluster *string `yaml:"cluster"`
+	} `yaml:"listeners"`
+	TLS struct {
+		Cert          *string `yaml:"cert"`
+		Key           *string `yaml:"key"`
+		CertCache     *string `yaml:"cert_cache"`
+		ACMEEmail     *string `yaml:"acme_email"`
+		ACMEDirectory *string `yaml:"acme_directory"`
+	} `yaml:"tls"`
+	Auth struct {
+		APIKeys    *[]configFileKey `yaml:"api_keys"`
+		AdminToken *string          `yaml:"admin_token"`
+	} `yaml:"auth"`
+	Limits struct {
+		ConnectTimeout  *time.Duration `yaml:"connect_timeout"`
+		IdleTimeout     *time.Duration `yaml:"idle_timeout"`
+		RequestTimeout  *time.Duration `yaml:"request_timeout"`
+		PingInterval    *time.Duration `yaml:"ping_interval"`
+		PingTimeout     *time.Duration `yaml:"ping_timeout"`
+		DrainTimeout    *time.Duration `yaml:"drain_timeout"`
+		QuotaPeriod     *QuotaPeriod   `yaml:"quota_period"`
+		TunnelQuota     *string        `yaml:"tunnel_quota"`
+		TunnelBandwidth *string        `yaml:"tunnel_bandwidth"`
+	} `yaml:"limits"`
+	Domains *[]struct {
+		Name string `yaml:"name"`
+		TLS  struct {
+			Cert string `yaml:"cert"`
+			Key  string `yaml:"key"`
+		} `yaml:"tls"`
+		Limits struct {
+			TunnelQuota     string `yaml:"tunnel_quota"`
+			TunnelBandwidth string `yaml:"tunnel_bandwidth"`
+		} `yaml:"limits"`
+		APIKeys []configFileKey `yaml:"api_keys"`
+	} `yaml:"domains"`
+	Reserved *[]string `yaml:"reserved"`
+	Pages    *string   `yaml:"pages"`
+	Logging  struct {
+		Debug *bool   `yaml:"debug"`
+		File  *string `yaml:"file"`
+	} `yaml:"logging"`
+}
+
+// configFileKey is an API key in a configuration file
+type configFileKey struct {
+	Key   string `yaml:"key"`
+	Name  string `yaml:"name"`
+	Quota string `yaml:"quota"`
+}
+
+// apiKey converts the key, which opens tunnels on domain
+func (fk configFileKey) apiKey(domain string) (APIKey, error) {
+	if fk.Key == "" {
+		return APIKey{}, errors.New("api key: missing key")
+	}
+	k := APIKey{Key: fk.Key, Name: fk.Name, Domain: domain}
+	if k.Name == "" {
+		k.Name = defaultKeyName(k.Key)
+	}
+	if fk.Quota != "" {
+		quota, err := common.ParseSize(fk.Quota)
+		if err != nil {
+			return APIKey{}, fmt.Errorf("api key %q: %w", k.Name, err)
+		}
+		k.Quota = quota
+	}
+	return k, nil
+}
+
+// LoadConfigFile returns a copy of base with the settings of a YAML file of the form
+//
+//	domain: leap.example.com
+//	listeners:
+//	  bind: 0.0.0.0:80
+//	  tls: 0.0.0.0:443
+//	tls:
+//	  cert: /etc/leap/wildcard.pem
+//	  key: /etc/leap/wildcard.key
+//	auth:
+//	  api_keys:
+//	    - key: s3cret
+//	      name: alice
+//	      quota: 10g
+//	  admin_token: t0ken
+//	limits:
+//	  idle_timeout: 1h
+//	  tunnel_quota: 50g
+//	  tunnel_bandwidth: 1m
+//	domains:
+//	  - name: leap.partners.example.com
+//	    tls:
+//	      cert: /etc/leap/partners.pem
+//	      key: /etc/leap/partners.key
+//	    limits:
+//	      tunnel_quota: 10g
+//	    api_keys:
+//	      - key: p4rtner
+//	        name: partner
+//	reserved: [www, api, admin]
+//	logging:
+//	  debug: false
+//	  file: /var/log/leap.log
+//
+// Settings in the file take precedence over those in base. The server rereads the file
+// on SIGHUP, starting over from base.
+func LoadConfigFile(path string, base *Config) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file configFile
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	config := *base
+	config.ConfigFile = path
+	config.base = base
+	if err := file.apply(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// apply copies the settings present in the file to config
+func (f *configFile) apply(config *Config) error {
+	setString(&config.Domain, f.Domain)
+	setString(&config.Bind, f.Listeners.Bind)
+	setString(&config.TLSBind, f.Listeners.TLS)
+	setString(&config.ClusterBind, f.Listeners.Cluster)
+
+	setString(&config.TLSCertFile, f.TLS.Cert)
+	setString(&config.TLSKeyFile, f.TLS.Key)
+	setString(&config.CertCacheDir, f.TLS.CertCache)
+	setString(&config.ACMEEmail, f.TLS.ACMEEmail)
+	setString(&config.ACMEDirectory, f.TLS.ACMEDirectory)
+
+	if f.Auth.APIKeys != nil {
+		// these are the keys of the primary domain, replacing those given elsewhere
+		keys := make([]APIKey, 0, len(*f.Auth.APIKeys))
+		for _, fk := range *f.Auth.APIKeys {
+			k, err := fk.apiKey("")
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range config.APIKeys {
+			if k.Domain != "" {
+				keys = append(keys, k)
+			}
+		}
+		config.APIKeys = keys
+	}
+	setString(&config.AdminToken, f.Auth.AdminToken)
+
+	if f.Domains != nil {
+		// the keys of the other domains are listed with them, replacing those given elsewhere
+		var keys []APIKey
+		for _, k := range config.APIKeys {
+			if k.Domain == "" {
+				keys = append(keys, k)
+			}
+		}
+
+		config.Domains = make([]DomainConfig, 0, len(*f.Domains))
+		for _, fd := range *f.Domains {
+			d := DomainConfig{
+				Name:        strings.ToLower(fd.Name),
+				TLSCertFile: fd.TLS.Cert,
+				TLSKeyFile:  fd.TLS.Key,
+			}
+			if err := setSize(&d.TunnelQuota, &fd.Limits.TunnelQuota); err != nil {
+				return fmt.Errorf("domain %s: tunnel quota: %w", d.Name, err)
+			}
+			if err := setSize(&d.TunnelBandwidth, &fd.Limits.TunnelBandwidth); err != nil {
+				return fmt.Errorf("domain %s: tunnel bandwidth: %w", d.Name, err)
+			}
+			for _, fk := range fd.APIKeys {
+				k, err := fk.apiKey(d.Name)
+				if err != nil {
+					return fmt.Errorf("domain %s: %w", d.Name, err)
+				}
+				keys = append(keys, k)
+			}
+			config.Domains = append(config.Domains, d)
+		}
+		config.APIKeys = keys
+	}
+
+	setDuration(&config.ConnectTimeout, f.Limits.ConnectTimeout)
+	setDuration(&config.IdleTimeout, f.Limits.IdleTimeout)
+	setDuration(&config.RequestTimeout, f.Limits.RequestTimeout)
+	setDuration(&config.PingInterval, f.Limits.PingInterval)
+	setDuration(&config.PingTimeout, f.Limits.PingTimeout)
+	setDuration(&config.DrainTimeout, f.Limits.DrainTimeout)
+	if f.Limits.QuotaPeriod != nil {
+		config.QuotaPeriod = *f.Limits.QuotaPeriod
+	}
+	if err := setSize(&config.TunnelQuota, f.Limits.TunnelQuota); err != nil {
+		return fmt.Errorf("tunnel quota: %w", err)
+	}
+	if err := setSize(&config.TunnelBandwidth, f.Limits.TunnelBandwidth); err != nil {
+		return fmt.Errorf("tunnel bandwidth: %w", err)
+	}
+
+	if f.Reserved != nil {
+		config.Reserved = *f.Reserved
+	}
+	setString(&config.PagesDir, f.Pages)
+	if f.Logging.Debug != nil {
+		config.Debug = *f.Logging.Debug
+	}
+	setString(&config.LogFile, f.Logging.File)
+	return nil
+}
+
+func setString(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setDuration(dst *time.Duration, v *time.Duration) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setSize(dst *int64, v *string) error {
+	if v == nil {
+		return nil
+	}
+	if *v == "" || *v == "0" {
+		*dst = 0
+		return nil
+	}
+	size, err := common.ParseSize(*v)
+	if err != nil {
+		return err
+	}
+	*dst = size
+	return nil
+}
+
+// validate checks the configuration for mistakes that would otherwise only show once
+// the server is running
+func (c *Config) validate() error {
+	if c.Domain == "" {
+		return errors.New("a domain is required")
+	}
+	if c.QuotaPeriod != "" && c.QuotaPeriod != QuotaDaily && c.QuotaPeriod != QuotaMonthly {
+		return fmt.Errorf("unknown quota period %q", c.QuotaPeriod)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("a TLS certificate requires both a certificate and a key file")
+	}
+
+	durations := map[string]time.Duration{
+		"connect timeout": c.ConnectTimeout,
+		"idle timeout":    c.IdleTimeout,
+		"request timeout": c.RequestTimeout,
+		"ping interval":   c.PingInterval,
+		"ping timeout":    c.PingTimeout,
+		"drain timeout":   c.DrainTimeout,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return fmt.Errorf("negative %s %v", name, d)
+		}
+	}
+	if c.TunnelQuota < 0 || c.TunnelBandwidth < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	// domains are matched without regard to case
+	domains := map[string]bool{strings.ToLower(c.Domain): true}
+	for _, d := range c.Domains {
+		if d.Name == "" {
+			return errors.New("a domain is missing its name")
+		}
+		if domains[strings.ToLower(d.Name)] {
+			return fmt.Errorf("domain %s is listed twice", d.Name)
+		}
+		if (d.TLSCertFile == "") != (d.TLSKeyFile == "") {
+			return fmt.Errorf("domain %s: a TLS certificate requires both a certificate and a key file", d.Name)
+		}
+		if d.TunnelQuota < 0 || d.TunnelBandwidth < 0 {
+			return fmt.Errorf("domain %s: limits must not be negative", d.Name)
+		}
+		domains[strings.ToLower(d.Name)] = true
+	}
+
+	// key names are unique across domains, as usage is counted by name
+	keys := make(map[string]bool, len(c.APIKeys))
+	names := make(map[string]bool, len(c.APIKeys))
+	for _, k := range c.APIKeys {
+		if k.Domain != "" && !domains[strings.ToLower(k.Domain)] {
+			return fmt.Errorf("api key %q is for the unknown domain %s", k.Name, k.Domain)
+		}
+		if keys[k.Key] {
+			return fmt.Errorf("api key %q is listed twice", k.Name)
+		}
+		if names[k.Name] {
+			return fmt.Errorf("api key name %q is used twice", k.Name)
+		}
+		keys[k.Key], names[k.Name] = true, true
+	}
+
+	for _, name := range c.Reserved {
+		if !isValidLabel(name) {
+			return fmt.Errorf("reserved name %q is not a valid subdomain", name)
+		}
+	}
+	return nil
+}
+
+// isValidLabel reports whether s can be a lowercase DNS label
+func isValidLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
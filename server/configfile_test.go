@@ -0,0 +1,233 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := &Config{
+		Domain:      "leap.example.com",
+		Bind:        "0.0.0.0:80",
+		IdleTimeout: time.Hour,
+		APIKeys: []APIKey{
+			{Key: "flag", Name: "flag"},
+			{Key: "partner-flag", Name: "partner-flag", Domain: "leap.partners.com"},
+		},
+		Domains: []DomainConfig{{Name: "leap.partners.com"}},
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		check   func(t *testing.T, c *Config)
+		wantErr bool
+	}{
+		{
+			name: "empty file keeps base",
+			file: "{}\n",
+			check: func(t *testing.T, c *Config) {
+				if c.Domain != base.Domain || c.Bind != base.Bind || c.IdleTimeout != time.Hour {
+					t.Errorf("config = %+v, want the base settings", c)
+				}
+				if !reflect.DeepEqual(c.APIKeys, base.APIKeys) || !reflect.DeepEqual(c.Domains, base.Domains) {
+					t.Errorf("keys %+v, domains %+v, want those of base", c.APIKeys, c.Domains)
+				}
+			},
+		},
+		{
+			name: "settings",
+			file: `
+domain: tunnel.example.com
+listeners:
+  bind: 127.0.0.1:8080
+limits:
+  idle_timeout: 5m
+  quota_period: daily
+  tunnel_quota: 1g
+  tunnel_bandwidth: 64k
+reserved: [www, api]
+logging:
+  debug: true
+  file: /var/log/leap.log
+`,
+			check: func(t *testing.T, c *Config) {
+				want := *base
+				want.Domain = "tunnel.example.com"
+				want.Bind = "127.0.0.1:8080"
+				want.IdleTimeout = 5 * time.Minute
+				want.QuotaPeriod = QuotaDaily
+				want.TunnelQuota = 1 << 30
+				want.TunnelBandwidth = 64 << 10
+				want.Reserved = []string{"www", "api"}
+				want.Debug = true
+				want.LogFile = "/var/log/leap.log"
+				want.ConfigFile = c.ConfigFile
+				want.base = base
+				if !reflect.DeepEqual(c, &want) {
+					t.Errorf("config = %+v, want %+v", c, &want)
+				}
+			},
+		},
+		{
+			name: "primary keys replace those of the primary domain",
+			file: `
+auth:
+  api_keys:
+    - key: s3cret
+      name: alice
+      quota: 10g
+    - key: t0ken
+`,
+			check: func(t *testing.T, c *Config) {
+				want := []APIKey{
+					{Key: "s3cret", Name: "alice", Quota: 10 << 30},
+					{Key: "t0ken", Name: "key-b46c0967"},
+					{Key: "partner-flag", Name: "partner-flag", Domain: "leap.partners.com"},
+				}
+				if !reflect.DeepEqual(c.APIKeys, want) {
+					t.Errorf("keys = %+v, want %+v", c.APIKeys, want)
+				}
+			},
+		},
+		{
+			name: "domains replace the other domains and their keys",
+			file: `
+domains:
+  - name: Leap.Other.com
+    tls:
+      cert: /etc/leap/other.pem
+      key: /etc/leap/other.key
+    limits:
+      tunnel_quota: 10g
+    api_keys:
+      - key: 0ther
+        name: other
+`,
+			check: func(t *testing.T, c *Config) {
+				wantDomains := []DomainConfig{{
+					Name:        "leap.other.com",
+					TunnelQuota: 10 << 30,
+					TLSCertFile: "/etc/leap/other.pem",
+					TLSKeyFile:  "/etc/leap/other.key",
+				}}
+				if !reflect.DeepEqual(c.Domains, wantDomains) {
+					t.Errorf("domains = %+v, want %+v", c.Domains, wantDomains)
+				}
+				wantKeys := []APIKey{
+					{Key: "flag", Name: "flag"},
+					{Key: "0ther", Name: "other", Domain: "leap.other.com"},
+				}
+				if !reflect.DeepEqual(c.APIKeys, wantKeys) {
+					t.Errorf("keys = %+v, want %+v", c.APIKeys, wantKeys)
+				}
+			},
+		},
+		{
+			name: "zero size disables limit",
+			file: "limits:\n  tunnel_quota: \"0\"\n",
+			check: func(t *testing.T, c *Config) {
+				if c.TunnelQuota != 0 {
+					t.Errorf("tunnel quota = %d, want 0", c.TunnelQuota)
+				}
+			},
+		},
+		{name: "unknown setting", file: "domian: leap.example.com\n", wantErr: true},
+		{name: "invalid yaml", file: "domain: [\n", wantErr: true},
+		{name: "invalid duration", file: "limits:\n  idle_timeout: soon\n", wantErr: true},
+		{name: "invalid size", file: "limits:\n  tunnel_quota: lots\n", wantErr: true},
+		{name: "key without key", file: "auth:\n  api_keys:\n    - name: alice\n", wantErr: true},
+		{name: "invalid domain quota", file: "domains:\n  - name: leap.other.com\n    limits:\n      tunnel_quota: lots\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, filepath.Base(t.Name())+".yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := LoadConfigFile(path, base)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfigFile() = %+v, want error", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigFile() error: %v", err)
+			}
+			if c.ConfigFile != path || c.base != base {
+				t.Errorf("config file %q, base %p, want %q, %p", c.ConfigFile, c.base, path, base)
+			}
+			tt.check(t, c)
+		})
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(dir, "missing.yaml"), base); err == nil {
+		t.Error("LoadConfigFile() of a missing file succeeded")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Domain:  "leap.example.com",
+			Domains: []DomainConfig{{Name: "leap.partners.com"}},
+			APIKeys: []APIKey{
+				{Key: "a", Name: "alice"},
+				{Key: "b", Name: "bob", Domain: "leap.partners.com"},
+			},
+			Reserved: []string{"www", "api-v2"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "key domain in another case", modify: func(c *Config) { c.APIKeys[1].Domain = "Leap.Partners.com" }},
+		{name: "missing domain", modify: func(c *Config) { c.Domain = "" }, wantErr: true},
+		{name: "unknown quota period", modify: func(c *Config) { c.QuotaPeriod = "weekly" }, wantErr: true},
+		{name: "cert without key", modify: func(c *Config) { c.TLSCertFile = "cert.pem" }, wantErr: true},
+		{name: "negative timeout", modify: func(c *Config) { c.IdleTimeout = -time.Second }, wantErr: true},
+		{name: "negative quota", modify: func(c *Config) { c.TunnelQuota = -1 }, wantErr: true},
+		{name: "unnamed domain", modify: func(c *Config) { c.Domains[0].Name = "" }, wantErr: true},
+		{name: "primary domain listed again", modify: func(c *Config) { c.Domains[0].Name = "LEAP.example.com" }, wantErr: true},
+		{
+			name:    "domain listed twice",
+			modify:  func(c *Config) { c.Domains = append(c.Domains, DomainConfig{Name: "leap.partners.com"}) },
+			wantErr: true,
+		},
+		{name: "key for unknown domain", modify: func(c *Config) { c.APIKeys[1].Domain = "leap.other.com" }, wantErr: true},
+		{name: "key listed twice", modify: func(c *Config) { c.APIKeys[1].Key = "a" }, wantErr: true},
+		{name: "key name used twice", modify: func(c *Config) { c.APIKeys[1].Name = "alice" }, wantErr: true},
+		{name: "invalid reserved name", modify: func(c *Config) { c.Reserved = []string{"WWW"} }, wantErr: true},
+		{name: "reserved name with dot", modify: func(c *Config) { c.Reserved = []string{"a.b"} }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			err := c.validate()
+			if tt.wantErr && err == nil {
+				t.Error("validate() = nil, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"strings"
+)
+
+// DomainConfig is a base domain served alongside Config.Domain with its own limits and
+// certificate. Clients open tunnels on it with the API keys naming it (see APIKey.Domain),
+// or without a key if none do.
+type DomainConfig struct {
+	Name string
+	// Bytes each subdomain may transfer per quota period, or zero for no quota
+	TunnelQuota int64
+	// Bytes per second the traffic of each tunnel is throttled to, or zero for no limit
+	TunnelBandwidth int64
+	// Certificate for the domain and its subdomains, usually a wildcard
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// ParseDomain parses a domain of the form NAME[;quota=SIZE][;bandwidth=SIZE]
+// [;cert=FILE;key=FILE], for example "leap.partners.example.com;quota=10g".
+func ParseDomain(s string) (DomainConfig, error) {
+	parts := strings.Split(s, ";")
+	d := DomainConfig{Name: strings.ToLower(strings.TrimSpace(parts[0]))}
+	if d.Name == "" {
+		return DomainConfig{}, errors.New("domain: missing name")
+	}
+
+	for _, part := range parts[1:] {
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			return DomainConfig{}, fmt.Errorf("domain: expected KEY=VALUE, got %q", part)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(part[:eq])), strings.TrimSpace(part[eq+1:])
+		switch key {
+		case "quota", "bandwidth":
+			size, err := common.ParseSize(value)
+			if err != nil {
+				return DomainConfig{}, fmt.Errorf("domain: %w", err)
+			}
+			if key == "quota" {
+				d.TunnelQuota = size
+			} else {
+				d.TunnelBandwidth = size
+			}
+		case "cert":
+			d.TLSCertFile = value
+		case "key":
+			d.TLSKeyFile = value
+		default:
+			return DomainConfig{}, fmt.Errorf("domain: unknown option %q", key)
+		}
+	}
+	return d, nil
+}
+
+// baseDomain is a domain tunnels are served under, along with its policies
+type baseDomain struct {
+	name string
+	// whether this is Config.Domain
+	primary bool
+	apiKeys map[string]*APIKey // by key
+	// limits of each tunnel
+	quota     int64
+	bandwidth int64
+	// certificate for the domain, if configured
+	certificate *tls.Certificate
+}
+
+// tunnelName is the name tunnels on subdomain are registered and claimed under. On the
+// primary domain it is the subdomain alone, so that it doesn't change for servers that
+// only have one, and subdomain.domain on the others.
+func (d *baseDomain) tunnelName(subdomain string) string {
+	if d.primary {
+		return subdomain
+	}
+	return subdomain + "." + d.name
+}
+
+// newBaseDomain loads the certificate of a domain. Names are kept in lowercase, like the
+// hosts they are matched against.
+func newBaseDomain(name string, primary bool, quota, bandwidth int64, certFile, keyFile string) (*baseDomain, error) {
+	d := &baseDomain{
+		name:      strings.ToLower(name),
+		primary:   primary,
+		apiKeys:   make(map[string]*APIKey),
+		quota:     quota,
+		bandwidth: bandwidth,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate for %s: %w", name, err)
+		}
+		d.certificate = &cert
+	}
+	return d, nil
+}
+
+// domain returns the base domain called name, ignoring case
+func (l *liveConfig) domain(name string) (*baseDomain, bool) {
+	name = strings.ToLower(name)
+	for _, d := range l.domains {
+		if d.name == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// splitHost splits a host into a lowercase subdomain and the base domain it is directly
+// under. Where base domains are nested, the longest one wins.
+func (l *liveConfig) splitHost(host string) (string, *baseDomain, bool) {
+	host = strings.ToLower(host)
+	var match *baseDomain
+	for _, d := range l.domains {
+		if strings.HasSuffix(host, "."+d.name) && (match == nil || len(d.name) > len(match.name)) {
+			match = d
+		}
+	}
+	if match == nil {
+		return "", nil, false
+	}
+
+	subdomain := strings.TrimSuffix(host, "."+match.name)
+	if strings.Contains(subdomain, ".") {
+		return "", nil, false
+	}
+	return subdomain, match, true
+}
+
+// domainOfName returns the base domain of a tunnel name (see baseDomain.tunnelName)
+func (l *liveConfig) domainOfName(name string) (*baseDomain, bool) {
+	if !strings.Contains(name, ".") {
+		return l.domains[0], true
+	}
+	_, d, ok := l.splitHost(name)
+	return d, ok
+}
+
+// domainFor returns the base domain a host is or is under, or the primary domain
+func (l *liveConfig) domainFor(host string) *baseDomain {
+	if d, ok := l.domain(host); ok {
+		return d
+	}
+	if _, d, ok := l.splitHost(host); ok {
+		return d
+	}
+	return l.domains[0]
+}
+
+// certificateFor returns the certificate of the base domain serverName is or is under.
+// Server names carry no port, unlike the names of base domains served on other ports.
+func (l *liveConfig) certificateFor(serverName string) *tls.Certificate {
+	serverName = strings.ToLower(serverName)
+	var match *baseDomain
+	for _, d := range l.domains {
+		name := stripPort(d.name)
+		if (serverName == name || strings.HasSuffix(serverName, "."+name)) && (match == nil || len(d.name) > len(match.name)) {
+			match = d
+		}
+	}
+	if match == nil || match.certificate == nil {
+		return l.domains[0].certificate
+	}
+	return match.certificate
+}
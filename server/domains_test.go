@@ -0,0 +1,104 @@
+package server
+
+import "testing"
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    DomainConfig
+		wantErr bool
+	}{
+		{in: "leap.partners.com", want: DomainConfig{Name: "leap.partners.com"}},
+		{in: " Leap.Partners.com:8080 ", want: DomainConfig{Name: "leap.partners.com:8080"}},
+		{
+			in:   "leap.partners.com;quota=10g; Bandwidth = 1m",
+			want: DomainConfig{Name: "leap.partners.com", TunnelQuota: 10 << 30, TunnelBandwidth: 1 << 20},
+		},
+		{
+			in:   "leap.partners.com;cert=/etc/leap/partners.pem;key=/etc/leap/partners.key",
+			want: DomainConfig{Name: "leap.partners.com", TLSCertFile: "/etc/leap/partners.pem", TLSKeyFile: "/etc/leap/partners.key"},
+		},
+		{in: "", wantErr: true},
+		{in: ";quota=1g", wantErr: true},
+		{in: "leap.partners.com;quota", wantErr: true},
+		{in: "leap.partners.com;quota=lots", wantErr: true},
+		{in: "leap.partners.com;owner=partner", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDomain(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseDomain(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDomain(%q) error: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDomain(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHost(t *testing.T) {
+	live, err := newLiveConfig(&Config{
+		Domain: "Leap.Example.com",
+		Domains: []DomainConfig{
+			{Name: "partners.example.com"},
+			{Name: "eu.leap.example.com"},
+			{Name: "leap.test:8080"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host          string
+		wantSubdomain string
+		wantDomain    string
+		wantName      string
+		ok            bool
+	}{
+		{host: "foo.leap.example.com", wantSubdomain: "foo", wantDomain: "leap.example.com", wantName: "foo", ok: true},
+		{host: "FOO.Leap.Example.COM", wantSubdomain: "foo", wantDomain: "leap.example.com", wantName: "foo", ok: true},
+		{host: "foo.eu.leap.example.com", wantSubdomain: "foo", wantDomain: "eu.leap.example.com", wantName: "foo.eu.leap.example.com", ok: true},
+		{host: "foo.partners.example.com", wantSubdomain: "foo", wantDomain: "partners.example.com", wantName: "foo.partners.example.com", ok: true},
+		{host: "foo.leap.test:8080", wantSubdomain: "foo", wantDomain: "leap.test:8080", wantName: "foo.leap.test:8080", ok: true},
+		{host: "foo.leap.test"},
+		{host: "foo.bar.leap.example.com"},
+		{host: "leap.example.com"},
+		{host: "foo.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			subdomain, d, ok := live.splitHost(tt.host)
+			if ok != tt.ok {
+				t.Fatalf("splitHost(%q) ok = %v, want %v", tt.host, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if subdomain != tt.wantSubdomain || d.name != tt.wantDomain {
+				t.Errorf("splitHost(%q) = %q, %q, want %q, %q", tt.host, subdomain, d.name, tt.wantSubdomain, tt.wantDomain)
+			}
+			if name := d.tunnelName(subdomain); name != tt.wantName {
+				t.Errorf("tunnelName(%q) = %q, want %q", subdomain, name, tt.wantName)
+			}
+			if back, ok := live.domainOfName(tt.wantName); !ok || back != d {
+				t.Errorf("domainOfName(%q) = %v, want %s", tt.wantName, back, d.name)
+			}
+		})
+	}
+
+	for _, name := range []string{"LEAP.EXAMPLE.COM", "Partners.Example.com"} {
+		if _, ok := live.domain(name); !ok {
+			t.Errorf("domain(%q) not found", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listenerFDsEnv passes the listeners inherited from a previous process during a hot
+// restart, as NAME=FD pairs separated by commas
+const listenerFDsEnv = "LEAP_LISTENER_FDS"
+
+// listen opens the listener called name on addr, or takes it over from the process this
+// one replaced
+func (s *LeapServer) listen(name, addr string) (net.Listener, error) {
+	if fd, ok := inheritedFD(name); ok {
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit %s listener: %w", name, err)
+		}
+		s.listeners[name] = l
+		return l, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.listeners[name] = l
+	return l, nil
+}
+
+func inheritedFD(name string) (int, bool) {
+	for _, pair := range strings.Split(os.Getenv(listenerFDsEnv), ",") {
+		eq := strings.Index(pair, "=")
+		if eq == -1 || pair[:eq] != name {
+			continue
+		}
+		fd, err := strconv.Atoi(pair[eq+1:])
+		return fd, err == nil
+	}
+	return 0, false
+}
+
+// isDraining reports whether the server is shutting down, in which case it takes no new
+// tunnels
+func (s *LeapServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// drain shuts the server down gracefully. The listeners close at once, then public
+// requests in flight get up to Config.DrainTimeout to finish before clients are asked
+// to reconnect, which they can do to another node or to the process that took over.
+func (s *LeapServer) drain(servers []*http.Server) error {
+	atomic.StoreInt32(&s.draining, 1)
+	deadline := time.Now().Add(s.conf().DrainTimeout)
+	log.Printf("Draining, waiting up to %v for requests in flight\n", s.conf().DrainTimeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Shutdown waits for requests that haven't been answered yet, but not for the
+	// hijacked connections of tunnels and of responses being written
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	wg.Wait()
+	for atomic.LoadInt64(&s.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if n := atomic.LoadInt64(&s.inflight); n > 0 {
+		log.Printf("Cutting off %d requests in flight\n", n)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tun := range s.registry.List() {
+		if !tun.lastActivity().IsZero() {
+			expire := time.Now().Add(time.Millisecond * 500)
+			_ = tun.closeConnection(websocket.CloseServiceRestart, "draining", expire)
+		}
+	}
+
+	close(errs)
+	for err := range errs {
+		if err != nil && err != context.DeadlineExceeded {
+			return err
+		}
+	}
+	return nil
+}
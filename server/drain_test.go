@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/dnsge/leap/common"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the tunnel answers the request in flight after the drain started
+		answer bool
+		status int
+	}{
+		{name: "request finishes", answer: true, status: http.StatusOK},
+		{name: "request cut off", status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, &Config{DrainTimeout: 500 * time.Millisecond})
+			ws := s.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+			defer ws.Close()
+			// never connected, so not closed by the drain
+			if status, _ := s.requestTunnel(t, common.SubdomainRequest{Subdomain: "bar"}); status != http.StatusOK {
+				t.Fatalf("tunnel request failed with status %d", status)
+			}
+
+			responses := make(chan *http.Response, 1)
+			go func() {
+				req, _ := http.NewRequest(http.MethodGet, "http://"+s.addr+"/", nil)
+				req.Host = "foo.leap.example.com"
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					responses <- resp
+				}
+				close(responses)
+			}()
+			request := readRequest(t, ws)
+
+			drained := make(chan error, 1)
+			start := time.Now()
+			go func() {
+				drained <- s.drain(s.servers)
+			}()
+			for !s.isDraining() {
+				time.Sleep(time.Millisecond)
+			}
+			if tt.answer {
+				respond(t, ws, request.ID, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\ndone")
+			}
+
+			// the client is asked to reconnect elsewhere once the request is done
+			_, _, err := ws.ReadMessage()
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Errorf("read error = %v, want a close for a restart", err)
+			}
+			if err := <-drained; err != nil {
+				t.Errorf("drain() = %v", err)
+			}
+			if elapsed := time.Since(start); tt.answer == (elapsed >= 500*time.Millisecond) {
+				t.Errorf("drain took %v with a drain timeout of 500ms", elapsed)
+			}
+
+			resp, ok := <-responses
+			if !ok {
+				t.Fatal("the request in flight failed without a response")
+			}
+			if readBody(t, resp); resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestDrainingRefusesTunnels(t *testing.T) {
+	s := startTestServer(t, &Config{})
+	defer s.Close()
+	_, token := s.requestTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+
+	atomic.StoreInt32(&s.draining, 1)
+	if status, _ := s.requestTunnel(t, common.SubdomainRequest{Subdomain: "bar"}); status != http.StatusServiceUnavailable {
+		t.Errorf("tunnel request status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	resp := s.request(t, http.MethodGet, "leap.example.com", "/api/connect?token="+token.Token, nil)
+	if readBody(t, resp); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connect status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestInheritedFD(t *testing.T) {
+	defer os.Setenv(listenerFDsEnv, os.Getenv(listenerFDsEnv))
+
+	tests := []struct {
+		env  string
+		name string
+		fd   int
+		ok   bool
+	}{
+		{env: "", name: "bind"},
+		{env: "bind=3", name: "bind", fd: 3, ok: true},
+		{env: "bind=3,tls=4", name: "tls", fd: 4, ok: true},
+		{env: "bind=3,tls=4", name: "cluster"},
+		{env: "binding=3", name: "bind"},
+		{env: "bind=three", name: "bind"},
+		{env: "bind", name: "bind"},
+	}
+	for _, tt := range tests {
+		_ = os.Setenv(listenerFDsEnv, tt.env)
+		fd, ok := inheritedFD(tt.name)
+		if fd != tt.fd || ok != tt.ok {
+			t.Errorf("%s=%q: inheritedFD(%q) = %d, %t, want %d, %t", listenerFDsEnv, tt.env, tt.name, fd, ok, tt.fd, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type EventType string
+
+const (
+	TunnelCreated      EventType = "tunnel.created"
+	TunnelConnected    EventType = "tunnel.connected"
+	TunnelDisconnected EventType = "tunnel.disconnected"
+	// The token of a created tunnel expired before the client connected
+	TunnelExpired    EventType = "tunnel.expired"
+	RequestCompleted EventType = "request.completed"
+)
+
+// Event describes something that happened to a tunnel
+type Event struct {
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	Subdomain string    `json:"subdomain"`
+	// Base domain the subdomain is under
+	Domain string `json:"domain"`
+	// Set for RequestCompleted only
+	Request *RequestInfo `json:"request,omitempty"`
+}
+
+// RequestInfo describes a public request served through a tunnel
+type RequestInfo struct {
+	// Also sent to the client in the X-Leap-Request-Id header
+	ID         string        `json:"id"`
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	RemoteAddr string        `json:"remote_addr"`
+	Status     int           `json:"status"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+// Hook receives tunnel events. Hooks are called synchronously by the goroutine the event
+// happened on, so they must return quickly and hand slow work off elsewhere.
+type Hook interface {
+	HandleEvent(e Event)
+}
+
+// HookFunc lets an ordinary function receive events in process
+type HookFunc func(e Event)
+
+func (f HookFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// emit passes an event to every hook
+func (s *LeapServer) emit(e Event) {
+	e.Time = time.Now()
+	for _, hook := range s.hooks {
+		hook.HandleEvent(e)
+	}
+}
+
+const (
+	// Header carrying the hex HMAC-SHA256 of the payload, keyed with the webhook secret
+	webhookSignatureHeader = "X-Leap-Signature"
+	webhookEventHeader     = "X-Leap-Event"
+
+	// Events waiting to be delivered beyond this many are dropped
+	webhookQueueSize = 256
+	// Delivery attempts per event, doubling the delay between them
+	webhookAttempts   = 5
+	webhookRetryDelay = time.Second
+)
+
+// WebhookHook posts events as JSON to a URL. Deliveries happen in the background in the
+// order events occurred and are retried on failure.
+type WebhookHook struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan Event
+}
+
+// NewWebhookHook starts delivering events to url. When secret is not empty, every
+// payload is signed with it in the X-Leap-Signature header as "sha256=<hex hmac>".
+func NewWebhookHook(url, secret string) *WebhookHook {
+	h := &WebhookHook{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: time.Second * 10},
+		queue:  make(chan Event, webhookQueueSize),
+	}
+	go h.deliverAll()
+	return h
+}
+
+func (h *WebhookHook) HandleEvent(e Event) {
+	select {
+	case h.queue <- e:
+	default:
+		log.Printf("Webhook queue is full, dropping %s event for %q\n", e.Type, e.Subdomain)
+	}
+}
+
+func (h *WebhookHook) deliverAll() {
+	for e := range h.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Failed to encode %s event: %v\n", e.Type, err)
+			continue
+		}
+
+		delay := webhookRetryDelay
+		for attempt := 1; ; attempt++ {
+			err := h.deliver(e.Type, body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("Giving up delivering %s event for %q: %v\n", e.Type, e.Subdomain, err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (h *WebhookHook) deliver(eventType EventType, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(eventType))
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
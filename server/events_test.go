@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/dnsge/leap/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliver(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		status  int
+		wantErr bool
+	}{
+		{name: "signed", secret: "s3cret", status: http.StatusOK},
+		{name: "unsigned", status: http.StatusNoContent},
+		{name: "rejected", secret: "s3cret", status: http.StatusInternalServerError, wantErr: true},
+		{name: "not modified", status: http.StatusNotModified, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received *http.Request
+			var receivedBody []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+				receivedBody, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			h := &WebhookHook{url: srv.URL, secret: []byte(tt.secret), client: srv.Client()}
+			body, _ := json.Marshal(Event{Type: TunnelCreated, Subdomain: "foo"})
+			err := h.deliver(TunnelCreated, body)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("deliver() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if received == nil {
+				t.Fatal("nothing was delivered")
+			}
+			if received.Method != http.MethodPost || string(receivedBody) != string(body) {
+				t.Errorf("received %s %q, want POST %q", received.Method, receivedBody, body)
+			}
+			if event := received.Header.Get(webhookEventHeader); event != string(TunnelCreated) {
+				t.Errorf("%s = %q, want %q", webhookEventHeader, event, TunnelCreated)
+			}
+
+			signature := received.Header.Get(webhookSignatureHeader)
+			if tt.secret == "" {
+				if signature != "" {
+					t.Errorf("%s = %q without a secret, want none", webhookSignatureHeader, signature)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(tt.secret))
+			mac.Write(body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("%s = %q, want %q", webhookSignatureHeader, signature, want)
+			}
+		})
+	}
+}
+
+func TestReapExpiredEvents(t *testing.T) {
+	var events []EventType
+	s := newTestServer(t, &Config{
+		ConnectTimeout: time.Minute,
+		Hooks: []Hook{HookFunc(func(e Event) {
+			events = append(events, e.Type)
+		})},
+	})
+
+	tun, _, message := s.issueTunnel(&common.SubdomainRequest{Subdomain: "foo"}, s.conf().domains[0], nil)
+	if tun == nil {
+		t.Fatalf("issueTunnel() failed: %s", message)
+	}
+	s.reapExpired(tun.created.Add(time.Second))
+	if len(events) != 0 {
+		t.Fatalf("events before the token expired = %v, want none", events)
+	}
+	s.reapExpired(tun.created.Add(time.Hour))
+	if want := []EventType{TunnelExpired}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/subtle"
+	"github.com/dnsge/leap/common"
+	"sync/atomic"
+)
+
+// tunnelGroup is the policy shared by the tunnels serving a subdomain. Unless the group
+// is shared, it applies to a single tunnel.
+type tunnelGroup struct {
+	next uint32 // round-robin position, accessed atomically
+
+	shared  bool
+	key     string
+	balance string
+	// of this node's claim on the subdomain in the cluster registry
+	generation uint64
+}
+
+func newTunnelGroup(sr *common.SubdomainRequest) *tunnelGroup {
+	g := &tunnelGroup{}
+	if sr.Group {
+		g.shared = true
+		g.key = sr.GroupKey
+		g.balance = sr.Balance
+		if g.balance == "" {
+			g.balance = common.BalanceRoundRobin
+		}
+	}
+	return g
+}
+
+// canJoin reports whether a tunnel request may attach to the existing group
+func (g *tunnelGroup) canJoin(sr *common.SubdomainRequest) bool {
+	return g.shared && sr.Group && subtle.ConstantTimeCompare([]byte(g.key), []byte(sr.GroupKey)) == 1
+}
+
+// pick chooses the connected member that should serve the next request, skipping any
+// member in exclude
+func (g *tunnelGroup) pick(members []*Tunnel, exclude map[*Tunnel]bool) (*Tunnel, bool) {
+	var candidates []*Tunnel
+	for _, member := range members {
+		if !member.lastActivity().IsZero() && !exclude[member] {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	if g.balance == common.BalanceLeastInflight {
+		best := candidates[0]
+		bestCount := best.pendingCount()
+		for _, tun := range candidates[1:] {
+			if n := tun.pendingCount(); n < bestCount {
+				best, bestCount = tun, n
+			}
+		}
+		return best, true
+	}
+
+	n := atomic.AddUint32(&g.next, 1)
+	return candidates[int(n)%len(candidates)], true
+}
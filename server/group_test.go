@@ -0,0 +1,160 @@
+package server
+
+import (
+	"github.com/dnsge/leap/common"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTunnelGroupPick(t *testing.T) {
+	domain := &baseDomain{name: "leap.example.com", primary: true}
+
+	tests := []struct {
+		name    string
+		balance string
+		// requests pending on each member, or -1 if the member never connected
+		pending []int
+		exclude []int
+		// members picked by consecutive calls
+		want []int
+	}{
+		{name: "round robin", balance: common.BalanceRoundRobin, pending: []int{0, 0, 0}, want: []int{1, 2, 0, 1}},
+		{name: "round robin skips unconnected", balance: common.BalanceRoundRobin, pending: []int{0, -1, 0}, want: []int{2, 0, 2}},
+		{name: "round robin skips excluded", balance: common.BalanceRoundRobin, pending: []int{0, 0, 0}, exclude: []int{0}, want: []int{2, 1, 2}},
+		{name: "least inflight", balance: common.BalanceLeastInflight, pending: []int{2, 1, 3}, want: []int{1, 1}},
+		{name: "least inflight on a tie", balance: common.BalanceLeastInflight, pending: []int{1, 0, 0}, want: []int{1}},
+		{name: "least inflight skips excluded", balance: common.BalanceLeastInflight, pending: []int{2, 1, 3}, exclude: []int{1}, want: []int{0}},
+		{name: "none connected", balance: common.BalanceRoundRobin, pending: []int{-1, -1}, want: []int{-1}},
+		{name: "all excluded", balance: common.BalanceLeastInflight, pending: []int{0}, exclude: []int{0}, want: []int{-1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := newTunnelGroup(&common.SubdomainRequest{Group: true, GroupKey: "key", Balance: tt.balance})
+			members := make([]*Tunnel, len(tt.pending))
+			index := make(map[*Tunnel]int)
+			for i, n := range tt.pending {
+				members[i] = newTunnel("foo", domain, group)
+				index[members[i]] = i
+				if n >= 0 {
+					members[i].touch()
+				}
+				for id := 0; id < n; id++ {
+					members[i].pending[uint64(id)] = &pendingRequest{}
+				}
+			}
+			exclude := make(map[*Tunnel]bool)
+			for _, i := range tt.exclude {
+				exclude[members[i]] = true
+			}
+
+			for call, want := range tt.want {
+				tun, ok := group.pick(members, exclude)
+				got := -1
+				if ok {
+					got = index[tun]
+				}
+				if got != want {
+					t.Errorf("call %d picked %d, want %d", call, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinGroup(t *testing.T) {
+	shared := common.SubdomainRequest{Subdomain: "foo", Group: true, GroupKey: "key"}
+
+	tests := []struct {
+		name   string
+		first  common.SubdomainRequest
+		second common.SubdomainRequest
+		status int
+	}{
+		{name: "same key", first: shared, second: shared, status: http.StatusOK},
+		{
+			name:   "balance set by the first member",
+			first:  shared,
+			second: common.SubdomainRequest{Subdomain: "foo", Group: true, GroupKey: "key", Balance: common.BalanceLeastInflight},
+			status: http.StatusOK,
+		},
+		{
+			name:   "wrong key",
+			first:  shared,
+			second: common.SubdomainRequest{Subdomain: "foo", Group: true, GroupKey: "other"},
+			status: http.StatusForbidden,
+		},
+		{name: "not a member", first: shared, second: common.SubdomainRequest{Subdomain: "foo"}, status: http.StatusConflict},
+		{name: "not shared", first: common.SubdomainRequest{Subdomain: "foo"}, second: shared, status: http.StatusConflict},
+		{
+			name:   "missing key",
+			first:  common.SubdomainRequest{Subdomain: "bar"},
+			second: common.SubdomainRequest{Subdomain: "foo", Group: true},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown balance",
+			first:  common.SubdomainRequest{Subdomain: "bar"},
+			second: common.SubdomainRequest{Subdomain: "foo", Group: true, GroupKey: "key", Balance: "random"},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, &Config{})
+			defer s.Close()
+
+			if status, _ := s.requestTunnel(t, tt.first); status != http.StatusOK {
+				t.Fatalf("first tunnel request failed with status %d", status)
+			}
+			if status, _ := s.requestTunnel(t, tt.second); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if members := s.registry.Lookup("foo"); len(members) == 2 && members[1].group.balance != common.BalanceRoundRobin {
+				t.Errorf("balance = %q, want the first member's", members[1].group.balance)
+			}
+		})
+	}
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	s := startTestServer(t, &Config{})
+	defer s.Close()
+
+	sr := common.SubdomainRequest{Subdomain: "foo", Group: true, GroupKey: "key"}
+	for _, body := range []string{"a", "b"} {
+		ws := s.openTunnel(t, sr)
+		defer ws.Close()
+		go answer(ws, body)
+	}
+
+	served := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		resp := s.request(t, http.MethodGet, "foo.leap.example.com", "/", nil)
+		served[readBody(t, resp)]++
+	}
+	if served["a"] != 2 || served["b"] != 2 {
+		t.Errorf("members served %v, want 2 requests each", served)
+	}
+
+	// the remaining member takes over once the other disconnects
+	if err := s.registry.Lookup("foo")[0].closeConnection(websocket.CloseNormalClosure, "", time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(s.registry.Lookup("foo")) > 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the closed member wasn't removed")
+		}
+	}
+	served = make(map[string]int)
+	for i := 0; i < 2; i++ {
+		resp := s.request(t, http.MethodGet, "foo.leap.example.com", "/", nil)
+		served[readBody(t, resp)]++
+	}
+	if len(served) != 1 {
+		t.Errorf("members served %v, want a single member", served)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// watchHandoff hands the listeners over to a new process started from the current
+// executable on SIGUSR2, then calls stop to drain this one
+func (s *LeapServer) watchHandoff(ctx context.Context, stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			if err := s.handoff(); err != nil {
+				log.Printf("Hot restart failed: %v\n", err)
+				continue
+			}
+			stop()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handoff starts a new process with the same arguments that inherits the listeners
+func (s *LeapServer) handoff() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var fds []string
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for name, l := range s.listeners {
+		tcp, ok := l.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("%s listener is not a TCP listener", name)
+		}
+		f, err := tcp.File()
+		if err != nil {
+			return fmt.Errorf("%s listener: %w", name, err)
+		}
+		// the child sees ExtraFiles from fd 3 on
+		fds = append(fds, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenerFDsEnv+"="+strings.Join(fds, ","))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Printf("Handed listeners over to process %d\n", cmd.Process.Pid)
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestListenInherited(t *testing.T) {
+	defer os.Setenv(listenerFDsEnv, os.Getenv(listenerFDsEnv))
+
+	// the listener of the process handing over
+	previous, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer previous.Close()
+	f, err := previous.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inherited descriptors are taken over, so hand over a copy
+	fd, err := syscall.Dup(int(f.Fd()))
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Setenv(listenerFDsEnv, fmt.Sprintf("tls=%d,bind=%d", fd+100, fd))
+
+	s := New(&Config{})
+	l, err := s.listen("bind", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr().String() != previous.Addr().String() {
+		t.Errorf("listening on %s, want the inherited %s", l.Addr(), previous.Addr())
+	}
+	if s.listeners["bind"] != l {
+		t.Error("the inherited listener wasn't recorded for the next handoff")
+	}
+
+	conn, err := net.Dial("tcp", previous.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = previous.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept() on the inherited listener: %v", err)
+	}
+	_ = accepted.Close()
+
+	if _, err := s.listen("tls", "127.0.0.1:0"); err == nil {
+		t.Error("listen() succeeded with an invalid inherited descriptor")
+	}
+}
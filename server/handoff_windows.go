@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package server
+
+import (
+	"context"
+	"log"
+)
+
+// watchHandoff does nothing, as Windows has no SIGUSR2 to trigger a hot restart with
+func (s *LeapServer) watchHandoff(ctx context.Context, stop func()) {
+	log.Println("Hot restart is not supported on Windows")
+}
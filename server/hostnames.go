@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prefix of the TXT record that can verify a custom hostname instead of a CNAME
+const verifyRecordPrefix = "_leap."
+
+// Timeout for the DNS lookups that verify a custom hostname
+const verifyTimeout = time.Second * 10
+
+var errHostnameNotVerified = errors.New("hostname does not point at this server")
+
+// hostnameResolver looks up the records that verify custom hostnames. *net.Resolver
+// implements it.
+type hostnameResolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// newResolver returns a resolver that queries the DNS server at addr, or the system
+// resolver if addr is empty
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// stripPort removes the port from a request host, if any
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// verifyHostname checks that hostname points at the tunnel, either through a CNAME to
+// the tunnel's host or a TXT record on _leap.<hostname> naming it. A CNAME to the base
+// domain or another tunnel's host is not enough, as it would let any client take over
+// hostnames meant for someone else.
+func (s *LeapServer) verifyHostname(ctx context.Context, hostname string, tun *Tunnel) error {
+	host := tunnelHost(tun)
+
+	if cname, err := s.resolver.LookupCNAME(ctx, hostname); err == nil {
+		if strings.EqualFold(strings.TrimSuffix(cname, "."), host) {
+			return nil
+		}
+	}
+
+	if records, err := s.resolver.LookupTXT(ctx, verifyRecordPrefix+hostname); err == nil {
+		for _, record := range records {
+			if strings.EqualFold(strings.TrimSuffix(record, "."), host) {
+				return nil
+			}
+		}
+	}
+
+	return errHostnameNotVerified
+}
+
+// tunnelHost returns the host tun is reachable at, without a port
+func tunnelHost(tun *Tunnel) string {
+	return tun.subdomain + "." + stripPort(tun.domain)
+}
+
+// lookupHostname returns the name of the tunnels a custom hostname is bound to
+func (s *LeapServer) lookupHostname(host string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.hostnames[strings.ToLower(stripPort(host))]
+	return sub, ok
+}
+
+// unbindHostnames removes the custom hostnames bound to the tunnels registered under
+// name. s.mu must be held.
+func (s *LeapServer) unbindHostnames(name string) {
+	for hostname, bound := range s.hostnames {
+		if bound == name {
+			delete(s.hostnames, hostname)
+		}
+	}
+}
+
+// isBaseHostname reports whether hostname is a base domain or under one, which makes it
+// unusable as a custom hostname
+func (s *LeapServer) isBaseHostname(hostname string) bool {
+	for _, d := range s.conf().domains {
+		domain := stripPort(d.name)
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func readHostnameRequest(r *http.Request) (*common.HostnameRequest, error) {
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload common.HostnameRequest
+	if err = json.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+
+	payload.Hostname = strings.ToLower(strings.TrimSuffix(payload.Hostname, "."))
+	return &payload, nil
+}
+
+func (s *LeapServer) registerHostname(c *gin.Context) {
+	hr, err := readHostnameRequest(c.Request)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if hr.Hostname == "" || s.isBaseHostname(hr.Hostname) {
+		c.String(http.StatusBadRequest, "Invalid custom hostname %q", hr.Hostname)
+		return
+	}
+
+	tun, ok := s.registry.LookupToken(hr.Token)
+	if !ok {
+		c.String(http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), verifyTimeout)
+	defer cancel()
+	if err := s.verifyHostname(ctx, hr.Hostname, tun); err != nil {
+		host := tunnelHost(tun)
+		c.String(http.StatusUnprocessableEntity, "%q must have a CNAME record pointing at %s or a TXT record on %s%s containing %s",
+			hr.Hostname, host, verifyRecordPrefix, hr.Hostname, host)
+		return
+	}
+
+	// other nodes forward requests for the hostname through the cluster registry
+	if err := s.bindClusterHostname(hr.Hostname, tun); errors.Is(err, ErrHostnameBound) {
+		c.String(http.StatusConflict, "The hostname %q is already bound to another tunnel", hr.Hostname)
+		return
+	} else if err != nil {
+		log.Printf("Failed to bind %q in the cluster registry: %v\n", hr.Hostname, err)
+		c.String(http.StatusServiceUnavailable, "The cluster registry is unavailable")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.registry.LookupToken(hr.Token); !ok {
+		c.String(http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if name, ok := s.hostnames[hr.Hostname]; ok && name != tun.name {
+		c.String(http.StatusConflict, "The hostname %q is already bound to another tunnel", hr.Hostname)
+		return
+	}
+
+	s.hostnames[hr.Hostname] = tun.name
+	c.Status(http.StatusNoContent)
+}
+
+// bindClusterHostname binds hostname to the tunnels of tun's subdomain in the cluster
+// registry, if this node is part of a cluster
+func (s *LeapServer) bindClusterHostname(hostname string, tun *Tunnel) error {
+	if s.cluster == nil {
+		return nil
+	}
+	return s.cluster.registry.BindHostname(hostname, tun.name, s.cluster.node.ID, tun.group.generation)
+}
+
+func (s *LeapServer) unregisterHostname(c *gin.Context) {
+	hr, err := readHostnameRequest(c.Request)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	tun, ok := s.registry.LookupToken(hr.Token)
+	if !ok {
+		c.String(http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	s.mu.Lock()
+	if s.hostnames[hr.Hostname] == tun.name {
+		delete(s.hostnames, hr.Hostname)
+	}
+	s.mu.Unlock()
+
+	if s.cluster != nil {
+		if err := s.cluster.registry.UnbindHostname(hr.Hostname, tun.name); err != nil {
+			log.Printf("Failed to unbind %q in the cluster registry: %v\n", hr.Hostname, err)
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// isCustomHostname reports whether host is a custom hostname bound to tunnels on this
+// node or, in a cluster, on another node
+func (s *LeapServer) isCustomHostname(host string) bool {
+	if _, ok := s.lookupHostname(host); ok {
+		return true
+	}
+	if s.isBaseHostname(strings.ToLower(stripPort(host))) {
+		return false
+	}
+	_, ok := s.lookupHostnameNode(host)
+	return ok
+}
+
+// hostPolicy only allows certificates to be issued for registered custom hostnames
+func (s *LeapServer) hostPolicy(_ context.Context, host string) error {
+	if !s.isCustomHostname(host) {
+		return fmt.Errorf("hostname %q is not registered", host)
+	}
+	return nil
+}
+
+func (s *LeapServer) makeCertManager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(s.conf().CertCacheDir),
+		HostPolicy: s.hostPolicy,
+		Email:      s.conf().ACMEEmail,
+	}
+	if s.conf().ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: s.conf().ACMEDirectory}
+	}
+	return m
+}
+
+// makeTLSConfig serves the static certificate for the base domain, if configured, and
+// certificates issued on demand for custom hostnames
+func (s *LeapServer) makeTLSConfig(m *autocert.Manager) (*tls.Config, error) {
+	tlsConfig := m.TLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// the certificate is reloaded along with the configuration
+		static := s.conf().certificateFor(hello.ServerName)
+		if static == nil || s.isCustomHostname(hello.ServerName) {
+			return m.GetCertificate(hello)
+		}
+		return static, nil
+	}
+	return tlsConfig, nil
+}
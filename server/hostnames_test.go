@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeResolver answers lookups from fixed records
+type fakeResolver struct {
+	cnames map[string]string
+	txts   map[string][]string
+}
+
+func (r fakeResolver) LookupCNAME(_ context.Context, host string) (string, error) {
+	if cname, ok := r.cnames[host]; ok {
+		return cname, nil
+	}
+	return "", errors.New("no such host")
+}
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if records, ok := r.txts[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestVerifyHostname(t *testing.T) {
+	primary := &baseDomain{name: "leap.example.com:8080", primary: true}
+	other := &baseDomain{name: "leap.partners.com"}
+
+	tests := []struct {
+		name     string
+		tunnel   *Tunnel
+		cnames   map[string]string
+		txts     map[string][]string
+		verified bool
+	}{
+		{
+			name:     "cname to tunnel host",
+			tunnel:   newTunnel("foo", primary, nil),
+			cnames:   map[string]string{"app.customer.com": "foo.leap.example.com."},
+			verified: true,
+		},
+		{
+			name:     "cname in another case",
+			tunnel:   newTunnel("foo", primary, nil),
+			cnames:   map[string]string{"app.customer.com": "FOO.Leap.Example.com."},
+			verified: true,
+		},
+		{
+			name:     "cname to tunnel host on another domain",
+			tunnel:   newTunnel("foo", other, nil),
+			cnames:   map[string]string{"app.customer.com": "foo.leap.partners.com."},
+			verified: true,
+		},
+		{
+			name:   "cname to base domain",
+			tunnel: newTunnel("foo", primary, nil),
+			cnames: map[string]string{"app.customer.com": "leap.example.com."},
+		},
+		{
+			name:   "cname to another tunnel",
+			tunnel: newTunnel("foo", primary, nil),
+			cnames: map[string]string{"app.customer.com": "bar.leap.example.com."},
+		},
+		{
+			name:   "cname to same subdomain on another domain",
+			tunnel: newTunnel("foo", primary, nil),
+			cnames: map[string]string{"app.customer.com": "foo.leap.partners.com."},
+		},
+		{
+			name:   "cname ending in tunnel host",
+			tunnel: newTunnel("foo", primary, nil),
+			cnames: map[string]string{"app.customer.com": "evilfoo.leap.example.com."},
+		},
+		{
+			name:   "cname to itself",
+			tunnel: newTunnel("foo", primary, nil),
+			cnames: map[string]string{"app.customer.com": "app.customer.com."},
+		},
+		{
+			name:     "txt naming tunnel host",
+			tunnel:   newTunnel("foo", primary, nil),
+			txts:     map[string][]string{"_leap.app.customer.com": {"v=spf1 -all", "foo.leap.example.com"}},
+			verified: true,
+		},
+		{
+			name:   "txt naming another tunnel",
+			tunnel: newTunnel("foo", primary, nil),
+			txts:   map[string][]string{"_leap.app.customer.com": {"bar.leap.example.com"}},
+		},
+		{
+			name:   "txt on the hostname itself",
+			tunnel: newTunnel("foo", primary, nil),
+			txts:   map[string][]string{"app.customer.com": {"foo.leap.example.com"}},
+		},
+		{
+			name:   "no records",
+			tunnel: newTunnel("foo", primary, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LeapServer{resolver: fakeResolver{cnames: tt.cnames, txts: tt.txts}}
+			err := s.verifyHostname(context.Background(), "app.customer.com", tt.tunnel)
+			if tt.verified && err != nil {
+				t.Errorf("verifyHostname() = %v, want nil", err)
+			}
+			if !tt.verified && !errors.Is(err, errHostnameNotVerified) {
+				t.Errorf("verifyHostname() = %v, want %v", err, errHostnameNotVerified)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Page is a page the server shows visitors instead of a tunnel's response
+type Page string
+
+const (
+	PageLanding          Page = "landing"
+	PageUnknownTunnel    Page = "unknown_tunnel"
+	PageTunnelOffline    Page = "tunnel_offline"
+	PageLocalUnavailable Page = "local_unavailable"
+	PageTimeout          Page = "timeout"
+	PageRateLimited      Page = "rate_limited"
+	PageError            Page = "error"
+)
+
+// Default titles and messages of the pages, which templates get as .Title and .Message
+var pageTexts = map[Page][2]string{
+	PageLanding:          {"Leap", "This is a leap server. Tunnels are served on its subdomains."},
+	PageUnknownTunnel:    {"Tunnel not found", "There is no tunnel at this address. The link may be out of date."},
+	PageTunnelOffline:    {"Tunnel offline", "The tunnel at this address is not connected right now. Try again later."},
+	PageLocalUnavailable: {"Service unavailable", "The tunnel is connected, but the service behind it is not running."},
+	PageTimeout:          {"Timed out", "The service behind the tunnel took too long to respond."},
+	PageRateLimited:      {"Limit reached", "The tunnel has used up its bandwidth quota."},
+	PageError:            {"Something went wrong", "An error occurred while passing the request through the tunnel."},
+}
+
+const defaultPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; background: #f6f7f9; color: #222; margin: 0; }
+main { max-width: 36rem; margin: 15vh auto; padding: 0 1.5rem; }
+h1 { font-size: 1.6rem; margin-bottom: .5rem; }
+.status { color: #888; font-weight: normal; }
+footer { margin-top: 2rem; color: #888; font-size: .85rem; }
+code { font-size: .85rem; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}{{if ge .Status 400}} <span class="status">{{.Status}}</span>{{end}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<footer>{{.Host}} &middot; Request ID <code>{{.RequestID}}</code></footer>{{end}}
+</main>
+</body>
+</html>
+`
+
+// pageData is what page templates are executed with
+type pageData struct {
+	Page       Page
+	Status     int
+	StatusText string
+	Title      string
+	Message    string
+	Host       string
+	Domain     string
+	RequestID  string
+}
+
+// loadPages parses the page templates. A file named after a page in dir, like
+// tunnel_offline.html, replaces its default template.
+func loadPages(dir string) (map[Page]*template.Template, error) {
+	defaultTemplate := template.Must(template.New("page").Parse(defaultPageTemplate))
+
+	pages := make(map[Page]*template.Template, len(pageTexts))
+	for page := range pageTexts {
+		pages[page] = defaultTemplate
+		if dir == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, string(page)+".html")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("page template: %w", err)
+		}
+		pages[page] = t
+	}
+	return pages, nil
+}
+
+// showPage answers a request with a page, as JSON for clients that prefer it and as
+// plain text for those that accept neither JSON nor HTML. An empty message stands for
+// the page's default one.
+func (s *LeapServer) showPage(c *gin.Context, page Page, status int, message string) {
+	data := pageData{
+		Page:       page,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Title:      pageTexts[page][0],
+		Message:    pageTexts[page][1],
+		Host:       c.Request.Host,
+		Domain:     s.conf().domainFor(c.Request.Host).name,
+		RequestID:  c.GetString(requestIDKey),
+	}
+	if message != "" {
+		data.Message = message
+	}
+	if data.RequestID != "" {
+		c.Header(requestIDHeader, data.RequestID)
+	}
+
+	accept := strings.ToLower(c.GetHeader("Accept"))
+	switch {
+	case strings.Contains(accept, "json") && !strings.Contains(accept, "text/html"):
+		body := gin.H{
+			"message":    data.Message,
+			"status":     status,
+			"request_id": data.RequestID,
+		}
+		if status >= 400 {
+			body["error"] = page
+		}
+		c.JSON(status, body)
+	case strings.Contains(accept, "text/html"):
+		c.Status(status)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		if err := s.conf().pages[page].Execute(c.Writer, data); err != nil {
+			_ = c.Error(fmt.Errorf("render page %s: %w", page, err))
+		}
+	default:
+		text := data.Message + "\n"
+		if data.RequestID != "" {
+			text += "Request ID: " + data.RequestID + "\n"
+		}
+		c.String(status, text)
+	}
+}
+
+// requestIDKey is the key of a public request's ID in its gin context
+const requestIDKey = "leap.request_id"
+
+// requestIDHeader carries the ID of a public request to the tunnel, to nodes of the
+// cluster and back in error pages
+const requestIDHeader = "X-Leap-Request-Id"
+
+// assignRequestID gives a public request an ID, keeping the one chosen by the node that
+// forwarded it, if trusted
+func assignRequestID(c *gin.Context, trusted bool) {
+	id := c.GetHeader(requestIDHeader)
+	if !trusted || id == "" {
+		id = generateToken(20)
+		c.Request.Header.Set(requestIDHeader, id)
+	}
+	c.Set(requestIDKey, id)
+}
+
+func (s *LeapServer) getLanding(c *gin.Context) {
+	s.showPage(c, PageLanding, http.StatusOK, "")
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"github.com/dnsge/leap/common"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShowPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	custom := "{{.Title}} at {{.Host}} on {{.Domain}}, {{.Status}} {{.StatusText}}: {{.Message}} ({{.RequestID}})"
+	if err := ioutil.WriteFile(filepath.Join(dir, "unknown_tunnel.html"), []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		pagesDir string
+		host     string
+		accept   string
+		status   int
+		// the body with the request ID in place of {id}
+		body        string
+		contentType string
+	}{
+		{
+			name:        "json",
+			host:        "bar.leap.example.com",
+			accept:      "application/json",
+			status:      http.StatusNotFound,
+			body:        `{"error":"unknown_tunnel","message":"There is no tunnel at this address. The link may be out of date.","request_id":"{id}","status":404}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "plain text",
+			host:        "bar.leap.example.com",
+			status:      http.StatusNotFound,
+			body:        "There is no tunnel at this address. The link may be out of date.\nRequest ID: {id}\n",
+			contentType: "text/plain",
+		},
+		{
+			name:        "html preferred to json",
+			host:        "bar.leap.example.com",
+			accept:      "text/html,application/json;q=0.9",
+			status:      http.StatusNotFound,
+			contentType: "text/html",
+		},
+		{
+			name:        "custom template",
+			pagesDir:    dir,
+			host:        "bar.leap.example.com",
+			accept:      "text/html",
+			status:      http.StatusNotFound,
+			body:        "Tunnel not found at bar.leap.example.com on leap.example.com, 404 Not Found: There is no tunnel at this address. The link may be out of date. ({id})",
+			contentType: "text/html",
+		},
+		{
+			name:        "landing",
+			pagesDir:    dir,
+			host:        "leap.example.com",
+			accept:      "application/json",
+			status:      http.StatusOK,
+			body:        `{"message":"This is a leap server. Tunnels are served on its subdomains.","request_id":"","status":200}`,
+			contentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, &Config{PagesDir: tt.pagesDir})
+			defer s.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, "http://"+s.addr+"/", nil)
+			req.Host = tt.host
+			req.Header.Set(requestIDHeader, "chosen-by-the-visitor")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := readBody(t, resp)
+
+			id := resp.Header.Get(requestIDHeader)
+			if tt.host != "leap.example.com" && (id == "" || id == "chosen-by-the-visitor") {
+				t.Errorf("request ID = %q, want one chosen by the server", id)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if !strings.HasPrefix(resp.Header.Get("Content-Type"), tt.contentType) {
+				t.Errorf("content type = %q, want %s", resp.Header.Get("Content-Type"), tt.contentType)
+			}
+			if tt.body == "" {
+				if !strings.Contains(body, "<title>Tunnel not found</title>") || !strings.Contains(body, id) {
+					t.Errorf("body = %q, want the default page with the request ID", body)
+				}
+			} else if want := strings.ReplaceAll(tt.body, "{id}", id); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestRequestIDPassedToTunnel(t *testing.T) {
+	s := startTestServer(t, &Config{})
+	defer s.Close()
+	ws := s.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+	defer ws.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.addr+"/", nil)
+	req.Host = "foo.leap.example.com"
+	req.Header.Set(requestIDHeader, "chosen-by-the-visitor")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	request := readRequest(t, ws)
+	raw, err := request.DecodeRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	respond(t, ws, request.ID, "HTTP/1.1 204 No Content\r\n\r\n")
+	<-done
+
+	var id string
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if strings.HasPrefix(line, requestIDHeader+": ") {
+			id = strings.TrimPrefix(line, requestIDHeader+": ")
+		}
+	}
+	if id == "" || id == "chosen-by-the-visitor" {
+		t.Errorf("request ID passed to the tunnel = %q, want one chosen by the server", id)
+	}
+}
+
+func TestLoadPagesError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leap-pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "timeout.html"), []byte("{{.Title"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadPages(dir); err == nil {
+		t.Error("loadPages() succeeded with a malformed template")
+	}
+}
@@ -1,63 +1,125 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/dnsge/leap/common"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func passExternalRequest(c *gin.Context, tun *Tunnel) error {
-	// lock the tunnel to preserve request/response ordering
-	tun.mu.Lock()
-	defer tun.mu.Unlock()
+// errSendFailed means the request never reached the client, so it is safe to retry
+var errSendFailed = errors.New("failed to send request through tunnel")
+
+// passExternalRequest sends a public request through tun and writes its response,
+// returning the status code the request was answered with
+func (s *LeapServer) passExternalRequest(c *gin.Context, tun *Tunnel) (int, error) {
+	if tun.limits.quotaExceeded(tun.name) {
+		s.showPage(c, PageRateLimited, http.StatusTooManyRequests, "")
+		return http.StatusTooManyRequests, nil
+	}
 
 	c.Request.Header.Set("Connection", "close")
 	rawRequest, err := httputil.DumpRequest(c.Request, true)
 	if err != nil {
-		return fmt.Errorf("dump request: %w", err)
+		return 0, fmt.Errorf("dump request: %w", err)
+	}
+	if len(rawRequest) > common.MaxPayloadSize {
+		// the client would drop the connection rather than read it
+		s.showPage(c, PageError, http.StatusRequestEntityTooLarge, "The request is too large to pass through the tunnel.")
+		return http.StatusRequestEntityTooLarge, nil
+	}
+	if err := tun.limits.throttle(c.Request.Context(), len(rawRequest)); err != nil {
+		return 0, nil
+	}
+
+	id, pending, err := tun.sendRawRequest(rawRequest)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errSendFailed, err)
 	}
+	defer tun.finishRequest(id)
+	tun.limits.account(tun.name, len(rawRequest), 0)
 
-	if err := tun.sendRawRequest(rawRequest); err != nil {
-		return fmt.Errorf("sendRawRequest: %w", err)
+	var timeoutChan <-chan time.Time
+	if timeout := s.conf().RequestTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
 	}
 
 	select {
-	case respMsg := <-tun.responseChan:
-		return proxyResponse(c, respMsg)
-	case errMsg := <-tun.errorChan:
-		handleError(c, errMsg)
-		return nil
+	case respMsg := <-pending.responseChan:
+		return s.proxyResponse(c, tun, respMsg)
+	case errMsg := <-pending.errorChan:
+		s.handleError(c, errMsg)
+		return c.Writer.Status(), nil
+	case <-timeoutChan:
+		s.showPage(c, PageTimeout, http.StatusGatewayTimeout, "The tunnel took too long to respond.")
+		if err := tun.cancelRequest(id); err != nil {
+			return http.StatusGatewayTimeout, fmt.Errorf("cancel timed out request: %w", err)
+		}
+		return http.StatusGatewayTimeout, nil
+	case <-c.Request.Context().Done():
+		if err := tun.cancelRequest(id); err != nil {
+			return 0, fmt.Errorf("cancel abandoned request: %w", err)
+		}
+		return 0, nil
 	}
 }
 
-func proxyResponse(c *gin.Context, resp *common.ResponseDataMessage) error {
+func (s *LeapServer) proxyResponse(c *gin.Context, tun *Tunnel, resp *common.ResponseDataMessage) (int, error) {
 	decodedBytes, err := resp.DecodeResponse()
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Bad encoding: %v", err)
-		return fmt.Errorf("readRawResponse: %w", err)
+		s.showPage(c, PageError, http.StatusInternalServerError, "")
+		return http.StatusInternalServerError, fmt.Errorf("readRawResponse: %w", err)
+	}
+	tun.compression.Add(decodedBytes, resp.Response)
+	if err := tun.limits.throttle(c.Request.Context(), len(decodedBytes)); err != nil {
+		return 0, nil
 	}
+	tun.limits.account(tun.name, 0, len(decodedBytes))
 
 	conn, buffer, err := c.Writer.Hijack()
 	if err != nil {
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
-		return fmt.Errorf("hijack: %w", err)
+		return http.StatusInternalServerError, fmt.Errorf("hijack: %w", err)
 	}
 
 	_, _ = buffer.Write(decodedBytes)
 	_ = buffer.Flush()
 	_ = conn.Close()
-	return nil
+	return rawResponseStatus(decodedBytes), nil
+}
+
+// rawResponseStatus reads the status code from the status line of a raw response, or
+// returns zero if it is malformed
+func rawResponseStatus(raw []byte) int {
+	line := raw
+	if i := bytes.IndexByte(raw, '\n'); i != -1 {
+		line = raw[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return 0
+	}
+	status, _ := strconv.Atoi(fields[1])
+	return status
 }
 
-func handleError(c *gin.Context, e *common.ResponseErrorMessage) {
+func (s *LeapServer) handleError(c *gin.Context, e *common.ResponseErrorMessage) {
 	switch e.Code {
 	case common.Unavailable:
-		c.String(http.StatusServiceUnavailable, "Failed to connect to local service")
+		s.showPage(c, PageLocalUnavailable, http.StatusServiceUnavailable, "")
 	case common.InternalError:
-		c.String(http.StatusInternalServerError, "An internal error occurred while proxying the request")
+		s.showPage(c, PageError, http.StatusInternalServerError, "")
 	case common.Timeout:
-		c.String(http.StatusGatewayTimeout, "The local service took too long to respond")
+		s.showPage(c, PageTimeout, http.StatusGatewayTimeout, "")
+	case common.PayloadTooLarge:
+		s.showPage(c, PageError, http.StatusBadGateway, "The response of the service behind the tunnel exceeded the size limit.")
 	}
 }
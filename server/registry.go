@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrDuplicateToken = errors.New("a tunnel with this token already exists")
+
+// TunnelRegistry stores the tunnels of a LeapServer. Implementations must be safe for
+// concurrent use. Wrapping the default registry is a convenient way to observe tunnels
+// being created and removed.
+type TunnelRegistry interface {
+	// Create adds a newly issued tunnel
+	Create(tun *Tunnel) error
+	// Lookup returns the tunnels registered under name (see Tunnel.Name). There is more
+	// than one only for shared subdomains.
+	Lookup(name string) []*Tunnel
+	// LookupToken returns the tunnel the token was issued for
+	LookupToken(token string) (*Tunnel, bool)
+	// Remove deletes tun, reporting whether it was present
+	Remove(tun *Tunnel) bool
+	// List returns every tunnel
+	List() []*Tunnel
+}
+
+type memoryTunnelRegistry struct {
+	mu      sync.RWMutex
+	byName  map[string][]*Tunnel
+	byToken map[string]*Tunnel
+}
+
+// NewMemoryTunnelRegistry returns the default registry, which keeps tunnels in process memory
+func NewMemoryTunnelRegistry() TunnelRegistry {
+	return &memoryTunnelRegistry{
+		byName:  make(map[string][]*Tunnel),
+		byToken: make(map[string]*Tunnel),
+	}
+}
+
+func (m *memoryTunnelRegistry) Create(tun *Tunnel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.byToken[tun.token]; ok {
+		return ErrDuplicateToken
+	}
+	m.byToken[tun.token] = tun
+	m.byName[tun.name] = append(m.byName[tun.name], tun)
+	return nil
+}
+
+func (m *memoryTunnelRegistry) Lookup(name string) []*Tunnel {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnels := m.byName[name]
+	return append([]*Tunnel(nil), tunnels...)
+}
+
+func (m *memoryTunnelRegistry) LookupToken(token string) (*Tunnel, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tun, ok := m.byToken[token]
+	return tun, ok
+}
+
+func (m *memoryTunnelRegistry) Remove(tun *Tunnel) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.byToken[tun.token] != tun {
+		return false
+	}
+	delete(m.byToken, tun.token)
+
+	tunnels := m.byName[tun.name]
+	for i, t := range tunnels {
+		if t == tun {
+			tunnels = append(tunnels[:i], tunnels[i+1:]...)
+			break
+		}
+	}
+	if len(tunnels) == 0 {
+		delete(m.byName, tun.name)
+	} else {
+		m.byName[tun.name] = tunnels
+	}
+	return true
+}
+
+func (m *memoryTunnelRegistry) List() []*Tunnel {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnels := make([]*Tunnel, 0, len(m.byToken))
+	for _, tun := range m.byToken {
+		tunnels = append(tunnels, tun)
+	}
+	return tunnels
+}
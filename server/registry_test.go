@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/dnsge/leap/common"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryTunnelRegistry(t *testing.T) {
+	domain := &baseDomain{name: "leap.example.com", primary: true}
+	group := newTunnelGroup(&common.SubdomainRequest{Group: true, GroupKey: "key"})
+	foo1 := newTunnel("foo", domain, group)
+	foo2 := newTunnel("foo", domain, group)
+	bar := newTunnel("bar", domain, newTunnelGroup(&common.SubdomainRequest{}))
+
+	r := NewMemoryTunnelRegistry()
+	for _, tun := range []*Tunnel{foo1, foo2, bar} {
+		if err := r.Create(tun); err != nil {
+			t.Fatalf("Create(%s) error: %v", tun.name, err)
+		}
+	}
+	duplicate := newTunnel("baz", domain, group)
+	duplicate.token = foo1.token
+	if err := r.Create(duplicate); err != ErrDuplicateToken {
+		t.Errorf("Create() with a used token = %v, want %v", err, ErrDuplicateToken)
+	}
+
+	members := r.Lookup("foo")
+	if len(members) != 2 || members[0] != foo1 || members[1] != foo2 {
+		t.Errorf("Lookup(foo) = %v, want both members in order", members)
+	}
+	members[0] = bar
+	if r.Lookup("foo")[0] != foo1 {
+		t.Error("modifying the result of Lookup changed the registry")
+	}
+	if members := r.Lookup("baz"); len(members) != 0 {
+		t.Errorf("Lookup(baz) = %v, want none", members)
+	}
+	if tun, ok := r.LookupToken(bar.token); !ok || tun != bar {
+		t.Errorf("LookupToken() = %v, %t, want bar", tun, ok)
+	}
+
+	if !r.Remove(foo1) {
+		t.Error("Remove(foo1) = false, want true")
+	}
+	if r.Remove(foo1) {
+		t.Error("second Remove(foo1) = true, want false")
+	}
+	if r.Remove(duplicate) {
+		t.Error("Remove() of a tunnel never created = true, want false")
+	}
+	if members := r.Lookup("foo"); len(members) != 1 || members[0] != foo2 {
+		t.Errorf("Lookup(foo) = %v, want foo2", members)
+	}
+	if _, ok := r.LookupToken(foo1.token); ok {
+		t.Error("the token of a removed tunnel is still registered")
+	}
+
+	var names []string
+	for _, tun := range r.List() {
+		names = append(names, tun.name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "bar" || names[1] != "foo" {
+		t.Errorf("List() = %v, want bar and foo", names)
+	}
+}
+
+// observedRegistry records the tunnels created and removed in the registry it wraps
+type observedRegistry struct {
+	TunnelRegistry
+
+	mu      sync.Mutex
+	created []string
+	removed []string
+}
+
+func (r *observedRegistry) Create(tun *Tunnel) error {
+	r.mu.Lock()
+	r.created = append(r.created, tun.Name())
+	r.mu.Unlock()
+	return r.TunnelRegistry.Create(tun)
+}
+
+func (r *observedRegistry) Remove(tun *Tunnel) bool {
+	r.mu.Lock()
+	r.removed = append(r.removed, tun.Name())
+	r.mu.Unlock()
+	return r.TunnelRegistry.Remove(tun)
+}
+
+func TestConfigRegistry(t *testing.T) {
+	registry := &observedRegistry{TunnelRegistry: NewMemoryTunnelRegistry()}
+	s := startTestServer(t, &Config{Registry: registry})
+	defer s.Close()
+
+	ws := s.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+	go answer(ws, "ok")
+	resp := s.request(t, http.MethodGet, "foo.leap.example.com", "/", nil)
+	if body := readBody(t, resp); body != "ok" {
+		t.Errorf("body = %q, want ok", body)
+	}
+	_ = ws.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(s.registry.Lookup("foo")) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the closed tunnel wasn't removed")
+		}
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if !reflect.DeepEqual(registry.created, []string{"foo"}) || !reflect.DeepEqual(registry.removed, []string{"foo"}) {
+		t.Errorf("created %v and removed %v, want foo", registry.created, registry.removed)
+	}
+}
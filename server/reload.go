@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// liveConfig is the configuration in effect along with what is derived from it. It is
+// replaced as a whole when the configuration is reloaded.
+type liveConfig struct {
+	*Config
+	// the primary domain first
+	domains  []*baseDomain
+	reserved map[string]bool
+	pages    map[Page]*template.Template
+}
+
+// newLiveConfig validates config and prepares it for use
+func newLiveConfig(config *Config) (*liveConfig, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	live := &liveConfig{
+		Config:   config,
+		reserved: make(map[string]bool, len(config.Reserved)),
+	}
+	for _, name := range config.Reserved {
+		live.reserved[name] = true
+	}
+
+	primary, err := newBaseDomain(config.Domain, true, config.TunnelQuota, config.TunnelBandwidth, config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	live.domains = []*baseDomain{primary}
+	for _, dc := range config.Domains {
+		d, err := newBaseDomain(dc.Name, false, dc.TunnelQuota, dc.TunnelBandwidth, dc.TLSCertFile, dc.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		live.domains = append(live.domains, d)
+	}
+	for i := range config.APIKeys {
+		key := &config.APIKeys[i]
+		d := primary
+		if key.Domain != "" {
+			d, _ = live.domain(key.Domain)
+		}
+		d.apiKeys[key.Key] = key
+	}
+
+	pages, err := loadPages(config.PagesDir)
+	if err != nil {
+		return nil, err
+	}
+	live.pages = pages
+	return live, nil
+}
+
+// conf returns the configuration in effect
+func (s *LeapServer) conf() *liveConfig {
+	return s.config.Load().(*liveConfig)
+}
+
+// restartOnly are the settings that are only read at startup. Changes to them are
+// reported on reload but take effect once the server is restarted.
+var restartOnly = []string{
+	"Domain", "Bind", "TLSBind", "ClusterBind", "ClusterAdvertise", "ClusterSecret",
+	"ClusterRegistry", "NodeID", "CertCacheDir", "ACMEEmail", "ACMEDirectory",
+	"QuotaPeriod", "HotRestart", "Resolver", "WebhookURL", "WebhookSecret",
+}
+
+// secretSettings are left out of the changes logged on reload
+var secretSettings = map[string]bool{
+	"AdminToken":    true,
+	"ClusterSecret": true,
+	"WebhookSecret": true,
+}
+
+// watchReload reloads the configuration file on SIGHUP
+func (s *LeapServer) watchReload(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			if err := s.reload(); err != nil {
+				log.Printf("Keeping the current configuration: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload rereads the configuration file and applies it if it is valid. Tunnels stay
+// connected, keeping the limits they were opened with.
+func (s *LeapServer) reload() error {
+	current := s.conf()
+	next, err := LoadConfigFile(current.ConfigFile, current.base)
+	if err != nil {
+		return err
+	}
+	if err := next.validate(); err != nil {
+		return err
+	}
+
+	cur, nxt := reflect.ValueOf(current.Config).Elem(), reflect.ValueOf(next).Elem()
+	for _, name := range restartOnly {
+		if !reflect.DeepEqual(cur.FieldByName(name).Interface(), nxt.FieldByName(name).Interface()) {
+			log.Printf("%s changed, restart the server to apply it\n", name)
+			nxt.FieldByName(name).Set(cur.FieldByName(name))
+		}
+	}
+
+	live, err := newLiveConfig(next)
+	if err != nil {
+		return err
+	}
+	if err := s.openLog(next.LogFile); err != nil {
+		return err
+	}
+	s.config.Store(live)
+	setGinMode(next.Debug)
+
+	changes := diffConfig(current.Config, next)
+	if len(changes) == 0 {
+		log.Println("Reloaded the configuration, nothing changed")
+		return nil
+	}
+	log.Printf("Reloaded the configuration: %s\n", strings.Join(changes, ", "))
+	return nil
+}
+
+// diffConfig describes the settings that differ between two configurations
+func diffConfig(a, b *Config) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var changes []string
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		if field.PkgPath != "" || field.Name == "Registry" || field.Name == "Hooks" {
+			continue
+		}
+		before, after := va.Field(i).Interface(), vb.Field(i).Interface()
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+
+		switch {
+		case secretSettings[field.Name]:
+			changes = append(changes, field.Name+" changed")
+		case field.Name == "APIKeys":
+			changes = append(changes, fmt.Sprintf("APIKeys %s -> %s", describeKeys(a.APIKeys), describeKeys(b.APIKeys)))
+		case field.Name == "Domains":
+			changes = append(changes, fmt.Sprintf("Domains %s -> %s", describeDomains(a.Domains), describeDomains(b.Domains)))
+		default:
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", field.Name, before, after))
+		}
+	}
+	return changes
+}
+
+// describeKeys lists API keys by name, without the keys themselves
+func describeKeys(keys []APIKey) string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name
+		if k.Domain != "" {
+			names[i] += "@" + k.Domain
+		}
+		if k.Quota > 0 {
+			names[i] += fmt.Sprintf("(quota %d)", k.Quota)
+		}
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// describeDomains lists domains by name along with their limits
+func describeDomains(domains []DomainConfig) string {
+	names := make([]string, len(domains))
+	for i, d := range domains {
+		names[i] = d.Name
+		if d.TunnelQuota > 0 || d.TunnelBandwidth > 0 {
+			names[i] += fmt.Sprintf("(quota %d, bandwidth %d)", d.TunnelQuota, d.TunnelBandwidth)
+		}
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// openLog sends the log to the file at path, or to stderr if path is empty. The previous
+// file is closed, so reopening the same path picks up a rotated log.
+func (s *LeapServer) openLog(path string) error {
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return fmt.Errorf("open log: %w", err)
+		}
+		log.SetOutput(f)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+
+	if s.logFile != nil {
+		_ = s.logFile.Close()
+	}
+	s.logFile = f
+	return nil
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dnsge/leap/common"
 	"github.com/gin-gonic/gin"
@@ -10,101 +11,312 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// How often expired and idle tunnels are checked for
+const reapInterval = time.Second * 5
+
+// How many random subdomains are tried before giving up when they are claimed elsewhere
+const maxClaimAttempts = 10
+
 type LeapServer struct {
-	config  *Config
-	mu      sync.Mutex
-	tunnels map[string]*Tunnel
-	ctx     context.Context
+	// the configuration in effect, a *liveConfig. See conf.
+	config    atomic.Value
+	logFile   *os.File
+	mu        sync.Mutex
+	registry  TunnelRegistry
+	hostnames map[string]string // custom hostname -> subdomain
+	resolver  hostnameResolver
+	cluster   *cluster
+	hooks     []Hook
+	usage     *usageTracker
+	// payloads of every tunnel
+	compression common.CompressionStats
+	ctx         context.Context
+
+	listeners map[string]net.Listener // by name, for handing them over
+	// public requests being served. Accessed atomically.
+	inflight int64
+	// set to 1 once shutting down. Accessed atomically.
+	draining int32
 }
 
 func New(config *Config) *LeapServer {
-	return &LeapServer{
-		config:  config,
-		tunnels: make(map[string]*Tunnel),
-		ctx:     context.Background(),
+	registry := config.Registry
+	if registry == nil {
+		registry = NewMemoryTunnelRegistry()
+	}
+
+	hooks := config.Hooks
+	if config.WebhookURL != "" {
+		hooks = append(hooks, NewWebhookHook(config.WebhookURL, config.WebhookSecret))
+	}
+
+	period := config.QuotaPeriod
+	if period == "" {
+		period = QuotaMonthly
 	}
+
+	s := &LeapServer{
+		usage:     newUsageTracker(period),
+		registry:  registry,
+		hostnames: make(map[string]string),
+		resolver:  newResolver(config.Resolver),
+		cluster:   newCluster(config),
+		hooks:     hooks,
+		ctx:       context.Background(),
+		listeners: make(map[string]net.Listener),
+	}
+	// completed by Run, which reports invalid configurations
+	s.config.Store(&liveConfig{Config: config})
+	return s
 }
 
-func (s *LeapServer) makeServer() *http.Server {
-	if s.config.Debug {
+// setGinMode puts gin in debug mode if debug is set, or in release mode
+func setGinMode(debug bool) {
+	if debug {
 		gin.SetMode(gin.DebugMode)
 	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
+}
+
+func (s *LeapServer) makeServer() ([]*http.Server, error) {
+	setGinMode(s.conf().Debug)
 
 	r := gin.New()
 	r.Use(gin.Recovery())
 
 	r.Use(s.interceptRequest)
+	r.GET("/", s.getLanding)
 	r.GET("/api/status", s.getStatus)
 	r.POST("/api/tunnel", s.newTunnelRequest)
 	r.GET("/api/connect", s.connectTunnel)
+	r.POST("/api/hostname", s.registerHostname)
+	r.DELETE("/api/hostname", s.unregisterHostname)
+	admin := r.Group("/api/admin", s.requireAdminToken)
+	admin.GET("/usage", s.getUsage)
+
+	certManager := s.makeCertManager()
+	// answer HTTP-01 challenges for custom hostnames on the plain listener
+	handler := certManager.HTTPHandler(r)
 
-	server := &http.Server{Addr: s.config.Bind}
+	l, err := s.listen("bind", s.conf().Bind)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
 	go func() {
 		log.Println("Starting leap server")
-		if err := http.ListenAndServe(s.config.Bind, r); err != http.ErrServerClosed {
+		if err := server.Serve(l); err != http.ErrServerClosed {
 			log.Fatalf("listen: %v", err)
 		}
 	}()
 
-	return server
+	servers := []*http.Server{server}
+	if s.cluster != nil {
+		clusterServer, err := s.makeClusterServer()
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, clusterServer)
+	}
+
+	if s.conf().TLSBind == "" {
+		return servers, nil
+	}
+
+	tlsConfig, err := s.makeTLSConfig(certManager)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsListener, err := s.listen("tls", s.conf().TLSBind)
+	if err != nil {
+		return nil, err
+	}
+	tlsServer := &http.Server{Handler: r, TLSConfig: tlsConfig}
+	go func() {
+		log.Println("Starting leap TLS server")
+		if err := tlsServer.ServeTLS(tlsListener, "", ""); err != http.ErrServerClosed {
+			log.Fatalf("listen tls: %v", err)
+		}
+	}()
+
+	return append(servers, tlsServer), nil
 }
 
 func (s *LeapServer) Run(ctx context.Context) error {
 	s.ctx = ctx
-	server := s.makeServer()
+	if s.cluster != nil && s.cluster.secret == "" {
+		return errors.New("a cluster secret is required to join a cluster")
+	}
 
-	<-ctx.Done() // wait for interrupt
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	live, err := newLiveConfig(s.conf().Config)
+	if err != nil {
+		return err
+	}
+	s.config.Store(live)
+	if err := s.openLog(live.LogFile); err != nil {
+		return err
+	}
 
-	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "closing")
-	for _, tun := range s.tunnels {
-		if tun.ws != nil {
-			expire := time.Now().Add(time.Millisecond * 500)
-			_ = tun.ws.WriteControl(websocket.CloseMessage, closeMessage, expire)
-		}
+	servers, err := s.makeServer()
+	if err != nil {
+		return err
 	}
 
-	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go s.reapTunnels(ctx)
+	if s.cluster != nil {
+		go s.maintainClaims(ctx)
+	}
+	if s.conf().HotRestart {
+		go s.watchHandoff(ctx, stop)
+	}
+	if s.conf().ConfigFile != "" {
+		go s.watchReload(ctx)
+	}
 
-	return server.Shutdown(timeout)
+	<-ctx.Done() // wait for interrupt or a hot restart
+	return s.drain(servers)
 }
 
 func (s *LeapServer) interceptRequest(c *gin.Context) {
-	if c.Request.Host == s.config.Domain { // request to base domain (API request)
+	if _, ok := s.conf().domain(c.Request.Host); ok { // request to a base domain (API request)
 		c.Next()
 	} else {
 		c.Abort() // prevent other handlers from being called
-		if strings.HasSuffix(c.Request.Host, s.config.Domain) {
-			subdomain := strings.Split(c.Request.Host, ".")[0]
-			if tun, ok := s.tunnels[subdomain]; ok {
-				err := passExternalRequest(c, tun)
-				if err != nil {
-					log.Println("external error:", err)
-				}
+		s.serveTunnelRequest(c, true)
+	}
+}
+
+// serveTunnelRequest passes a public request to the tunnel its host points at. If the
+// tunnel is held by another node in the cluster, the request is forwarded there unless
+// allowForward is false.
+func (s *LeapServer) serveTunnelRequest(c *gin.Context, allowForward bool) {
+	// requests are only forwarded once, so those that can't be come from another node
+	assignRequestID(c, !allowForward)
+
+	name, ok := s.lookupHostname(c.Request.Host)
+	if !ok {
+		var subdomain string
+		var domain *baseDomain
+		if subdomain, domain, ok = s.conf().splitHost(c.Request.Host); ok {
+			name = domain.tunnelName(subdomain)
+		}
+	}
+	if ok {
+		if len(s.registry.Lookup(name)) > 0 {
+			s.proxyToGroup(c, name)
+			return
+		}
+		if allowForward {
+			if node, ok := s.lookupNode(name); ok {
+				s.forwardToNode(c, node)
 				return
 			}
 		}
-		c.Status(http.StatusNotFound)
+	} else if allowForward {
+		// a custom hostname bound on another node
+		if node, ok := s.lookupHostnameNode(c.Request.Host); ok {
+			s.forwardToNode(c, node)
+			return
+		}
+	}
+	s.showPage(c, PageUnknownTunnel, http.StatusNotFound, "")
+}
+
+// pickTunnel chooses the tunnel registered under name that should serve a request
+func (s *LeapServer) pickTunnel(name string, exclude map[*Tunnel]bool) (*Tunnel, bool) {
+	members := s.registry.Lookup(name)
+	if len(members) == 0 {
+		return nil, false
+	}
+	return members[0].group.pick(members, exclude)
+}
+
+// proxyToGroup passes a public request to a tunnel registered under name, failing over
+// to another member of a shared group if the request could not be sent
+func (s *LeapServer) proxyToGroup(c *gin.Context, name string) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	start := time.Now()
+	info := &RequestInfo{
+		Method:     c.Request.Method,
+		Host:       c.Request.Host,
+		Path:       c.Request.URL.Path,
+		RemoteAddr: c.Request.RemoteAddr,
+		ID:         c.GetString(requestIDKey),
+	}
+	event := Event{Type: RequestCompleted, Subdomain: name, Request: info}
+	defer func() {
+		info.Duration = time.Since(start)
+		s.emit(event)
+	}()
+
+	failed := make(map[*Tunnel]bool)
+	for {
+		tun, ok := s.pickTunnel(name, failed)
+		if !ok {
+			s.showPage(c, PageTunnelOffline, http.StatusServiceUnavailable, "")
+			info.Status = http.StatusServiceUnavailable
+			return
+		}
+		event.Subdomain, event.Domain = tun.subdomain, tun.domain
+
+		status, err := s.passExternalRequest(c, tun)
+		if errors.Is(err, errSendFailed) {
+			failed[tun] = true
+			continue
+		}
+		if err != nil {
+			log.Println("external error:", err)
+		}
+		info.Status = status
+		return
 	}
 }
 
 type statusResponse struct {
-	Subdomains int `json:"subdomains"`
+	Subdomains  int                 `json:"subdomains"`
+	Tunnels     int                 `json:"tunnels"`
+	Compression compressionResponse `json:"compression"`
+}
+
+// compressionResponse sums up the payloads sent through tunnels since the server started
+type compressionResponse struct {
+	PayloadBytes    int64 `json:"payload_bytes"`
+	CompressedBytes int64 `json:"compressed_bytes"`
+	// CompressedBytes as a fraction of PayloadBytes
+	Ratio float64 `json:"ratio"`
 }
 
 func (s *LeapServer) getStatus(c *gin.Context) {
+	tunnels := s.registry.List()
+	subdomains := make(map[string]bool)
+	for _, tun := range tunnels {
+		subdomains[tun.name] = true
+	}
+
+	payloadBytes, compressedBytes := s.compression.Bytes()
 	resp := statusResponse{
-		Subdomains: len(s.tunnels),
+		Subdomains: len(subdomains),
+		Tunnels:    len(tunnels),
+		Compression: compressionResponse{
+			PayloadBytes:    payloadBytes,
+			CompressedBytes: compressedBytes,
+			Ratio:           s.compression.Ratio(),
+		},
 	}
 	c.JSON(http.StatusOK, resp)
 }
@@ -133,49 +345,167 @@ func readSubdomainRequest(r *http.Request) (*common.SubdomainRequest, error) {
 	return &payload, nil
 }
 
-func (s *LeapServer) isSubdomainAvailable(sub string) bool {
-	_, ok := s.tunnels[strings.ToLower(sub)]
-	return !ok
+func (s *LeapServer) isSubdomainAvailable(sub string, domain *baseDomain) bool {
+	return len(s.registry.Lookup(domain.tunnelName(strings.ToLower(sub)))) == 0
 }
 
-func (s *LeapServer) createNewTunnel(sub string) *Tunnel {
-	newTun := newTunnel(sub)
-	s.tunnels[sub] = newTun
-	return newTun
+// createNewTunnel issues a tunnel on the subdomain of domain, joining the existing group
+// if there is one. s.mu must be held.
+func (s *LeapServer) createNewTunnel(sr *common.SubdomainRequest, sub string, domain *baseDomain, key *APIKey) (*Tunnel, error) {
+	var group *tunnelGroup
+	if members := s.registry.Lookup(domain.tunnelName(sub)); len(members) > 0 {
+		group = members[0].group
+	} else {
+		group = newTunnelGroup(sr)
+		if s.cluster != nil {
+			group.generation = s.cluster.nextGeneration()
+		}
+	}
+
+	newTun := newTunnel(sub, domain, group)
+	newTun.limits = &limits{
+		usage: s.usage,
+		key:   key,
+		quota: domain.quota,
+	}
+	if domain.bandwidth > 0 {
+		newTun.limits.limiter = newBandwidthLimiter(domain.bandwidth)
+	}
+	if err := s.registry.Create(newTun); err != nil {
+		return nil, err
+	}
+	return newTun, nil
 }
 
 func (s *LeapServer) newTunnelRequest(c *gin.Context) {
+	if s.isDraining() {
+		c.String(http.StatusServiceUnavailable, "The server is shutting down")
+		return
+	}
+
 	sr, err := readSubdomainRequest(c.Request)
 	if err != nil {
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
+	if sr.Group {
+		if sr.GroupKey == "" {
+			c.String(http.StatusBadRequest, "Shared tunnels require a group key")
+			return
+		}
+		if sr.Balance != "" && sr.Balance != common.BalanceRoundRobin && sr.Balance != common.BalanceLeastInflight {
+			c.String(http.StatusBadRequest, "Unknown balance mode %q", sr.Balance)
+			return
+		}
+	}
+
+	if strings.Contains(sr.Subdomain, ".") {
+		c.String(http.StatusBadRequest, "Invalid subdomain %q", sr.Subdomain)
+		return
+	}
+
+	// the domain the client connected to, unless it asks for another
+	domainName := strings.ToLower(c.Request.Host)
+	if sr.Domain != "" {
+		domainName = strings.ToLower(sr.Domain)
+	}
+	domain, ok := s.conf().domain(domainName)
+	if !ok {
+		c.String(http.StatusBadRequest, "Unknown domain %q", sr.Domain)
+		return
+	}
+
+	var key *APIKey
+	if len(domain.apiKeys) > 0 {
+		if key, ok = domain.apiKeys[sr.APIKey]; !ok {
+			c.String(http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+		var name string
+		if sr.Subdomain != "" {
+			name = domain.tunnelName(sr.Subdomain)
+		}
+		keyUsage := s.setUsageHeaders(c, name, key, domain.quota)
+		if key.Quota > 0 && keyUsage.total() >= key.Quota {
+			c.String(http.StatusTooManyRequests, "The API key has used up its quota")
+			return
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		newTun, status, message := s.issueTunnel(sr, domain, key)
+		if newTun == nil {
+			c.String(status, message)
+			return
+		}
+
+		err := s.claimSubdomain(newTun.name, newTun.group.generation)
+		if err == nil {
+			s.emit(newTun.event(TunnelCreated))
+			resp := common.TokenResponse{
+				Token:     newTun.token,
+				Subdomain: newTun.subdomain,
+				Domain:    newTun.domain,
+			}
+			if !s.conf().DisableCompression {
+				resp.Encodings = []string{common.EncodingGzip}
+			}
+			s.setUsageHeaders(c, newTun.name, key, domain.quota)
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+
+		s.removeTunnel(newTun)
+		if !errors.Is(err, ErrSubdomainClaimed) {
+			log.Printf("Failed to claim %q in the cluster registry: %v\n", newTun.name, err)
+			c.String(http.StatusServiceUnavailable, "The cluster registry is unavailable")
+			return
+		}
+		if sr.Group && sr.Subdomain != "" {
+			c.String(http.StatusConflict, "The subdomain %q is served by another node of the cluster, members of a group must connect to the same node", newTun.subdomain)
+			return
+		}
+		if sr.Subdomain != "" || attempt == maxClaimAttempts {
+			c.String(http.StatusConflict, "A tunnel on the subdomain %q already exists", newTun.subdomain)
+			return
+		}
+	}
+}
+
+// issueTunnel creates a tunnel for the request on this node. If the request cannot be
+// satisfied, it returns nil with the status and message to respond with.
+func (s *LeapServer) issueTunnel(sr *common.SubdomainRequest, domain *baseDomain, key *APIKey) (*Tunnel, int, string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	reserved := s.conf().reserved
 	var subdomain string
 	if sr.Subdomain == "" { // wants random
 		randomSub := randomSubdomain()
-		for !s.isSubdomainAvailable(randomSub) {
+		for !s.isSubdomainAvailable(randomSub, domain) || reserved[randomSub] {
 			randomSub = randomSubdomain()
 		}
 		subdomain = randomSub
 	} else { // wants specific
-		if !s.isSubdomainAvailable(sr.Subdomain) {
-			c.String(http.StatusConflict, "A tunnel on the subdomain %q already exists", sr.Subdomain)
-			return
+		if reserved[sr.Subdomain] {
+			return nil, http.StatusForbidden, fmt.Sprintf("The subdomain %q is reserved", sr.Subdomain)
+		}
+		if members := s.registry.Lookup(domain.tunnelName(sr.Subdomain)); len(members) > 0 && !members[0].group.canJoin(sr) {
+			if members[0].group.shared && sr.Group {
+				return nil, http.StatusForbidden, fmt.Sprintf("Invalid group key for the subdomain %q", sr.Subdomain)
+			}
+			return nil, http.StatusConflict, fmt.Sprintf("A tunnel on the subdomain %q already exists", sr.Subdomain)
 		}
 		subdomain = sr.Subdomain
 	}
 
-	newTun := s.createNewTunnel(subdomain)
-	token := common.TokenResponse{
-		Token:     newTun.token,
-		Subdomain: subdomain,
+	newTun, err := s.createNewTunnel(sr, subdomain, domain, key)
+	if err != nil {
+		log.Printf("Failed to create tunnel %q: %v\n", domain.tunnelName(subdomain), err)
+		return nil, http.StatusInternalServerError, "Failed to create the tunnel"
 	}
-
-	c.JSON(http.StatusOK, token)
+	return newTun, 0, ""
 }
 
 func (s *LeapServer) connectTunnel(c *gin.Context) {
@@ -185,44 +515,54 @@ func (s *LeapServer) connectTunnel(c *gin.Context) {
 		return
 	}
 
-	found := false
-	for _, tun := range s.tunnels {
-		if tun.token == token {
-			conn, err := wsUpgrade.Upgrade(c.Writer, c.Request, nil)
-			if err != nil {
-				fmt.Println(err)
-				_ = c.AbortWithError(http.StatusInternalServerError, err)
-				return
-			}
-
-			found = true
-			tun.setTunnelConnection(conn)
-			go s.handleTunnelConnection(tun)
-		}
-	}
-
+	tun, found := s.registry.LookupToken(token)
 	if !found {
 		c.String(http.StatusBadRequest, "Invalid token")
+		return
+	}
+	if s.isDraining() {
+		c.String(http.StatusServiceUnavailable, "The server is shutting down")
+		return
+	}
+
+	conn, err := wsUpgrade.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		fmt.Println(err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
 	}
+
+	compress := !s.conf().DisableCompression && c.Query("encoding") == common.EncodingGzip
+	tun.setTunnelConnection(conn, compress, &s.compression)
+	go s.handleTunnelConnection(tun)
 }
 
 func (s *LeapServer) handleTunnelConnection(tun *Tunnel) {
 	defer func() {
-		if s.config.Debug {
-			log.Printf("Client %q disconnected\n", tun.subdomain)
+		if s.conf().Debug {
+			log.Printf("Client %q disconnected\n", tun.name)
 		}
 		_ = tun.ws.Close()
-		delete(s.tunnels, tun.subdomain)
+		s.removeTunnel(tun)
+		tun.failPending(common.Unavailable)
+		s.emit(tun.event(TunnelDisconnected))
 	}()
 
-	if s.config.Debug {
-		log.Printf("Client %q connected\n", tun.subdomain)
+	if s.conf().Debug {
+		log.Printf("Client %q connected\n", tun.name)
 	}
+	s.emit(tun.event(TunnelConnected))
+
+	done := make(chan struct{})
+	defer close(done)
+	common.KeepAlive(tun.ws, s.conf().PingInterval, s.conf().PingTimeout, done)
 
 	for {
 		_, data, err := tun.ws.ReadMessage()
 		if err != nil {
-			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			if isTimeout(err) {
+				log.Printf("Client %q stopped responding to pings\n", tun.name)
+			} else if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				log.Println("read:", err)
 			} else {
 				_ = tun.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "closing"), time.Now().Add(time.Second))
@@ -235,6 +575,72 @@ func (s *LeapServer) handleTunnelConnection(tun *Tunnel) {
 	}
 }
 
+func (s *LeapServer) removeTunnel(tun *Tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteTunnel(tun)
+}
+
+// deleteTunnel removes tun from the registry. Once no tunnel serves its subdomain, the
+// subdomain is released along with its custom hostnames. s.mu must be held.
+func (s *LeapServer) deleteTunnel(tun *Tunnel) {
+	if !s.registry.Remove(tun) {
+		return
+	}
+	if len(s.registry.Lookup(tun.name)) == 0 {
+		s.unbindHostnames(tun.name)
+		go s.releaseSubdomain(tun.name, tun.group.generation)
+	}
+}
+
+func (s *LeapServer) reapTunnels(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.reapExpired(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reapExpired removes tunnels whose token was never used before the connect
+// deadline and closes connected tunnels that have exceeded the idle timeout
+func (s *LeapServer) reapExpired(now time.Time) {
+	var expired []*Tunnel // reported once s.mu is released
+	defer func() {
+		for _, tun := range expired {
+			s.emit(tun.event(TunnelExpired))
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tun := range s.registry.List() {
+		lastActive := tun.lastActivity()
+		if lastActive.IsZero() {
+			if s.conf().ConnectTimeout > 0 && now.Sub(tun.created) > s.conf().ConnectTimeout {
+				log.Printf("Tunnel %q expired before connecting\n", tun.name)
+				s.deleteTunnel(tun)
+				expired = append(expired, tun)
+			}
+		} else if s.conf().IdleTimeout > 0 && now.Sub(lastActive) > s.conf().IdleTimeout && tun.pendingCount() == 0 {
+			log.Printf("Tunnel %q closed after being idle for %v\n", tun.name, now.Sub(lastActive).Truncate(time.Second))
+			_ = tun.closeConnection(websocket.CloseNormalClosure, "idle timeout", time.Now().Add(time.Second))
+			s.deleteTunnel(tun)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func randomSubdomain() string {
 	var hexDigits = []rune("0123456789abcdef")
 	b := make([]rune, 6)
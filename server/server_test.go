@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with config in effect, without starting it
+func newTestServer(t *testing.T, config *Config) *LeapServer {
+	if config.Domain == "" {
+		config.Domain = "leap.example.com"
+	}
+	s := New(config)
+	live, err := newLiveConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.Store(live)
+	return s
+}
+
+// testServer is a server listening on a local port, reached through the hosts it serves
+type testServer struct {
+	*LeapServer
+	addr    string
+	servers []*http.Server
+}
+
+// startTestServer starts serving config on a local port
+func startTestServer(t *testing.T, config *Config) *testServer {
+	config.Bind = "127.0.0.1:0"
+	s := newTestServer(t, config)
+	servers, err := s.makeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{LeapServer: s, addr: s.listeners["bind"].Addr().String(), servers: servers}
+}
+
+func (ts *testServer) Close() {
+	_ = ts.drain(ts.servers)
+}
+
+// request sends a request to host through the server
+func (ts *testServer) request(t *testing.T, method, host, path string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+ts.addr+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// requestTunnel asks for a tunnel token, returning the response status along with it
+func (ts *testServer) requestTunnel(t *testing.T, sr common.SubdomainRequest) (int, common.TokenResponse) {
+	t.Helper()
+	b, _ := json.Marshal(sr)
+	resp := ts.request(t, http.MethodPost, ts.conf().domains[0].name, "/api/tunnel", b)
+	defer resp.Body.Close()
+
+	var token common.TokenResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, token
+}
+
+// openTunnel opens a tunnel and returns the client's end of its connection
+func (ts *testServer) openTunnel(t *testing.T, sr common.SubdomainRequest) *websocket.Conn {
+	t.Helper()
+	status, token := ts.requestTunnel(t, sr)
+	if status != http.StatusOK {
+		t.Fatalf("tunnel request failed with status %d", status)
+	}
+	header := http.Header{"Host": {ts.conf().domains[0].name}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+ts.addr+"/api/connect?token="+token.Token, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// readMessage returns the type of the next message the server sends through the tunnel,
+// along with the message
+func readMessage(t *testing.T, ws *websocket.Conn) (common.MessageType, []byte) {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, raw, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("no message from the server: %v", err)
+	}
+	var message common.WSMessage
+	if err := json.Unmarshal(raw, &message); err != nil {
+		t.Fatal(err)
+	}
+	return message.MessageType(), raw
+}
+
+// readRequest returns the next request sent through the tunnel
+func readRequest(t *testing.T, ws *websocket.Conn) *common.RequestMessage {
+	t.Helper()
+	typ, raw := readMessage(t, ws)
+	var request common.RequestMessage
+	if err := json.Unmarshal(raw, &request); err != nil || typ != common.Request {
+		t.Fatalf("message = %s, want a request", raw)
+	}
+	return &request
+}
+
+// respond answers a request sent through the tunnel with a raw response
+func respond(t *testing.T, ws *websocket.Conn, id uint64, raw string) {
+	t.Helper()
+	encoded, encoding := common.EncodePayload([]byte(raw), false)
+	if err := ws.WriteJSON(common.NewResponseDataMessage(id, encoded, encoding)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// answer answers every request sent through the tunnel with body, until the connection
+// closes
+func answer(ws *websocket.Conn, body string) {
+	response := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	for {
+		_, raw, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request common.RequestMessage
+		if json.Unmarshal(raw, &request) != nil || request.MessageType() != common.Request {
+			continue
+		}
+		encoded, encoding := common.EncodePayload([]byte(response), false)
+		_ = ws.WriteJSON(common.NewResponseDataMessage(request.ID, encoded, encoding))
+	}
+}
+
+// readBody reads and closes the body of resp
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReapExpired(t *testing.T) {
+	start := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		connectTimeout time.Duration
+		idleTimeout    time.Duration
+		// when the tunnel was last active, or zero if it never connected
+		lastActive time.Time
+		pending    bool
+		now        time.Time
+		removed    bool
+	}{
+		{
+			name:           "unconnected within the connect timeout",
+			connectTimeout: time.Minute,
+			now:            start.Add(time.Minute),
+		},
+		{
+			name:           "unconnected past the connect timeout",
+			connectTimeout: time.Minute,
+			now:            start.Add(time.Minute + time.Second),
+			removed:        true,
+		},
+		{
+			name: "unconnected without a connect timeout",
+			now:  start.Add(time.Hour),
+		},
+		{
+			name:        "active within the idle timeout",
+			idleTimeout: time.Minute,
+			lastActive:  start.Add(time.Hour),
+			now:         start.Add(time.Hour + time.Minute),
+		},
+		{
+			name:        "idle past the idle timeout",
+			idleTimeout: time.Minute,
+			lastActive:  start.Add(time.Hour),
+			now:         start.Add(time.Hour + time.Minute + time.Second),
+			removed:     true,
+		},
+		{
+			name:        "idle with a request in flight",
+			idleTimeout: time.Minute,
+			lastActive:  start,
+			pending:     true,
+			now:         start.Add(time.Hour),
+		},
+		{
+			name:           "connected past the connect timeout",
+			connectTimeout: time.Minute,
+			lastActive:     start,
+			now:            start.Add(time.Hour),
+		},
+		{
+			name:       "idle without an idle timeout",
+			lastActive: start,
+			now:        start.Add(time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, &Config{ConnectTimeout: tt.connectTimeout, IdleTimeout: tt.idleTimeout})
+			tun, _, message := s.issueTunnel(&common.SubdomainRequest{Subdomain: "foo"}, s.conf().domains[0], nil)
+			if tun == nil {
+				t.Fatalf("issueTunnel() failed: %s", message)
+			}
+			tun.created = start
+			if !tt.lastActive.IsZero() {
+				atomic.StoreInt64(&tun.lastActive, tt.lastActive.UnixNano())
+			}
+			if tt.pending {
+				tun.pending[1] = &pendingRequest{}
+			}
+
+			s.reapExpired(tt.now)
+			if _, ok := s.registry.LookupToken(tun.token); ok == tt.removed {
+				t.Errorf("tunnel registered = %t, want %t", ok, !tt.removed)
+			}
+		})
+	}
+}
+
+func TestIdleTunnelClosed(t *testing.T) {
+	s := startTestServer(t, &Config{IdleTimeout: time.Minute})
+	defer s.Close()
+
+	ws := s.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+	defer ws.Close()
+	s.reapExpired(time.Now().Add(time.Minute + time.Second))
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) || err.(*websocket.CloseError).Text != "idle timeout" {
+		t.Errorf("read error = %v, want a normal close for the idle timeout", err)
+	}
+	resp := s.request(t, http.MethodGet, "foo.leap.example.com", "/", nil)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d once closed", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := startTestServer(t, &Config{RequestTimeout: 100 * time.Millisecond})
+	defer s.Close()
+
+	ws := s.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+	defer ws.Close()
+
+	resp := s.request(t, http.MethodGet, "foo.leap.example.com", "/slow", nil)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	request := readRequest(t, ws)
+	typ, raw := readMessage(t, ws)
+	var cancel common.CancelMessage
+	if err := json.Unmarshal(raw, &cancel); err != nil || typ != common.Cancel || cancel.ID != request.ID {
+		t.Errorf("message = %s, want the cancellation of request %d", raw, request.ID)
+	}
+
+	// a late response is dropped without disturbing the next request
+	respond(t, ws, request.ID, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nlate")
+	_ = ws.SetReadDeadline(time.Time{})
+	go answer(ws, "next")
+	resp = s.request(t, http.MethodGet, "foo.leap.example.com", "/next", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "next" {
+		t.Errorf("next response = %d %q, want 200 \"next\"", resp.StatusCode, body)
+	}
+}
+
+func TestRequestAbandoned(t *testing.T) {
+	s := startTestServer(t, &Config{})
+	defer s.Close()
+
+	ws := s.openTunnel(t, common.SubdomainRequest{Subdomain: "foo"})
+	defer ws.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.addr+"/slow", nil)
+	req.Host = "foo.leap.example.com"
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req.WithContext(ctx))
+		failed <- err
+	}()
+
+	request := readRequest(t, ws)
+	cancel()
+	if err := <-failed; err == nil {
+		t.Fatal("the request succeeded, want it canceled")
+	}
+	typ, raw := readMessage(t, ws)
+	var message common.CancelMessage
+	if err := json.Unmarshal(raw, &message); err != nil || typ != common.Cancel || message.ID != request.ID {
+		t.Errorf("message = %s, want the cancellation of request %d", raw, request.ID)
+	}
+}
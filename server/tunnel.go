@@ -1,13 +1,13 @@
 package server
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/dnsge/leap/common"
 	"github.com/gorilla/websocket"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,34 +26,175 @@ func generateToken(length int) string {
 }
 
 type Tunnel struct {
+	// unix nanoseconds of the last tunnel traffic, zero until connected. Accessed atomically.
+	lastActive int64
+
+	// registry key of the tunnel, see baseDomain.tunnelName
+	name      string
 	subdomain string
+	domain    string
 	token     string
+	created   time.Time
+	group     *tunnelGroup
+	limits    *limits
 
-	mu           sync.Mutex
-	responseChan chan *common.ResponseDataMessage
-	errorChan    chan *common.ResponseErrorMessage
+	// mu guards writes to ws and the pending request map
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingRequest
 
 	ws *websocket.Conn
+	// whether the client accepts compressed requests
+	compress    bool
+	compression *common.CompressionStats
+}
+
+// pendingRequest receives the client's reply to a request sent through the tunnel
+type pendingRequest struct {
+	responseChan chan *common.ResponseDataMessage
+	errorChan    chan *common.ResponseErrorMessage
 }
 
-func newTunnel(subdomain string) *Tunnel {
+func newTunnel(subdomain string, domain *baseDomain, group *tunnelGroup) *Tunnel {
 	return &Tunnel{
-		subdomain:    subdomain,
-		token:        generateToken(64),
-		responseChan: make(chan *common.ResponseDataMessage),
-		errorChan:    make(chan *common.ResponseErrorMessage),
-		ws:           nil,
+		name:      domain.tunnelName(subdomain),
+		subdomain: subdomain,
+		domain:    domain.name,
+		group:     group,
+		token:     generateToken(64),
+		created:   time.Now(),
+		pending:   make(map[uint64]*pendingRequest),
+		ws:        nil,
 	}
 }
 
-func (t *Tunnel) sendRawRequest(b []byte) error {
+func (t *Tunnel) Subdomain() string {
+	return t.subdomain
+}
+
+// Domain returns the base domain the tunnel is served under
+func (t *Tunnel) Domain() string {
+	return t.domain
+}
+
+// Name returns the name the tunnel is registered under: its subdomain on the primary
+// domain and subdomain.domain on the others
+func (t *Tunnel) Name() string {
+	return t.name
+}
+
+// event returns an event of type t about the tunnel
+func (t *Tunnel) event(typ EventType) Event {
+	return Event{Type: typ, Subdomain: t.subdomain, Domain: t.domain}
+}
+
+func (t *Tunnel) Token() string {
+	return t.token
+}
+
+func (t *Tunnel) Created() time.Time {
+	return t.created
+}
+
+// sendRawRequest forwards a raw HTTP request to the client. The caller must call
+// finishRequest with the returned id once it stops waiting for the reply.
+func (t *Tunnel) sendRawRequest(b []byte) (uint64, *pendingRequest, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	if t.ws == nil {
 		panic("trying to send data on nil connection")
 	}
 
-	return t.ws.WriteJSON(common.RequestMessage{
-		Data: base64.StdEncoding.EncodeToString(b),
-	})
+	t.nextID++
+	id := t.nextID
+	p := &pendingRequest{
+		responseChan: make(chan *common.ResponseDataMessage, 1),
+		errorChan:    make(chan *common.ResponseErrorMessage, 1),
+	}
+
+	t.touch()
+	data, encoding := common.EncodePayload(b, t.compress)
+	t.compression.Add(b, data)
+	if err := t.ws.WriteJSON(common.NewRequestMessage(id, data, encoding)); err != nil {
+		return 0, nil, err
+	}
+
+	t.pending[id] = p
+	return id, p, nil
+}
+
+// finishRequest stops tracking a request, counting its end as activity so that the idle
+// timeout runs from the last request to finish
+func (t *Tunnel) finishRequest(id uint64) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+	t.touch()
+}
+
+// cancelRequest stops waiting for the reply to a request and tells the client to abort it
+func (t *Tunnel) cancelRequest(id uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.pending[id]; !ok {
+		return nil
+	}
+	delete(t.pending, id)
+	return t.ws.WriteJSON(common.NewCancelMessage(id))
+}
+
+// failPending replies to every request still waiting on the tunnel with an error
+func (t *Tunnel) failPending(code common.ErrorCode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, p := range t.pending {
+		p.errorChan <- common.NewResponseErrorMessage(id, code)
+		delete(t.pending, id)
+	}
+}
+
+// closeConnection asks the client to close the tunnel's connection, if it has one
+func (t *Tunnel) closeConnection(code int, text string, deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ws == nil {
+		return nil
+	}
+	return t.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+}
+
+func (t *Tunnel) pendingCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// takePending removes and returns the request waiting on id. Replies to requests
+// that are no longer pending are dropped.
+func (t *Tunnel) takePending(id uint64) (*pendingRequest, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[id]
+	delete(t.pending, id)
+	return p, ok
+}
+
+func (t *Tunnel) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// lastActivity returns the time of the last tunnel traffic, or the zero time if the
+// tunnel has never been connected
+func (t *Tunnel) lastActivity() time.Time {
+	n := atomic.LoadInt64(&t.lastActive)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
 }
 
 func (t *Tunnel) handleRawMessage(data []byte) error {
@@ -62,6 +203,7 @@ func (t *Tunnel) handleRawMessage(data []byte) error {
 		return err
 	}
 
+	t.touch()
 	msgType := message.MessageType()
 
 	switch msgType {
@@ -70,13 +212,17 @@ func (t *Tunnel) handleRawMessage(data []byte) error {
 		if err := json.Unmarshal(data, &r); err != nil {
 			return err
 		}
-		t.responseChan <- &r
+		if p, ok := t.takePending(r.ID); ok {
+			p.responseChan <- &r
+		}
 	case common.ResponseError:
 		var r common.ResponseErrorMessage
 		if err := json.Unmarshal(data, &r); err != nil {
 			return err
 		}
-		t.errorChan <- &r
+		if p, ok := t.takePending(r.ID); ok {
+			p.errorChan <- &r
+		}
 	default:
 		return fmt.Errorf("handleRawMessage: unexpected message type %v", msgType)
 	}
@@ -84,8 +230,14 @@ func (t *Tunnel) handleRawMessage(data []byte) error {
 	return nil
 }
 
-func (t *Tunnel) setTunnelConnection(conn *websocket.Conn) {
+// setTunnelConnection attaches the client's websocket, counting the payloads sent through
+// it in stats
+func (t *Tunnel) setTunnelConnection(conn *websocket.Conn, compress bool, stats *common.CompressionStats) {
+	conn.SetReadLimit(common.MaxMessageSize)
 	t.mu.Lock()
 	t.ws = conn
+	t.compress = compress
+	t.compression = stats
 	t.mu.Unlock()
+	t.touch()
 }
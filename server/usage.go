@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dnsge/leap/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaPeriod is how often usage is reset
+type QuotaPeriod string
+
+const (
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// APIKey lets clients open tunnels. Its quota applies to all of its tunnels together.
+type APIKey struct {
+	Key  string
+	Name string
+	// Bytes the key's tunnels may transfer per quota period, or zero for no quota
+	Quota int64
+	// Base domain the key opens tunnels on, or empty for Config.Domain
+	Domain string
+}
+
+// ParseAPIKey parses a key of the form KEY[;name=NAME][;quota=SIZE][;domain=DOMAIN], for
+// example "s3cret;name=alice;quota=10g". The name defaults to one derived from the key,
+// see defaultKeyName.
+func ParseAPIKey(s string) (APIKey, error) {
+	parts := strings.Split(s, ";")
+	k := APIKey{Key: strings.TrimSpace(parts[0])}
+	if k.Key == "" {
+		return APIKey{}, errors.New("api key: missing key")
+	}
+
+	for _, part := range parts[1:] {
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			return APIKey{}, fmt.Errorf("api key: expected KEY=VALUE, got %q", part)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(part[:eq])), strings.TrimSpace(part[eq+1:])
+		switch key {
+		case "name":
+			k.Name = value
+		case "quota":
+			quota, err := common.ParseSize(value)
+			if err != nil {
+				return APIKey{}, fmt.Errorf("api key: %w", err)
+			}
+			k.Quota = quota
+		case "domain":
+			k.Domain = strings.ToLower(value)
+		default:
+			return APIKey{}, fmt.Errorf("api key: unknown option %q", key)
+		}
+	}
+
+	if k.Name == "" {
+		k.Name = defaultKeyName(k.Key)
+	}
+	return k, nil
+}
+
+// defaultKeyName names a key in usage reports, logs and events without revealing it
+func defaultKeyName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// usage is the traffic of a subdomain or an API key in the current period. Bytes in
+// are those of requests, bytes out those of responses.
+type usage struct {
+	In  int64 `json:"bytes_in"`
+	Out int64 `json:"bytes_out"`
+}
+
+func (u usage) total() int64 {
+	return u.In + u.Out
+}
+
+// usageTracker counts the traffic of subdomains and API keys, resetting every period
+type usageTracker struct {
+	period QuotaPeriod
+
+	mu      sync.Mutex
+	start   time.Time
+	tunnels map[string]*usage // by subdomain
+	keys    map[string]*usage // by API key name
+}
+
+func newUsageTracker(period QuotaPeriod) *usageTracker {
+	u := &usageTracker{period: period}
+	u.reset(time.Now())
+	return u
+}
+
+// periodStart returns when the period containing t began
+func (u *usageTracker) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if u.period == QuotaDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// periodEnd returns when the current period ends. The caller must hold mu.
+func (u *usageTracker) periodEnd() time.Time {
+	if u.period == QuotaDaily {
+		return u.start.AddDate(0, 0, 1)
+	}
+	return u.start.AddDate(0, 1, 0)
+}
+
+func (u *usageTracker) reset(now time.Time) {
+	u.start = u.periodStart(now)
+	u.tunnels = make(map[string]*usage)
+	u.keys = make(map[string]*usage)
+}
+
+// rollover starts a new period if the current one is over. The caller must hold mu.
+func (u *usageTracker) rollover() {
+	if now := time.Now(); !now.Before(u.periodEnd()) {
+		u.reset(now)
+	}
+}
+
+func (u *usageTracker) add(subdomain, key string, in, out int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+
+	counters := []*usage{u.counter(u.tunnels, subdomain)}
+	if key != "" {
+		counters = append(counters, u.counter(u.keys, key))
+	}
+	for _, c := range counters {
+		c.In += in
+		c.Out += out
+	}
+}
+
+func (u *usageTracker) counter(m map[string]*usage, name string) *usage {
+	c, ok := m[name]
+	if !ok {
+		c = &usage{}
+		m[name] = c
+	}
+	return c
+}
+
+// used returns the usage of a subdomain and an API key in the current period, and
+// when it ends
+func (u *usageTracker) used(subdomain, key string) (usage, usage, time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+
+	var tunnelUsage, keyUsage usage
+	if c, ok := u.tunnels[subdomain]; ok {
+		tunnelUsage = *c
+	}
+	if c, ok := u.keys[key]; ok {
+		keyUsage = *c
+	}
+	return tunnelUsage, keyUsage, u.periodEnd()
+}
+
+// snapshot copies the usage of every subdomain and API key in the current period
+func (u *usageTracker) snapshot() (time.Time, time.Time, map[string]usage, map[string]usage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+
+	tunnels := make(map[string]usage, len(u.tunnels))
+	for name, c := range u.tunnels {
+		tunnels[name] = *c
+	}
+	keys := make(map[string]usage, len(u.keys))
+	for name, c := range u.keys {
+		keys[name] = *c
+	}
+	return u.start, u.periodEnd(), tunnels, keys
+}
+
+// bandwidthLimiter paces transfers so that they don't exceed a rate on average
+type bandwidthLimiter struct {
+	rate int64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // when the transfers so far are done at the rate
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes may be transferred, or ctx is done
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limits are the quotas and throttle that apply to a tunnel
+type limits struct {
+	usage *usageTracker
+	// API key the tunnel was opened with, if any
+	key *APIKey
+	// Bytes the tunnel's subdomain may transfer per period, or zero for no quota
+	quota   int64
+	limiter *bandwidthLimiter
+}
+
+func (l *limits) keyName() string {
+	if l.key == nil {
+		return ""
+	}
+	return l.key.Name
+}
+
+// quotaExceeded reports whether the tunnel's subdomain or API key used up its quota
+func (l *limits) quotaExceeded(subdomain string) bool {
+	tunnelUsage, keyUsage, _ := l.usage.used(subdomain, l.keyName())
+	if l.quota > 0 && tunnelUsage.total() >= l.quota {
+		return true
+	}
+	return l.key != nil && l.key.Quota > 0 && keyUsage.total() >= l.key.Quota
+}
+
+// throttle waits until n bytes may pass through the tunnel
+func (l *limits) throttle(ctx context.Context, n int) error {
+	if l.limiter == nil {
+		return nil
+	}
+	return l.limiter.wait(ctx, n)
+}
+
+func (l *limits) account(subdomain string, in, out int) {
+	l.usage.add(subdomain, l.keyName(), int64(in), int64(out))
+}
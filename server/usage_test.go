@@ -0,0 +1,155 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAPIKey(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    APIKey
+		wantErr bool
+	}{
+		{in: "s3cret", want: APIKey{Key: "s3cret", Name: "key-1ec1c26b"}},
+		{in: " s3cret ; name = alice ", want: APIKey{Key: "s3cret", Name: "alice"}},
+		{in: "s3cret;name=alice;quota=10g", want: APIKey{Key: "s3cret", Name: "alice", Quota: 10 << 30}},
+		{in: "s3cret;QUOTA=512", want: APIKey{Key: "s3cret", Name: "key-1ec1c26b", Quota: 512}},
+		{in: "s3cret;domain=Leap.Partners.com", want: APIKey{Key: "s3cret", Name: "key-1ec1c26b", Domain: "leap.partners.com"}},
+		{in: "", wantErr: true},
+		{in: ";name=alice", wantErr: true},
+		{in: "s3cret;alice", wantErr: true},
+		{in: "s3cret;quota=lots", wantErr: true},
+		{in: "s3cret;quota=-1", wantErr: true},
+		{in: "s3cret;owner=alice", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseAPIKey(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseAPIKey(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAPIKey(%q) error: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAPIKey(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	type transfer struct {
+		subdomain string
+		in, out   int
+	}
+
+	tests := []struct {
+		name      string
+		quota     int64
+		key       *APIKey
+		transfers []transfer
+		exceeded  bool
+	}{
+		{
+			name:      "no quotas",
+			transfers: []transfer{{"foo", 1 << 20, 1 << 20}},
+		},
+		{
+			name:      "under tunnel quota",
+			quota:     100,
+			transfers: []transfer{{"foo", 40, 59}},
+		},
+		{
+			name:      "tunnel quota used up",
+			quota:     100,
+			transfers: []transfer{{"foo", 40, 60}},
+			exceeded:  true,
+		},
+		{
+			name:      "tunnel quota counts only its subdomain",
+			quota:     100,
+			transfers: []transfer{{"bar", 100, 100}, {"foo", 10, 10}},
+		},
+		{
+			name:      "under key quota",
+			key:       &APIKey{Key: "k", Name: "alice", Quota: 100},
+			transfers: []transfer{{"foo", 30, 0}, {"bar", 0, 69}},
+		},
+		{
+			name:      "key quota shared by its tunnels",
+			key:       &APIKey{Key: "k", Name: "alice", Quota: 100},
+			transfers: []transfer{{"foo", 30, 20}, {"bar", 25, 25}},
+			exceeded:  true,
+		},
+		{
+			name:      "key without quota",
+			key:       &APIKey{Key: "k", Name: "alice"},
+			transfers: []transfer{{"foo", 1 << 20, 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &limits{usage: newUsageTracker(QuotaMonthly), key: tt.key, quota: tt.quota}
+			for _, tr := range tt.transfers {
+				l.account(tr.subdomain, tr.in, tr.out)
+			}
+			if got := l.quotaExceeded("foo"); got != tt.exceeded {
+				t.Errorf("quotaExceeded() = %v, want %v", got, tt.exceeded)
+			}
+		})
+	}
+}
+
+func TestUsageTrackerPeriod(t *testing.T) {
+	now := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+	tests := []struct {
+		period    QuotaPeriod
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{QuotaDaily, time.Date(2021, time.March, 14, 0, 0, 0, 0, time.UTC), time.Date(2021, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{QuotaMonthly, time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.period), func(t *testing.T) {
+			u := &usageTracker{period: tt.period}
+			u.reset(now)
+			if !u.start.Equal(tt.wantStart) {
+				t.Errorf("start = %v, want %v", u.start, tt.wantStart)
+			}
+			if end := u.periodEnd(); !end.Equal(tt.wantEnd) {
+				t.Errorf("periodEnd() = %v, want %v", end, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestUsageTrackerCounts(t *testing.T) {
+	u := newUsageTracker(QuotaDaily)
+	u.add("foo", "alice", 10, 20)
+	u.add("foo", "", 1, 2)
+	u.add("bar", "alice", 100, 200)
+
+	tests := []struct {
+		subdomain, key      string
+		wantTunnel, wantKey usage
+	}{
+		{"foo", "alice", usage{11, 22}, usage{110, 220}},
+		{"bar", "alice", usage{100, 200}, usage{110, 220}},
+		{"baz", "bob", usage{}, usage{}},
+	}
+	for _, tt := range tests {
+		tunnelUsage, keyUsage, _ := u.used(tt.subdomain, tt.key)
+		if tunnelUsage != tt.wantTunnel || keyUsage != tt.wantKey {
+			t.Errorf("used(%q, %q) = %+v, %+v, want %+v, %+v", tt.subdomain, tt.key, tunnelUsage, keyUsage, tt.wantTunnel, tt.wantKey)
+		}
+	}
+}